@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
+)
+
+// activeListener is a protocol listener that's being served, as reported by
+// the admin API.
+type activeListener struct {
+	protocol string
+	addr     string
+	listener net.Listener
+	conns    *int64
+}
+
+type adminListener struct {
+	Protocol          string `json:"protocol"`
+	ConfiguredAddr    string `json:"configuredAddr"`
+	Addr              string `json:"addr"`
+	ActiveConnections int64  `json:"activeConnections"`
+}
+
+type adminSessionTicketKeys struct {
+	Addr           string   `json:"addr"`
+	Fingerprints   []string `json:"fingerprints"`
+	KeyRingVersion int64    `json:"keyRingVersion,omitempty"`
+}
+
+// trackActiveListener wraps the given protocol listener to count its
+// connections and remembers it for the admin API.
+func (p *Proxy) trackActiveListener(protocol, addr string, l net.Listener) net.Listener {
+	conns := new(int64)
+	p.activeListeners = append(p.activeListeners, &activeListener{
+		protocol: protocol,
+		addr:     addr,
+		listener: l,
+		conns:    conns,
+	})
+	return listeners.NewCountingListener(l, conns)
+}
+
+// trackSessionTicketKeysInspector remembers the given TLS listener so that the
+// admin API can report its session ticket keys.
+func (p *Proxy) trackSessionTicketKeysInspector(l net.Listener) {
+	if inspector, ok := l.(tlslistener.SessionTicketKeysInspector); ok {
+		p.sessionTicketKeyInspectors = append(p.sessionTicketKeyInspectors, inspector)
+	}
+}
+
+// listenAndServeAdmin serves the admin API at AdminAddr until ctx is done.
+// All requests need to carry AdminToken as a bearer token.
+func (p *Proxy) listenAndServeAdmin(ctx context.Context) error {
+	if p.AdminToken == "" {
+		return errors.New("Admin API requires a token")
+	}
+	l, err := net.Listen("tcp", p.AdminAddr)
+	if err != nil {
+		return errors.New("Unable to listen for admin API at %v: %v", p.AdminAddr, err)
+	}
+	srv := &http.Server{
+		Handler:           p.adminHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		log.Debugf("Serving admin API at %v", l.Addr())
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Error serving admin API: %v", err)
+		}
+	}()
+	return nil
+}
+
+func (p *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/listeners", p.adminListeners)
+	mux.HandleFunc("/connections", p.adminConnections)
+	mux.HandleFunc("/throttle", p.adminThrottle)
+	mux.HandleFunc("/blacklist", p.adminBlacklist)
+	mux.HandleFunc("/usage", p.adminUsage)
+	mux.HandleFunc("/sessionticketkeys", p.adminSessionTicketKeys)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !p.adminAuthorized(req) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+func (p *Proxy) adminAuthorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && p.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(p.AdminToken)) == 1
+}
+
+func (p *Proxy) adminListeners(w http.ResponseWriter, req *http.Request) {
+	result := make([]*adminListener, 0, len(p.activeListeners))
+	for _, l := range p.activeListeners {
+		result = append(result, &adminListener{
+			Protocol:          l.protocol,
+			ConfiguredAddr:    l.addr,
+			Addr:              l.listener.Addr().String(),
+			ActiveConnections: atomic.LoadInt64(l.conns),
+		})
+	}
+	writeAdminJSON(w, result)
+}
+
+func (p *Proxy) adminConnections(w http.ResponseWriter, req *http.Request) {
+	result := make(map[string]int64, len(p.activeListeners))
+	for _, l := range p.activeListeners {
+		result[l.protocol] += atomic.LoadInt64(l.conns)
+	}
+	writeAdminJSON(w, result)
+}
+
+func (p *Proxy) adminThrottle(w http.ResponseWriter, req *http.Request) {
+	var result throttle.SettingsByCountryAndPlatform
+	if p.throttleConfig != nil {
+		result = p.throttleConfig.AllSettings()
+	}
+	writeAdminJSON(w, result)
+}
+
+func (p *Proxy) adminBlacklist(w http.ResponseWriter, req *http.Request) {
+	var result *blacklist.Snapshot
+	if p.blacklist != nil {
+		result = p.blacklist.Snapshot()
+	}
+	writeAdminJSON(w, result)
+}
+
+func (p *Proxy) adminUsage(w http.ResponseWriter, req *http.Request) {
+	deviceID := req.URL.Query().Get("device")
+	if deviceID == "" {
+		http.Error(w, "missing device parameter", http.StatusBadRequest)
+		return
+	}
+	var u *usage.Usage
+	if p.usage != nil {
+		u, _ = p.usage.Peek(deviceID)
+	}
+	if u == nil {
+		http.Error(w, "no usage for device", http.StatusNotFound)
+		return
+	}
+	writeAdminJSON(w, u)
+}
+
+func (p *Proxy) adminSessionTicketKeys(w http.ResponseWriter, req *http.Request) {
+	result := make([]*adminSessionTicketKeys, 0, len(p.sessionTicketKeyInspectors))
+	for _, inspector := range p.sessionTicketKeyInspectors {
+		keys := &adminSessionTicketKeys{
+			Fingerprints:   inspector.SessionTicketKeyFingerprints(),
+			KeyRingVersion: inspector.SessionTicketKeyRingVersion(),
+		}
+		if l, ok := inspector.(net.Listener); ok {
+			keys.Addr = l.Addr().String()
+		}
+		result = append(result, keys)
+	}
+	writeAdminJSON(w, result)
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Errorf("Unable to write admin response: %v", err)
+	}
+}
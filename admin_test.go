@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
+)
+
+func TestAdminAuthorization(t *testing.T) {
+	p := &Proxy{AdminToken: "secret"}
+	handler := p.adminHandler()
+
+	for _, auth := range []string{"", "Bearer wrong", "secret"} {
+		req := httptest.NewRequest(http.MethodGet, "/connections", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, auth)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/connections", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAdminViews(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	p := &Proxy{
+		AdminToken:     "secret",
+		throttleConfig: throttle.NewForcedConfig(1000, 100, throttle.Daily),
+		usage:          usage.New(usage.Options{}),
+	}
+	l = p.trackActiveListener("https", "127.0.0.1:0", l)
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	conn, err := l.Accept()
+	require.NoError(t, err)
+
+	get := func(path string, result interface{}) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		p.adminHandler().ServeHTTP(rec, req)
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), result))
+		}
+		return rec.Code
+	}
+
+	var connections map[string]int64
+	require.Equal(t, http.StatusOK, get("/connections", &connections))
+	assert.Equal(t, map[string]int64{"https": 1}, connections)
+
+	conn.Close()
+	require.Equal(t, http.StatusOK, get("/connections", &connections))
+	assert.Equal(t, map[string]int64{"https": 0}, connections)
+
+	var activeListeners []*adminListener
+	require.Equal(t, http.StatusOK, get("/listeners", &activeListeners))
+	if assert.Len(t, activeListeners, 1) {
+		assert.Equal(t, "https", activeListeners[0].Protocol)
+		assert.Equal(t, l.Addr().String(), activeListeners[0].Addr)
+	}
+
+	var settings throttle.SettingsByCountryAndPlatform
+	require.Equal(t, http.StatusOK, get("/throttle", &settings))
+	assert.EqualValues(t, 100, settings["default"]["default"][0].Rate)
+
+	p.usage.Set("admin-device", "ir", 2000, 3000, time.Now(), 60)
+	var u usage.Usage
+	require.Equal(t, http.StatusOK, get("/usage?device=admin-device", &u))
+	assert.EqualValues(t, 5000, u.Bytes)
+	assert.Equal(t, "ir", u.CountryCode)
+	assert.Equal(t, http.StatusNotFound, get("/usage?device=unknown-device", &u))
+	assert.Equal(t, http.StatusBadRequest, get("/usage", &u))
+}
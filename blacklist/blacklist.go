@@ -6,9 +6,13 @@ package blacklist
 import (
 	"context"
 	"fmt"
+	"net"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/getlantern/errors"
+	"github.com/getlantern/geo"
 	"github.com/getlantern/golog"
 
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
@@ -30,16 +34,62 @@ const (
 	// DefaultExpiration is used fro Expiration if a non-positive value is
 	// specified.
 	DefaultExpiration = 6 * time.Hour
+
+	// DefaultSyncInterval is used for SyncInterval if a non-positive value is
+	// specified.
+	DefaultSyncInterval = 1 * time.Minute
+)
+
+const (
+	// ReasonIdle means that the IP repeatedly connected without successfully
+	// sending an HTTP request.
+	ReasonIdle = "idle"
+
+	// ReasonShared means that the IP was loaded from the Store, having been
+	// blacklisted by another proxy or before a restart.
+	ReasonShared = "shared"
 )
 
 var (
 	log = golog.LoggerFor("blacklist")
+)
+
+// Mode determines what a Blacklist does about blacklisted IPs.
+type Mode string
 
-	blacklistingEnabled = false // we've temporarily turned off blacklisting for safety
+const (
+	// ModeOff doesn't track connections at all and allows all IPs.
+	ModeOff Mode = "off"
+
+	// ModeDryRun tracks connections and blacklists IPs like ModeEnforce, but
+	// still allows blacklisted IPs to connect, only logging and instrumenting
+	// the connections that would have been rejected.
+	ModeDryRun Mode = "dry-run"
+
+	// ModeEnforce rejects connections from blacklisted IPs.
+	ModeEnforce Mode = "enforce"
 )
 
+// ParseMode parses a Mode from its string representation. An empty string
+// means ModeOff.
+func ParseMode(mode string) (Mode, error) {
+	switch Mode(strings.ToLower(strings.TrimSpace(mode))) {
+	case "", ModeOff:
+		return ModeOff, nil
+	case ModeDryRun:
+		return ModeDryRun, nil
+	case ModeEnforce:
+		return ModeEnforce, nil
+	default:
+		return "", errors.New("unknown blacklist mode %q, expected one of %v, %v or %v", mode, ModeOff, ModeDryRun, ModeEnforce)
+	}
+}
+
 // Options is a set of options to initialize a blacklist.
 type Options struct {
+	// Whether to track and reject blacklisted IPs. Defaults to ModeOff.
+	Mode Mode
+
 	// The maximum amount of time we'll wait between the start of a connection
 	// and seeing a successful HTTP request before we mark the connection as
 	// failed. Defaults to 2 minutes.
@@ -58,10 +108,25 @@ type Options struct {
 	// 6 hours.
 	Expiration time.Duration
 
+	// Optional Store used to share the blacklist with other proxies and to
+	// persist it across restarts.
+	Store Store
+
+	// How frequently to load blacklisted IPs from the Store. Defaults to 1
+	// minute.
+	SyncInterval time.Duration
+
+	// Used to log the country of blacklisted IPs.
+	CountryLookup geo.CountryLookup
+
 	Instrument instrument.Instrument
 }
 
 func (opts *Options) applyDefaults() {
+	if opts.Mode == "" {
+		opts.Mode = ModeOff
+	}
+
 	if opts.MaxIdleTime <= 0 {
 		opts.MaxIdleTime = DefaultMaxIdleTime
 		log.Debugf("Defaulted MaxIdleTime to %v", opts.MaxIdleTime)
@@ -81,23 +146,44 @@ func (opts *Options) applyDefaults() {
 		opts.Expiration = DefaultExpiration
 		log.Debugf("Defaulted Expiration to %v", opts.Expiration)
 	}
+
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.CountryLookup == nil {
+		opts.CountryLookup = geo.NoLookup{}
+	}
 	if opts.Instrument == nil {
 		opts.Instrument = instrument.NoInstrument{}
 	}
 }
 
+type blacklistEntry struct {
+	blacklistedAt time.Time
+	reason        string
+}
+
 // Blacklist is a blacklist of IPs.
 type Blacklist struct {
+	mode                Mode
 	maxIdleTime         time.Duration
 	maxConnectInterval  time.Duration
 	allowedFailures     int
 	blacklistExpiration time.Duration
+	syncInterval        time.Duration
 	connections         chan string
 	successes           chan string
+	optionsUpdates      chan Options
+	snapshotRequests    chan chan *Snapshot
+	store               Store
+	storeOps            chan storeOp
+	storeLoads          chan map[string]time.Time
+	stored              map[string]bool
 	firstConnectionTime map[string]time.Time
 	lastConnectionTime  map[string]time.Time
 	failureCounts       map[string]int
-	blacklist           map[string]time.Time
+	blacklist           map[string]blacklistEntry
+	countryLookup       geo.CountryLookup
 	instrument          instrument.Instrument
 	mutex               sync.RWMutex
 }
@@ -107,18 +193,30 @@ func New(opts Options) *Blacklist {
 	opts.applyDefaults()
 
 	bl := &Blacklist{
+		mode:                opts.Mode,
 		maxIdleTime:         opts.MaxIdleTime,
 		maxConnectInterval:  opts.MaxConnectInterval,
 		allowedFailures:     opts.AllowedFailures,
 		blacklistExpiration: opts.Expiration,
+		syncInterval:        opts.SyncInterval,
 		connections:         make(chan string, 10000),
 		successes:           make(chan string, 10000),
+		optionsUpdates:      make(chan Options),
+		snapshotRequests:    make(chan chan *Snapshot),
+		store:               opts.Store,
+		storeOps:            make(chan storeOp, 1000),
+		storeLoads:          make(chan map[string]time.Time),
+		stored:              make(map[string]bool),
 		firstConnectionTime: make(map[string]time.Time),
 		lastConnectionTime:  make(map[string]time.Time),
 		failureCounts:       make(map[string]int),
-		blacklist:           make(map[string]time.Time),
+		blacklist:           make(map[string]blacklistEntry),
+		countryLookup:       opts.CountryLookup,
 		instrument:          opts.Instrument,
 	}
+	if bl.store != nil {
+		go bl.syncWithStore()
+	}
 	go bl.track()
 	return bl
 }
@@ -135,21 +233,26 @@ func (bl *Blacklist) Succeed(ip string) {
 }
 
 // OnConnect records an attempt to connect from the given IP. If the IP is
-// blacklisted, this returns false.
+// blacklisted and the Blacklist is in ModeEnforce, this returns false.
 func (bl *Blacklist) OnConnect(ip string) bool {
-	if !blacklistingEnabled {
-		bl.instrument.Blacklist(context.Background(), false)
+	bl.mutex.RLock()
+	mode := bl.mode
+	entry, blacklisted := bl.blacklist[ip]
+	bl.mutex.RUnlock()
+
+	fromIP := net.ParseIP(ip)
+	if mode == ModeOff {
+		bl.instrument.Blacklist(context.Background(), fromIP, string(mode), false, "")
 		return true
 	}
-	bl.mutex.RLock()
-	defer bl.mutex.RUnlock()
-	_, blacklisted := bl.blacklist[ip]
+	bl.instrument.Blacklist(context.Background(), fromIP, string(mode), blacklisted, entry.reason)
 	if blacklisted {
-		log.Errorf("%v is blacklisted", ip)
-		bl.instrument.Blacklist(context.Background(), true)
-		return false
+		if mode == ModeEnforce {
+			log.Errorf("%v is blacklisted", ip)
+			return false
+		}
+		log.Tracef("%v is blacklisted (%v), allowing in %v mode", ip, entry.reason, mode)
 	}
-	bl.instrument.Blacklist(context.Background(), false)
 	select {
 	case bl.connections <- ip:
 		// ip submitted as connected
@@ -159,23 +262,91 @@ func (bl *Blacklist) OnConnect(ip string) bool {
 	return true
 }
 
+// SetOptions changes the options of a running Blacklist. Tracked connections
+// and the current blacklist are retained. Instrument, Store and SyncInterval are
+// ignored.
+func (bl *Blacklist) SetOptions(opts Options) {
+	opts.applyDefaults()
+	bl.mutex.Lock()
+	bl.mode = opts.Mode
+	bl.mutex.Unlock()
+	bl.optionsUpdates <- opts
+}
+
+// Snapshot is a point in time view of a Blacklist.
+type Snapshot struct {
+	// Blacklisted maps blacklisted IPs to the time at which they were
+	// blacklisted.
+	Blacklisted map[string]time.Time `json:"blacklisted"`
+
+	// FailureCounts contains the current number of failures for IPs that have
+	// failed at least once.
+	FailureCounts map[string]int `json:"failureCounts"`
+}
+
+// Snapshot returns a copy of the current blacklist and failure counts.
+func (bl *Blacklist) Snapshot() *Snapshot {
+	result := make(chan *Snapshot)
+	bl.snapshotRequests <- result
+	return <-result
+}
+
 func (bl *Blacklist) track() {
 	idleTicker := time.NewTicker(bl.maxIdleTime)
 	blacklistTicker := time.NewTicker(bl.blacklistExpiration / 10)
+	var syncTickerC <-chan time.Time
+	if bl.store != nil {
+		syncTicker := time.NewTicker(bl.syncInterval)
+		syncTickerC = syncTicker.C
+		// load whatever has been blacklisted before we started
+		bl.submitStoreOp(storeOp{load: true, expiration: bl.blacklistExpiration})
+	}
 	for {
 		select {
 		case ip := <-bl.connections:
 			bl.onConnection(ip)
 		case ip := <-bl.successes:
 			bl.onSuccess(ip)
+		case opts := <-bl.optionsUpdates:
+			log.Debugf("Updating blacklist options: %+v", opts)
+			bl.maxIdleTime = opts.MaxIdleTime
+			bl.maxConnectInterval = opts.MaxConnectInterval
+			bl.allowedFailures = opts.AllowedFailures
+			bl.blacklistExpiration = opts.Expiration
+			idleTicker.Reset(bl.maxIdleTime)
+			blacklistTicker.Reset(bl.blacklistExpiration / 10)
+		case result := <-bl.snapshotRequests:
+			result <- bl.snapshot()
 		case <-idleTicker.C:
 			bl.checkForIdlers()
 		case <-blacklistTicker.C:
 			bl.checkExpiration()
+		case <-syncTickerC:
+			bl.submitStoreOp(storeOp{load: true, expiration: bl.blacklistExpiration})
+		case stored := <-bl.storeLoads:
+			bl.mergeStored(stored)
 		}
 	}
 }
 
+func (bl *Blacklist) snapshot() *Snapshot {
+	snapshot := &Snapshot{
+		Blacklisted:   make(map[string]time.Time),
+		FailureCounts: make(map[string]int),
+	}
+	for ip, count := range bl.failureCounts {
+		if count > 0 {
+			snapshot.FailureCounts[ip] = count
+		}
+	}
+	bl.mutex.RLock()
+	for ip, entry := range bl.blacklist {
+		snapshot.Blacklisted[ip] = entry.blacklistedAt
+	}
+	bl.mutex.RUnlock()
+	return snapshot
+}
+
 func (bl *Blacklist) onConnection(ip string) {
 	now := time.Now()
 	t, exists := bl.lastConnectionTime[ip]
@@ -196,8 +367,13 @@ func (bl *Blacklist) onSuccess(ip string) {
 	delete(bl.lastConnectionTime, ip)
 	delete(bl.firstConnectionTime, ip)
 	bl.mutex.Lock()
+	_, blacklisted := bl.blacklist[ip]
 	delete(bl.blacklist, ip)
 	bl.mutex.Unlock()
+	if blacklisted && bl.store != nil {
+		delete(bl.stored, ip)
+		bl.submitStoreOp(storeOp{ip: ip, remove: true})
+	}
 }
 
 func (bl *Blacklist) checkForIdlers() {
@@ -213,7 +389,7 @@ func (bl *Blacklist) checkForIdlers() {
 			count := bl.failureCounts[ip] + 1
 			bl.failureCounts[ip] = count
 			if count >= bl.allowedFailures {
-				_ = log.Errorf("Blacklisting %v", ip)
+				bl.logBlacklisting(ip, ReasonIdle)
 				blacklistAdditions = append(blacklistAdditions, ip)
 			}
 		}
@@ -221,22 +397,40 @@ func (bl *Blacklist) checkForIdlers() {
 	if len(blacklistAdditions) > 0 {
 		bl.mutex.Lock()
 		for _, ip := range blacklistAdditions {
-			bl.blacklist[ip] = now
+			bl.blacklist[ip] = blacklistEntry{blacklistedAt: now, reason: ReasonIdle}
 		}
 		bl.mutex.Unlock()
+		if bl.store != nil {
+			for _, ip := range blacklistAdditions {
+				bl.submitStoreOp(storeOp{ip: ip, blacklistedAt: now, expiration: bl.blacklistExpiration})
+			}
+		}
 	}
 }
 
 func (bl *Blacklist) checkExpiration() {
 	now := time.Now()
 	bl.mutex.Lock()
-	for ip, blacklistedAt := range bl.blacklist {
-		if now.Sub(blacklistedAt) > bl.blacklistExpiration {
+	for ip, entry := range bl.blacklist {
+		if now.Sub(entry.blacklistedAt) > bl.blacklistExpiration {
 			log.Tracef("Removing %v from blacklist", ip)
 			delete(bl.blacklist, ip)
+			delete(bl.stored, ip)
 			delete(bl.failureCounts, ip)
 			delete(bl.firstConnectionTime, ip)
 		}
 	}
 	bl.mutex.Unlock()
 }
+
+func (bl *Blacklist) logBlacklisting(ip string, reason string) {
+	bl.mutex.RLock()
+	mode := bl.mode
+	bl.mutex.RUnlock()
+	countryCode := bl.countryLookup.CountryCode(net.ParseIP(ip))
+	if mode == ModeEnforce {
+		_ = log.Errorf("Blacklisting %v in %v: %v", ip, countryCode, reason)
+	} else {
+		log.Debugf("Would blacklist %v in %v: %v (%v mode)", ip, countryCode, reason, mode)
+	}
+}
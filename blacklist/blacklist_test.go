@@ -1,6 +1,7 @@
 package blacklist
 
 import (
+	"sync"
 	"testing"
 	"time"
 
@@ -11,12 +12,9 @@ const (
 	ip = "8.8.8.8"
 )
 
-func init() {
-	blacklistingEnabled = true
-}
-
 func TestBlacklistSucceed(t *testing.T) {
 	bl := New(Options{
+		Mode:               ModeEnforce,
 		MaxIdleTime:        50 * time.Millisecond,
 		MaxConnectInterval: 1 * time.Millisecond,
 		AllowedFailures:    2,
@@ -31,6 +29,7 @@ func TestBlacklistSucceed(t *testing.T) {
 func TestBlacklistFail(t *testing.T) {
 	maxIdleTime := 10 * time.Millisecond
 	bl := New(Options{
+		Mode:               ModeEnforce,
 		MaxIdleTime:        maxIdleTime,
 		MaxConnectInterval: maxIdleTime * 5,
 		AllowedFailures:    3,
@@ -61,3 +60,141 @@ func TestBlacklistFail(t *testing.T) {
 		bl.Succeed(ip)
 	}
 }
+
+func TestBlacklistModes(t *testing.T) {
+	maxIdleTime := 10 * time.Millisecond
+	bl := New(Options{
+		Mode:               ModeDryRun,
+		MaxIdleTime:        maxIdleTime,
+		MaxConnectInterval: time.Second,
+		AllowedFailures:    2,
+		Expiration:         time.Minute,
+	})
+	for i := 0; i < 3; i++ {
+		bl.OnConnect(ip)
+		time.Sleep(maxIdleTime * 3)
+	}
+	assert.Contains(t, bl.Snapshot().Blacklisted, ip, "dry run should still blacklist")
+	assert.True(t, bl.OnConnect(ip), "dry run should allow blacklisted IPs")
+
+	bl.SetOptions(Options{
+		Mode:               ModeEnforce,
+		MaxIdleTime:        maxIdleTime,
+		MaxConnectInterval: time.Second,
+		AllowedFailures:    2,
+		Expiration:         time.Minute,
+	})
+	assert.False(t, bl.OnConnect(ip), "switching to enforce should reject blacklisted IPs")
+
+	bl.SetOptions(Options{
+		MaxIdleTime:        maxIdleTime,
+		MaxConnectInterval: time.Second,
+		AllowedFailures:    2,
+		Expiration:         time.Minute,
+	})
+	assert.True(t, bl.OnConnect(ip), "blacklisting should be off by default")
+}
+
+func TestParseMode(t *testing.T) {
+	for input, expected := range map[string]Mode{"": ModeOff, "off": ModeOff, "dry-run": ModeDryRun, " Enforce ": ModeEnforce} {
+		mode, err := ParseMode(input)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, mode)
+	}
+	_, err := ParseMode("on")
+	assert.Error(t, err)
+}
+
+func TestBlacklistSnapshot(t *testing.T) {
+	maxIdleTime := 10 * time.Millisecond
+	bl := New(Options{
+		Mode:               ModeEnforce,
+		MaxIdleTime:        maxIdleTime,
+		MaxConnectInterval: time.Second,
+		AllowedFailures:    2,
+		Expiration:         time.Minute,
+	})
+	snapshot := bl.Snapshot()
+	assert.Empty(t, snapshot.Blacklisted)
+	assert.Empty(t, snapshot.FailureCounts)
+
+	for i := 0; i < 3; i++ {
+		bl.OnConnect(ip)
+		time.Sleep(maxIdleTime * 3)
+	}
+	snapshot = bl.Snapshot()
+	assert.Contains(t, snapshot.Blacklisted, ip)
+	assert.GreaterOrEqual(t, snapshot.FailureCounts[ip], 2)
+
+	bl.Succeed(ip)
+	time.Sleep(maxIdleTime)
+	snapshot = bl.Snapshot()
+	assert.Empty(t, snapshot.Blacklisted)
+	assert.Empty(t, snapshot.FailureCounts)
+}
+
+type memoryStore struct {
+	blacklist map[string]time.Time
+	mx        sync.Mutex
+}
+
+func (s *memoryStore) Add(ip string, blacklistedAt time.Time, expiration time.Duration) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.blacklist[ip] = blacklistedAt
+	return nil
+}
+
+func (s *memoryStore) Remove(ip string) error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.blacklist, ip)
+	return nil
+}
+
+func (s *memoryStore) All(expiration time.Duration) (map[string]time.Time, error) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	result := make(map[string]time.Time, len(s.blacklist))
+	for ip, blacklistedAt := range s.blacklist {
+		if time.Since(blacklistedAt) <= expiration {
+			result[ip] = blacklistedAt
+		}
+	}
+	return result, nil
+}
+
+func TestBlacklistStore(t *testing.T) {
+	store := &memoryStore{blacklist: map[string]time.Time{"1.1.1.1": time.Now()}}
+	maxIdleTime := 10 * time.Millisecond
+	newBlacklist := func() *Blacklist {
+		return New(Options{
+			Mode:               ModeEnforce,
+			MaxIdleTime:        maxIdleTime,
+			MaxConnectInterval: time.Second,
+			AllowedFailures:    2,
+			Expiration:         time.Minute,
+			Store:              store,
+			SyncInterval:       maxIdleTime,
+		})
+	}
+	bl1 := newBlacklist()
+	bl2 := newBlacklist()
+	time.Sleep(maxIdleTime * 3)
+	assert.False(t, bl1.OnConnect("1.1.1.1"), "IP blacklisted before start should be loaded from store")
+	assert.False(t, bl2.OnConnect("1.1.1.1"), "IP blacklisted before start should be loaded from store")
+
+	for i := 0; i < 3; i++ {
+		bl1.OnConnect(ip)
+		time.Sleep(maxIdleTime * 3)
+	}
+	assert.False(t, bl1.OnConnect(ip))
+	time.Sleep(maxIdleTime * 3)
+	assert.False(t, bl2.OnConnect(ip), "IP blacklisted by another proxy should be blacklisted")
+
+	bl2.Succeed(ip)
+	time.Sleep(maxIdleTime * 3)
+	assert.True(t, bl1.OnConnect(ip), "IP that succeeded on another proxy should be removed from blacklist")
+	assert.True(t, bl2.OnConnect(ip))
+	assert.False(t, bl1.OnConnect("1.1.1.1"))
+}
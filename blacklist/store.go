@@ -0,0 +1,94 @@
+package blacklist
+
+import (
+	"time"
+)
+
+// Store is a shared, persistent record of blacklisted IPs. Blacklist only
+// talks to the Store in the background, so OnConnect never waits on it.
+type Store interface {
+	// Add records that ip was blacklisted at blacklistedAt. The entry should
+	// be forgotten once expiration has elapsed.
+	Add(ip string, blacklistedAt time.Time, expiration time.Duration) error
+
+	// Remove removes ip from the Store.
+	Remove(ip string) error
+
+	// All returns the IPs blacklisted within the last expiration, mapped to
+	// the time at which they were blacklisted.
+	All(expiration time.Duration) (map[string]time.Time, error)
+}
+
+// storeOp is a pending operation against the Store. Exactly one of load,
+// remove or an addition (the default) is performed.
+type storeOp struct {
+	ip            string
+	blacklistedAt time.Time
+	expiration    time.Duration
+	remove        bool
+	load          bool
+}
+
+func (bl *Blacklist) submitStoreOp(op storeOp) {
+	select {
+	case bl.storeOps <- op:
+		// op submitted
+	default:
+		_ = log.Errorf("Unable to submit blacklist store operation for %v", op.ip)
+	}
+}
+
+// syncWithStore performs store operations one at a time, in the order in which
+// they were submitted, so that a load always reflects preceding additions and
+// removals.
+func (bl *Blacklist) syncWithStore() {
+	for op := range bl.storeOps {
+		switch {
+		case op.load:
+			stored, err := bl.store.All(op.expiration)
+			if err != nil {
+				_ = log.Errorf("Unable to load blacklist from store: %v", err)
+				continue
+			}
+			bl.storeLoads <- stored
+		case op.remove:
+			if err := bl.store.Remove(op.ip); err != nil {
+				_ = log.Errorf("Unable to remove %v from blacklist store: %v", op.ip, err)
+			}
+		default:
+			if err := bl.store.Add(op.ip, op.blacklistedAt, op.expiration); err != nil {
+				_ = log.Errorf("Unable to add %v to blacklist store: %v", op.ip, err)
+			}
+		}
+	}
+}
+
+// mergeStored merges IPs loaded from the Store into the local blacklist. IPs
+// that were previously loaded from the Store but have since been removed from
+// it, for example because another proxy saw them succeed, are removed locally
+// too.
+func (bl *Blacklist) mergeStored(stored map[string]time.Time) {
+	now := time.Now()
+	bl.mutex.Lock()
+	for ip := range bl.stored {
+		if _, found := stored[ip]; !found {
+			log.Tracef("%v was removed from blacklist store", ip)
+			delete(bl.blacklist, ip)
+			delete(bl.stored, ip)
+		}
+	}
+	for ip, blacklistedAt := range stored {
+		if now.Sub(blacklistedAt) > bl.blacklistExpiration {
+			continue
+		}
+		if existing, found := bl.blacklist[ip]; !found {
+			bl.blacklist[ip] = blacklistEntry{blacklistedAt: blacklistedAt, reason: ReasonShared}
+		} else if existing.blacklistedAt.Before(blacklistedAt) {
+			existing.blacklistedAt = blacklistedAt
+			bl.blacklist[ip] = existing
+		}
+		bl.stored[ip] = true
+	}
+	bl.mutex.Unlock()
+	log.Debugf("Loaded %d blacklisted IPs from store", len(stored))
+}
@@ -40,8 +40,12 @@ const (
 	OriginHost        = "origin_host"
 	OriginPort        = "origin_port"
 	ProbingError      = "probing_error"
+	JA3               = "ja3"
+	JA4               = "ja4"
 	ClientIP          = "client_ip"
 	ThrottleSettings  = "throttle_settings"
+	ThrottleTier      = "throttle_tier"
 	TimeZone          = "time_zone"
 	SupportedDataCaps = "supported_data_caps"
+	AuthTokenLabel    = "auth_token_label"
 )
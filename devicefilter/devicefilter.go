@@ -5,7 +5,6 @@ import (
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -19,6 +18,7 @@ import (
 	"github.com/getlantern/http-proxy-lantern/v2/common"
 	"github.com/getlantern/http-proxy-lantern/v2/domains"
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/protoken"
 	"github.com/getlantern/http-proxy-lantern/v2/redis"
 	"github.com/getlantern/http-proxy-lantern/v2/throttle"
 	"github.com/getlantern/http-proxy-lantern/v2/usage"
@@ -36,12 +36,12 @@ var (
 
 // deviceFilterPre does the device-based filtering
 type deviceFilterPre struct {
-	deviceFetcher      *redis.DeviceFetcher
-	throttleConfig     throttle.Config
-	sendXBQHeader      bool
-	instrument         instrument.Instrument
-	limitersByDevice   map[string]*listeners.RateLimiter
-	limitersByDeviceMx sync.Mutex
+	deviceFetcher    *redis.DeviceFetcher
+	usage            *usage.Cache
+	throttleConfig   throttle.Config
+	sendXBQHeader    bool
+	instrument       instrument.Instrument
+	limitersByDevice *limiterRegistry
 }
 
 // deviceFilterPost cleans up
@@ -51,6 +51,8 @@ type deviceFilterPost struct {
 
 // NewPre creates a filter which throttling all connections from a device if its data usage threshold is reached.
 // * df is used to fetch device data usage across all proxies from a central Redis.
+// * usageCache holds the device data usage fetched by df and reported by the
+// measured reporter.
 // * throttleConfig is to determine the threshold and throttle rate. They can
 // be fixed values or fetched from Redis periodically.
 // * If sendXBQHeader is true, it attaches a common.XBQHeader to inform the
@@ -63,17 +65,27 @@ type deviceFilterPost struct {
 // <allowed> is the string representation of a 64-bit unsigned integer
 // <asof> is the 64-bit signed integer representing seconds since a custom
 // epoch (00:00:00 01/01/2016 UTC).
-func NewPre(df *redis.DeviceFetcher, throttleConfig throttle.Config, sendXBQHeader bool, instrument instrument.Instrument) filters.Filter {
+//
+// The common.XBQHeaderv2 header appends the number of seconds until the cap
+// resets and, if the settings have throttling tiers, the active tier (0 for
+// none):
+//
+// <used>/<allowed>/<asof>/<ttl>[/<tier>]
+func NewPre(df *redis.DeviceFetcher, usageCache *usage.Cache, throttleConfig throttle.Config, sendXBQHeader bool, instrument instrument.Instrument) filters.Filter {
 	if throttleConfig != nil {
 		log.Debug("Throttling enabled")
 	}
 
+	limitersByDevice := newLimiterRegistry(defaultMaxTrackedDevices, defaultLimiterIdleTimeout, instrument)
+	go limitersByDevice.keepClean()
+
 	return &deviceFilterPre{
 		deviceFetcher:    df,
+		usage:            usageCache,
 		throttleConfig:   throttleConfig,
 		sendXBQHeader:    sendXBQHeader,
 		instrument:       instrument,
-		limitersByDevice: make(map[string]*listeners.RateLimiter, 0),
+		limitersByDevice: limitersByDevice,
 	}
 }
 
@@ -104,6 +116,13 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 		wc.ControlMessage("throttle", limiter)
 	}
 
+	// Pro users who land on a free proxy are neither capped nor throttled by
+	// default.
+	if protoken.IsPro(req.Context()) {
+		f.instrument.Throttle(req.Context(), false, "pro-token")
+		return next(cs, req)
+	}
+
 	// Some domains are excluded from being throttled and don't count towards the
 	// bandwidth cap.
 	if domains.ConfigForRequest(req).Unthrottled {
@@ -130,13 +149,17 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 	}
 
 	// Throttling enabled
-	u := usage.Get(lanternDeviceID)
+	u, stale := f.usage.Get(lanternDeviceID)
 	if u == nil {
 		// Eagerly request device ID data from Redis and store it in usage
 		f.deviceFetcher.RequestNewDeviceUsage(lanternDeviceID)
 		throttleDefault("no-usage-data")
 		return next(cs, req)
 	}
+	if stale {
+		// Keep using what we have while we refresh it
+		f.deviceFetcher.RequestNewDeviceUsage(lanternDeviceID)
+	}
 
 	settings, capOn := f.throttleConfig.SettingsFor(lanternDeviceID, u.CountryCode, req.Header.Get(common.PlatformHeader), req.Header.Get(common.AppHeader), req.Header[common.SupportedDataCapsHeader])
 
@@ -147,22 +170,41 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 	// To turn the data cap off in Redis we simply set the threshold to 0 or
 	// below. This will also turn off the cap in the UI on desktop and in newer
 	// versions on mobile.
+	// A schedule window may temporarily override the threshold and rate, in
+	// which case activeSettings differ from settings.
+	activeSettings := settings
 	if capOn {
 		log.Tracef("Got throttle settings: %v", settings)
-		capOn = settings.Threshold > 0
+		activeSettings = settings.ActiveAt(throttle.LocalTime(time.Now(), req.Header.Get(common.TimeZoneHeader), u.CountryCode))
+		capOn = settings.Threshold > 0 || activeSettings.Threshold > 0
 
 		// Send throttle settings to measured as well
-		measuredCtx["throttle_settings"] = settings
+		measuredCtx[common.ThrottleSettings] = activeSettings
 	}
 
-	if capOn && u.Bytes > settings.Threshold {
+	// With tiers, throttling gets progressively stricter as usage grows past
+	// each tier's share of the threshold. Tier 0 means not throttled.
+	// Depending on the settings, uploads may not count towards the cap.
+	tier, rate, used := 0, int64(0), u.Bytes
+	if capOn {
+		used = activeSettings.CountedBytes(u.BytesIn, u.BytesOut)
+		tier, rate = activeSettings.TierFor(used)
+		measuredCtx[common.ThrottleTier] = tier
+	}
+
+	if tier > 0 {
 		// per connection limiter
-		// Note - when people hit the data cap, we only throttle writes back to the client, not reads.
-		// This way, they can continue to upload videos or other bandwidth intensive content for sharing.
-		limiter := f.rateLimiterForDevice(lanternDeviceID, defaultThrottleRate, settings.Rate)
+		// Note - unless the settings specify an UploadRate, when people hit the data cap we only
+		// throttle writes back to the client, not reads. This way, they can continue to upload
+		// videos or other bandwidth intensive content for sharing.
+		uploadRate := defaultThrottleRate
+		if activeSettings.UploadRate > 0 {
+			uploadRate = activeSettings.UploadRate
+		}
+		limiter := f.rateLimiterForDevice(lanternDeviceID, uploadRate, rate)
 		if log.IsTraceEnabled() {
-			log.Tracef("Throttling connection from device %s to %v per second", lanternDeviceID,
-				humanize.Bytes(uint64(settings.Rate)))
+			log.Tracef("Throttling connection from device %s to %v per second (%v per second upload) at tier %d", lanternDeviceID,
+				humanize.Bytes(uint64(rate)), humanize.Bytes(uint64(uploadRate)), tier)
 		}
 		f.instrument.Throttle(req.Context(), true, "datacap")
 		wc.ControlMessage("throttle", limiter)
@@ -183,9 +225,20 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 	if resp.Header == nil {
 		resp.Header = make(http.Header, 1)
 	}
-	uMiB := u.Bytes / (1024 * 1024)
-	xbq := fmt.Sprintf("%d/%d/%d", uMiB, settings.Threshold/(1024*1024), int64(u.AsOf.Sub(epoch).Seconds()))
+	// While a schedule window lifts the cap, keep reporting the regular cap so
+	// that clients don't hide it.
+	threshold := activeSettings.Threshold
+	if threshold <= 0 {
+		threshold = settings.Threshold
+	}
+	uMiB := used / (1024 * 1024)
+	xbq := fmt.Sprintf("%d/%d/%d", uMiB, threshold/(1024*1024), int64(u.AsOf.Sub(epoch).Seconds()))
 	xbqv2 := fmt.Sprintf("%s/%d", xbq, u.TTLSeconds)
+	if len(activeSettings.Tiers) > 0 {
+		// only clients of tiered settings get the active tier, so that the
+		// header stays unchanged for everyone else
+		xbqv2 = fmt.Sprintf("%s/%d", xbqv2, tier)
+	}
 	resp.Header.Set(common.XBQHeader, xbq)     // for backward compatibility with older clients
 	resp.Header.Set(common.XBQHeaderv2, xbqv2) // for new clients that support different bandwidth cap expirations
 	f.instrument.XBQHeaderSent(req.Context())
@@ -193,15 +246,7 @@ func (f *deviceFilterPre) Apply(cs *filters.ConnectionState, req *http.Request,
 }
 
 func (f *deviceFilterPre) rateLimiterForDevice(deviceID string, rateLimitRead, rateLimitWrite int64) *listeners.RateLimiter {
-	f.limitersByDeviceMx.Lock()
-	defer f.limitersByDeviceMx.Unlock()
-
-	limiter := f.limitersByDevice[deviceID]
-	if limiter == nil || limiter.GetRateRead() != rateLimitRead || limiter.GetRateWrite() != rateLimitWrite {
-		limiter = listeners.NewRateLimiter(rateLimitRead, rateLimitWrite)
-		f.limitersByDevice[deviceID] = limiter
-	}
-	return limiter
+	return f.limitersByDevice.limiterFor(deviceID, rateLimitRead, rateLimitWrite)
 }
 
 func NewPost(bl *blacklist.Blacklist) filters.Filter {
@@ -0,0 +1,110 @@
+package devicefilter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
+)
+
+const (
+	// defaultMaxTrackedDevices bounds the number of devices for which we keep
+	// a rate limiter. Beyond this, the least recently used limiters are evicted.
+	defaultMaxTrackedDevices = 100000
+
+	// defaultLimiterIdleTimeout is how long we keep the limiter of a device
+	// that hasn't made any requests.
+	defaultLimiterIdleTimeout = 1 * time.Hour
+)
+
+type limiterEntry struct {
+	limiter  *listeners.RateLimiter
+	lastUsed time.Time
+}
+
+// limiterRegistry keeps one RateLimiter per device so that all of a device's
+// connections share the same limits. It's bounded in size and forgets devices
+// that have been idle for longer than idleTimeout.
+type limiterRegistry struct {
+	entries        *lru.Cache
+	idleTimeout    time.Duration
+	instrument     instrument.Instrument
+	evictionReason string
+	mx             sync.Mutex
+}
+
+func newLimiterRegistry(maxDevices int, idleTimeout time.Duration, instrument instrument.Instrument) *limiterRegistry {
+	r := &limiterRegistry{
+		idleTimeout:    idleTimeout,
+		instrument:     instrument,
+		evictionReason: "lru",
+	}
+	// lru.New only fails for non-positive sizes
+	r.entries, _ = lru.NewWithEvict(maxDevices, r.onEvicted)
+	return r
+}
+
+// onEvicted is called by the cache (with mx held) whenever it removes a device,
+// either because it's the least recently used one or because it's idle.
+func (r *limiterRegistry) onEvicted(key interface{}, value interface{}) {
+	r.instrument.DeviceLimiterEvicted(context.Background(), r.evictionReason)
+}
+
+// limiterFor returns the RateLimiter for the given device with the given rates.
+// If the device already has a limiter, its rates are updated in place so that
+// connections which are already using it pick up the new rates and its buckets
+// aren't reset.
+func (r *limiterRegistry) limiterFor(deviceID string, rateRead, rateWrite int64) *listeners.RateLimiter {
+	now := time.Now()
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	_entry, found := r.entries.Get(deviceID)
+	if found {
+		entry := _entry.(*limiterEntry)
+		entry.lastUsed = now
+		entry.limiter.SetRates(rateRead, rateWrite)
+		return entry.limiter
+	}
+
+	limiter := listeners.NewRateLimiter(rateRead, rateWrite)
+	r.entries.Add(deviceID, &limiterEntry{limiter: limiter, lastUsed: now})
+	r.instrument.DeviceLimiters(r.entries.Len())
+	return limiter
+}
+
+// removeIdle removes limiters for devices that have been idle for longer than
+// idleTimeout.
+func (r *limiterRegistry) removeIdle() {
+	cutoff := time.Now().Add(-1 * r.idleTimeout)
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	// Keys are ordered from least to most recently used, and since lastUsed
+	// is updated whenever an entry is used, we can stop at the first entry
+	// that's still active.
+	for _, key := range r.entries.Keys() {
+		_entry, found := r.entries.Peek(key)
+		if !found {
+			continue
+		}
+		if _entry.(*limiterEntry).lastUsed.After(cutoff) {
+			break
+		}
+		r.evictionReason = "idle"
+		r.entries.Remove(key)
+		r.evictionReason = "lru"
+	}
+	r.instrument.DeviceLimiters(r.entries.Len())
+}
+
+func (r *limiterRegistry) keepClean() {
+	for {
+		time.Sleep(r.idleTimeout / 10)
+		r.removeIdle()
+	}
+}
@@ -0,0 +1,36 @@
+package devicefilter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+)
+
+func TestLimiterRegistry(t *testing.T) {
+	r := newLimiterRegistry(2, time.Hour, instrument.NoInstrument{})
+
+	a := r.limiterFor("a", 100, 100)
+	assert.Same(t, a, r.limiterFor("a", 100, 50), "device should keep its limiter when rates change")
+	assert.EqualValues(t, 50, a.GetRateWrite(), "rates should be updated in place")
+
+	b := r.limiterFor("b", 100, 100)
+	r.limiterFor("a", 100, 100)
+	r.limiterFor("c", 100, 100)
+	assert.Equal(t, 2, r.entries.Len())
+	assert.NotSame(t, b, r.limiterFor("b", 100, 100), "least recently used device should have been evicted")
+}
+
+func TestLimiterRegistryRemoveIdle(t *testing.T) {
+	r := newLimiterRegistry(10, time.Hour, instrument.NoInstrument{})
+	r.limiterFor("idle", 100, 100)
+	r.limiterFor("active", 100, 100)
+	_entry, _ := r.entries.Peek("idle")
+	_entry.(*limiterEntry).lastUsed = time.Now().Add(-2 * time.Hour)
+
+	r.removeIdle()
+	assert.False(t, r.entries.Contains("idle"))
+	assert.True(t, r.entries.Contains("active"))
+}
@@ -3,30 +3,29 @@ package domains
 import (
 	"net"
 	"net/http"
-	"sort"
 	"strings"
 )
 
 // Config represents the configuration for a given domain
 type Config struct {
 	// Unthrottled indicates that this domain should not be subject to throttling.
-	Unthrottled bool
+	Unthrottled bool `json:"unthrottled,omitempty" yaml:"unthrottled,omitempty"`
 
 	// RewriteToHTTPS indicates that HTTP requests to this domain should be
 	// rewritten to HTTPS.
-	RewriteToHTTPS bool
+	RewriteToHTTPS bool `json:"rewriteToHTTPS,omitempty" yaml:"rewriteToHTTPS,omitempty"`
 
 	// AddConfigServerHeaders indicates that we should add config server auth
 	// tokens and client IP headers on requests to this domain
-	AddConfigServerHeaders bool
+	AddConfigServerHeaders bool `json:"addConfigServerHeaders,omitempty" yaml:"addConfigServerHeaders,omitempty"`
 
 	// AddForwardedFor indicates that we should include an X-Forwarded-For header
 	// with the client's IP.
-	AddForwardedFor bool
+	AddForwardedFor bool `json:"addForwardedFor,omitempty" yaml:"addForwardedFor,omitempty"`
 
 	// PassInternalHeaders indicates that headers starting with X-Lantern-* should
 	// be passed to this domain.
-	PassInternalHeaders bool
+	PassInternalHeaders bool `json:"passInternalHeaders,omitempty" yaml:"passInternalHeaders,omitempty"`
 }
 
 func (cfg *Config) withRewriteToHTTPS() *Config {
@@ -59,7 +58,9 @@ var (
 	}
 )
 
-var configs = configure(
+// builtin is the policy used until a different one is loaded with Set. Each
+// entry applies to the domain and all of its sub-domains.
+var builtin = domainsAndSubdomains(
 	map[string]*Config{
 		"config.getiantem.org":         internal.withRewriteToHTTPS().withAddConfigServerHeaders(),
 		"config-staging.getiantem.org": internal.withRewriteToHTTPS().withAddConfigServerHeaders(),
@@ -110,29 +111,21 @@ func ConfigForAddress(addr string) *ConfigWithHost {
 	return ConfigForHost(host)
 }
 
-// ConfigForHost returns the config for the deepest matching sub-domain for the
-// given host.
+// ConfigForHost returns the config for the given host from the current
+// policy. See Policy.ConfigForHost.
 func ConfigForHost(host string) *ConfigWithHost {
-	host = strings.ToLower(host)
-	cfg := &ConfigWithHost{Host: host}
-
-	for _, dcfg := range configs {
-		if host == dcfg.Host || strings.HasSuffix(host, "."+dcfg.Host) {
-			cfg.Config = dcfg.Config
-			return cfg
-		}
-	}
-
-	return cfg
+	return Current().ConfigForHost(host)
 }
 
-func configure(m map[string]*Config) []*ConfigWithHost {
-	cfgs := make([]*ConfigWithHost, 0, len(m))
+// domainsAndSubdomains adds an exact and a wildcard entry for each domain in
+// the given map.
+func domainsAndSubdomains(m map[string]*Config) map[string]*Config {
+	result := make(map[string]*Config, len(m)*2)
 	for domain, config := range m {
-		cfgs = append(cfgs, &ConfigWithHost{Host: domain, Config: *config})
+		result[domain] = config
+		result[wildcardPrefix+domain] = config
 	}
-	sort.Sort(byDepth(cfgs))
-	return cfgs
+	return result
 }
 
 type byDepth []*ConfigWithHost
@@ -0,0 +1,265 @@
+package domains
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/go-redis/redis/v8"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultRefreshInterval is how often a Source is reloaded by KeepCurrent
+	// if no interval is given.
+	DefaultRefreshInterval = 5 * time.Minute
+
+	// DefaultRedisKey is the redis key holding the JSON encoded policy.
+	DefaultRedisKey = "_domains"
+
+	wildcardPrefix = "*."
+)
+
+var (
+	log = golog.LoggerFor("domains")
+
+	defaultPolicy = mustPolicy(builtin)
+	current       atomic.Pointer[Policy]
+)
+
+func init() {
+	current.Store(defaultPolicy)
+}
+
+// Policy maps hosts to their Config. Entries are either exact hostnames like
+// "example.com", which match only that host, or wildcards like
+// "*.example.com", which match any sub-domain of example.com (but not
+// example.com itself). Policies are immutable once created.
+type Policy struct {
+	exact map[string]*ConfigWithHost
+	// wildcards are keyed by the domain without the wildcard prefix and are
+	// sorted from deepest to shallowest.
+	wildcards []*ConfigWithHost
+}
+
+// NewPolicy validates the given entries and builds a Policy from them.
+func NewPolicy(entries map[string]*Config) (*Policy, error) {
+	if len(entries) == 0 {
+		return nil, errors.New("policy contains no domains")
+	}
+	p := &Policy{
+		exact: make(map[string]*ConfigWithHost, len(entries)),
+	}
+	seen := make(map[string]bool, len(entries))
+	for pattern, config := range entries {
+		normalized := strings.ToLower(strings.TrimSpace(pattern))
+		if seen[normalized] {
+			return nil, errors.New("duplicate entry for %v", pattern)
+		}
+		seen[normalized] = true
+		if config == nil {
+			return nil, errors.New("missing config for %v", pattern)
+		}
+		wildcard := strings.HasPrefix(normalized, wildcardPrefix)
+		host := strings.TrimPrefix(normalized, wildcardPrefix)
+		if err := validateHost(host); err != nil {
+			return nil, errors.New("invalid entry %v: %v", pattern, err)
+		}
+		if wildcard && !strings.Contains(host, ".") {
+			return nil, errors.New("invalid entry %v: wildcards must be below a top-level domain", pattern)
+		}
+		cfg := &ConfigWithHost{Host: host, Config: *config}
+		if wildcard {
+			p.wildcards = append(p.wildcards, cfg)
+		} else {
+			p.exact[host] = cfg
+		}
+	}
+	sort.Sort(byDepth(p.wildcards))
+	return p, nil
+}
+
+func mustPolicy(entries map[string]*Config) *Policy {
+	p, err := NewPolicy(entries)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func validateHost(host string) error {
+	if host == "" {
+		return errors.New("empty host")
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" {
+			return errors.New("empty label")
+		}
+		for _, r := range label {
+			if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return errors.New("invalid character %q", r)
+			}
+		}
+	}
+	return nil
+}
+
+// ConfigForHost returns the config for the given host. An exact entry for the
+// host takes precedence, followed by the deepest matching wildcard. If nothing
+// matches, the returned config is empty.
+func (p *Policy) ConfigForHost(host string) *ConfigWithHost {
+	host = strings.ToLower(host)
+	cfg := &ConfigWithHost{Host: host}
+
+	if dcfg, found := p.exact[host]; found {
+		cfg.Config = dcfg.Config
+		return cfg
+	}
+	for _, dcfg := range p.wildcards {
+		if strings.HasSuffix(host, "."+dcfg.Host) {
+			cfg.Config = dcfg.Config
+			return cfg
+		}
+	}
+
+	return cfg
+}
+
+// DecodePolicyJSON decodes and validates a JSON policy, which is an object
+// mapping entries to their config, for example:
+//
+//	{"*.example.com": {"unthrottled": true}}
+func DecodePolicyJSON(encoded []byte) (*Policy, error) {
+	entries := make(map[string]*Config)
+	dec := json.NewDecoder(bytes.NewReader(encoded))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&entries); err != nil {
+		return nil, errors.New("unable to decode JSON policy: %v", err)
+	}
+	return NewPolicy(entries)
+}
+
+// DecodePolicyYAML is like DecodePolicyJSON for YAML policies.
+func DecodePolicyYAML(encoded []byte) (*Policy, error) {
+	entries := make(map[string]*Config)
+	dec := yaml.NewDecoder(bytes.NewReader(encoded))
+	dec.KnownFields(true)
+	if err := dec.Decode(&entries); err != nil {
+		return nil, errors.New("unable to decode YAML policy: %v", err)
+	}
+	return NewPolicy(entries)
+}
+
+// Default returns the built-in policy.
+func Default() *Policy {
+	return defaultPolicy
+}
+
+// Current returns the policy currently in use.
+func Current() *Policy {
+	return current.Load()
+}
+
+// Set atomically replaces the policy currently in use. A nil policy restores
+// the built-in default.
+func Set(p *Policy) {
+	if p == nil {
+		p = defaultPolicy
+	}
+	current.Store(p)
+}
+
+// Source is a place from which a Policy can be loaded.
+type Source interface {
+	Load(ctx context.Context) (*Policy, error)
+}
+
+type fileSource struct {
+	path string
+}
+
+// NewFileSource returns a Source that loads the policy from the given file.
+// Files ending in .yaml or .yml are decoded as YAML, everything else as JSON.
+func NewFileSource(path string) Source {
+	return &fileSource{path: path}
+}
+
+func (src *fileSource) Load(ctx context.Context) (*Policy, error) {
+	encoded, err := os.ReadFile(src.path)
+	if err != nil {
+		return nil, errors.New("unable to read domain policy file %v: %v", src.path, err)
+	}
+	switch strings.ToLower(filepath.Ext(src.path)) {
+	case ".yaml", ".yml":
+		return DecodePolicyYAML(encoded)
+	default:
+		return DecodePolicyJSON(encoded)
+	}
+}
+
+type redisSource struct {
+	rc  *redis.Client
+	key string
+}
+
+// NewRedisSource returns a Source that loads a JSON encoded policy from the
+// given redis key, or DefaultRedisKey if key is empty.
+func NewRedisSource(rc *redis.Client, key string) Source {
+	if key == "" {
+		key = DefaultRedisKey
+	}
+	return &redisSource{rc: rc, key: key}
+}
+
+func (src *redisSource) Load(ctx context.Context) (*Policy, error) {
+	encoded, err := src.rc.Get(ctx, src.key).Bytes()
+	if err != nil {
+		return nil, errors.New("unable to load domain policy from redis key %v: %v", src.key, err)
+	}
+	return DecodePolicyJSON(encoded)
+}
+
+// KeepCurrent loads the policy from the given source, makes it the current
+// policy and then keeps reloading it every refreshInterval until ctx is done.
+// If loading fails, the previous policy stays in use. The returned error is
+// the result of the initial load, reloading continues either way.
+func KeepCurrent(ctx context.Context, src Source, refreshInterval time.Duration) error {
+	if refreshInterval <= 0 {
+		log.Debugf("Defaulting refresh interval to %v", DefaultRefreshInterval)
+		refreshInterval = DefaultRefreshInterval
+	}
+	err := refresh(src)
+	go func() {
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := refresh(src); err != nil {
+					log.Errorf("Unable to refresh domain policy, keeping current one: %v", err)
+				}
+			}
+		}
+	}()
+	return err
+}
+
+func refresh(src Source) error {
+	p, err := src.Load(context.Background())
+	if err != nil {
+		return err
+	}
+	Set(p)
+	log.Debugf("Loaded domain policy with %d exact and %d wildcard entries", len(p.exact), len(p.wildcards))
+	return nil
+}
@@ -0,0 +1,114 @@
+package domains
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExactAndWildcard(t *testing.T) {
+	p, err := NewPolicy(map[string]*Config{
+		"example.com":       {Unthrottled: true},
+		"*.example.com":     {PassInternalHeaders: true},
+		"*.sub.example.com": {AddForwardedFor: true},
+		"a.sub.example.com": {RewriteToHTTPS: true},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, Config{Unthrottled: true}, p.ConfigForHost("Example.com").Config)
+	assert.Equal(t, Config{PassInternalHeaders: true}, p.ConfigForHost("www.example.com").Config)
+	assert.Equal(t, Config{PassInternalHeaders: true}, p.ConfigForHost("sub.example.com").Config, "wildcard shouldn't match its own domain")
+	assert.Equal(t, Config{AddForwardedFor: true}, p.ConfigForHost("b.sub.example.com").Config, "deepest wildcard should win")
+	assert.Equal(t, Config{RewriteToHTTPS: true}, p.ConfigForHost("a.sub.example.com").Config, "exact entry should win")
+	assert.Equal(t, Config{}, p.ConfigForHost("notexample.com").Config)
+	assert.Equal(t, "www.example.com", p.ConfigForHost("www.example.com").Host)
+}
+
+func TestInvalidPolicies(t *testing.T) {
+	for name, entries := range map[string]map[string]*Config{
+		"empty":           {},
+		"nil config":      {"example.com": nil},
+		"empty host":      {"": {}},
+		"empty label":     {"example..com": {}},
+		"bad character":   {"exa*mple.com": {}},
+		"wildcard on tld": {"*.com": {}},
+		"duplicate":       {"example.com": {}, "EXAMPLE.com": {}},
+	} {
+		_, err := NewPolicy(entries)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestDecodePolicy(t *testing.T) {
+	p, err := DecodePolicyJSON([]byte(`{"*.example.com": {"unthrottled": true, "rewriteToHTTPS": true}}`))
+	require.NoError(t, err)
+	assert.Equal(t, Config{Unthrottled: true, RewriteToHTTPS: true}, p.ConfigForHost("www.example.com").Config)
+
+	_, err = DecodePolicyJSON([]byte(`{"*.example.com": {"unthrotled": true}}`))
+	assert.Error(t, err, "unknown fields should be rejected")
+
+	p, err = DecodePolicyYAML([]byte("example.com:\n  addForwardedFor: true\n"))
+	require.NoError(t, err)
+	assert.Equal(t, Config{AddForwardedFor: true}, p.ConfigForHost("example.com").Config)
+
+	_, err = DecodePolicyYAML([]byte("example.com:\n  addForwardFor: true\n"))
+	assert.Error(t, err, "unknown fields should be rejected")
+}
+
+func TestKeepCurrentFromFile(t *testing.T) {
+	defer Set(nil)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "domains.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("\"*.example.com\":\n  unthrottled: true\n"), 0644))
+
+	src := NewFileSource(path)
+	ctx, cancel := context.WithCancel(context.Background())
+	// stop the background reload so it doesn't leak into other tests, the
+	// updates below are refreshed manually
+	defer cancel()
+	require.NoError(t, KeepCurrent(ctx, src, time.Hour))
+	assert.True(t, ConfigForHost("www.example.com").Unthrottled)
+	assert.False(t, ConfigForHost("sub.alipay.com").Unthrottled, "loaded policy should replace built-in one")
+
+	// an invalid update keeps the last good policy
+	require.NoError(t, os.WriteFile(path, []byte("\"*.com\": {}\n"), 0644))
+	assert.Error(t, refresh(src))
+	assert.True(t, ConfigForHost("www.example.com").Unthrottled)
+
+	require.NoError(t, os.WriteFile(path, []byte("\"*.example.org\":\n  unthrottled: true\n"), 0644))
+	require.NoError(t, refresh(src))
+	assert.False(t, ConfigForHost("www.example.com").Unthrottled)
+	assert.True(t, ConfigForHost("www.example.org").Unthrottled)
+
+	Set(nil)
+	assert.Same(t, Default(), Current())
+}
+
+func TestKeepCurrentStops(t *testing.T) {
+	defer Set(nil)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "domains.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("\"*.example.com\":\n  unthrottled: true\n"), 0644))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, KeepCurrent(ctx, NewFileSource(path), 10*time.Millisecond))
+
+	require.NoError(t, os.WriteFile(path, []byte("\"*.example.org\":\n  unthrottled: true\n"), 0644))
+	require.Eventually(t, func() bool {
+		return ConfigForHost("www.example.org").Unthrottled
+	}, time.Second, 10*time.Millisecond, "policy should be reloaded in the background")
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, os.WriteFile(path, []byte("\"*.example.net\":\n  unthrottled: true\n"), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, ConfigForHost("www.example.net").Unthrottled, "policy should not be reloaded once stopped")
+}
@@ -67,6 +67,7 @@ require (
 	go.opentelemetry.io/otel/trace v1.19.0
 	golang.org/x/net v0.20.0
 	google.golang.org/api v0.148.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -193,7 +194,6 @@ require (
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20231012201019-e917dd12ba7a // indirect
 	google.golang.org/grpc v1.58.3 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 	nhooyr.io/websocket v1.8.10 // indirect
 )
 
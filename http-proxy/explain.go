@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"strings"
+
+	"github.com/getlantern/errors"
+
+	lanternredis "github.com/getlantern/http-proxy-lantern/v2/redis"
+	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+)
+
+// explainThrottleCommand is the subcommand that explains which throttle
+// settings a device gets and why, for example:
+//
+//	http-proxy explain-throttle -throttleconfigfile throttle.json -deviceid abc -country ir -platform android -caps monthly
+const explainThrottleCommand = "explain-throttle"
+
+func explainThrottle(args []string) error {
+	fs := flag.NewFlagSet(explainThrottleCommand, flag.ExitOnError)
+	deviceID := fs.String("deviceid", "", "The device ID")
+	countryCode := fs.String("country", "", "The 2-letter country code of the device")
+	platform := fs.String("platform", "", "The platform of the device, e.g. windows or android")
+	appName := fs.String("app", "", "The app name reported by the device")
+	supportedDataCaps := fs.String("caps", "", "Comma-separated list of cap intervals supported by the device (daily, weekly, monthly). Leave empty for legacy clients")
+	configFile := fs.String("throttleconfigfile", "", "JSON file with the throttling configuration")
+	configURL := fs.String("throttleconfigurl", "", "URL of the JSON throttling configuration")
+	redisAddr := fs.String("reportingredis", "", "The address of the Redis instance holding the throttling configuration in \"redis[s]://host:port\" format")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var cfg throttle.Config
+	switch {
+	case *configFile != "":
+		cfg = throttle.NewFileConfig(*configFile, throttle.DefaultRefreshInterval)
+	case *configURL != "":
+		cfg = throttle.NewHTTPConfig(*configURL, throttle.DefaultRefreshInterval)
+	case *redisAddr != "":
+		rc, err := lanternredis.NewClient(*redisAddr)
+		if err != nil {
+			return errors.New("Unable to initialize redis client: %v", err)
+		}
+		cfg = throttle.NewRedisConfig(rc, throttle.DefaultRefreshInterval)
+	default:
+		return errors.New("Please specify one of -throttleconfigfile, -throttleconfigurl or -reportingredis")
+	}
+	settings := cfg.AllSettings()
+	if settings == nil {
+		return errors.New("Unable to load throttle config")
+	}
+
+	var caps []string
+	for _, c := range strings.Split(*supportedDataCaps, ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			caps = append(caps, c)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(settings.Explain(*deviceID, *countryCode, *platform, *appName, caps))
+}
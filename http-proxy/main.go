@@ -13,6 +13,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -27,6 +28,7 @@ import (
 
 	proxy "github.com/getlantern/http-proxy-lantern/v2"
 	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/domains"
 	"github.com/getlantern/http-proxy-lantern/v2/googlefilter"
 	"github.com/getlantern/http-proxy-lantern/v2/obfs4listener"
 	lanternredis "github.com/getlantern/http-proxy-lantern/v2/redis"
@@ -74,6 +76,7 @@ var (
 	keyfile              = flag.String("key", "", "Private key file name")
 	certfile             = flag.String("cert", "", "Certificate file name")
 	token                = flag.String("token", "", "Lantern token")
+	tokens               = flag.String("tokens", "", "Comma-separated list of additional Lantern tokens, each formatted as label|token[|expiration], with the optional expiration in RFC 3339 format")
 	sessionTicketKeyFile = flag.String("sessionticketkey", "", "File name for storing rotating session ticket keys (deprecated, use -sessionticketkeys instead)")
 	sessionTicketKeys    = flag.String("sessionticketkeys", "", "One or more 32 byte session ticket keys, base64 encoded. We will rotate through these every 24 hours. Replaces -sessionticketkey")
 
@@ -83,6 +86,9 @@ var (
 	// compatible with sessionticketkey.
 	firstSessionTicketKey = flag.String("first-session-ticket-key", "", "initial session ticket key; never expires; 32-byte string, base64-encoded  (deprecated, use -sessionticketkeys instead)")
 
+	sessionTicketKeyRingFile  = flag.String("sessionticketkeyringfile", "", "JSON file containing a versioned session ticket key ring, which is polled every minute and applied whenever its version changes. Takes precedence over -sessionticketkeys, which are used until the key ring can be loaded")
+	sessionTicketKeyRingRedis = flag.Bool("sessionticketkeyringredis", false, "Poll the session ticket key ring shared by all proxies on the same track from the reporting redis every minute and report the active key to it. Takes precedence over -sessionticketkeyringfile")
+
 	lampshadeKeyCacheSize     = flag.Int("lampshade-keycache-size", 0, "set this to a positive value to cache client keys and reject duplicates to thwart replay attacks")
 	lampshadeMaxClientInitAge = flag.Duration("lampshade-max-clientinit-age", 0, "set this to a positive value to limit the age of client init messages to thwart replay attacks")
 
@@ -90,15 +96,39 @@ var (
 	connectOKWaitsForUpstream = flag.Bool("connect-ok-waits-for-upstream", false, "Set to true to wait for upstream connection before responding OK to CONNECT requests")
 
 	throttleRefreshInterval = flag.Duration("throttlerefresh", throttle.DefaultRefreshInterval, "Specifies how frequently to refresh throttling configuration from redis. Defaults to 5 minutes.")
+	throttleConfigFile      = flag.String("throttleconfigfile", "", "JSON file with the throttling configuration, checked for changes every -throttlerefresh, instead of loading it from redis")
+	throttleConfigURL       = flag.String("throttleconfigurl", "", "URL from which to poll the JSON throttling configuration every -throttlerefresh, instead of loading it from redis. Can't be combined with -throttleconfigfile")
+
+	domainPolicyFile            = flag.String("domainpolicy", "", "JSON or YAML file with the per-domain policy, replacing the built-in one")
+	domainPolicyRedisKey        = flag.String("domainpolicyrediskey", "", "Redis key holding the JSON per-domain policy, replacing the built-in one. Can't be combined with -domainpolicy")
+	domainPolicyRefreshInterval = flag.Duration("domainpolicyrefresh", domains.DefaultRefreshInterval, "Specifies how frequently to reload the domain policy")
 
 	enableMultipath = flag.Bool("enablemultipath", false, "Enable multipath. Only clients support multipath can communicate with it.")
 
 	externalIP = flag.String("externalip", "", "The external IP of this proxy, used for reporting")
 	https      = flag.Bool("https", false, "Use TLS for client to proxy communication")
 	idleClose  = flag.Uint64("idleclose", 70, "Time in seconds that an idle connection will be allowed before closing it")
-	_          = flag.Uint64("maxconns", 0, "Max number of simultaneous allowed connections, unused")
+	maxConns   = flag.Uint64("maxconns", 0, "Max number of simultaneous allowed connections across all protocols, unlimited if 0")
+
+	maxConnsPerProtocol = flag.String("maxconns-per-protocol", "", "Comma-separated list of protocol=maxconns pairs limiting simultaneous connections per protocol, for example https=1000,shadowsocks=500")
+
+	ipLimitRate          = flag.Float64("iplimit-rate", 0, "Sustained number of new connections per second allowed from a single client IP across all protocols except broflake, unlimited if 0")
+	ipLimitBurst         = flag.Int64("iplimit-burst", 10, "Number of connections a single client IP can open in quick succession before being limited to -iplimit-rate")
+	ipLimitMaxConns      = flag.Int64("iplimit-maxconns", 0, "Max number of simultaneous connections from a single client IP across all protocols except broflake, unlimited if 0")
+	ipLimitIPv4PrefixLen = flag.Int("iplimit-ipv4-prefix", 32, "Prefix length of IPv4 addresses that count as the same client for -iplimit-rate and -iplimit-maxconns")
+	ipLimitIPv6PrefixLen = flag.Int("iplimit-ipv6-prefix", 64, "Prefix length of IPv6 addresses that count as the same client for -iplimit-rate and -iplimit-maxconns")
+	ipLimitExempt        = flag.String("iplimit-exempt", "", "Comma-separated list of CIDRs or IPs that aren't subject to per-IP limits. Loopback addresses are always exempt")
+
+	allowCIDRs    = flag.String("allow-cidrs", "", "Comma-separated list of CIDRs or IPs from which clients may connect. If empty, clients may connect from anywhere that's not denied")
+	denyCIDRs     = flag.String("deny-cidrs", "", "Comma-separated list of CIDRs or IPs from which clients may not connect, even if allowed by -allow-cidrs")
+	denyASNs      = flag.String("deny-asns", "", "Comma-separated list of ASNs (e.g. AS12345) from which clients may not connect. Requires the MaxMind ISP database")
+	denyCountries = flag.String("deny-countries", "", "Comma-separated list of country codes from which clients may not connect. Requires the MaxMind country database")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", proxy.DefaultShutdownTimeout, "How long to wait for active connections to finish when shutting down before closing them")
 
 	pprofAddr         = flag.String("pprofaddr", "", "pprof address to listen on, not activate pprof if empty")
+	adminAddr         = flag.String("adminaddr", "", "Address at which to serve the admin API, not activated if empty")
+	adminToken        = flag.String("admintoken", "", "Bearer token required for requests to the admin API")
 	maxmindLicenseKey = flag.String("maxmindlicensekey", "", "MaxMind license key to load the GeoLite2 City database")
 	geoip2ISPDBFile   = flag.String("geoip2ispdbfile", "", "The local copy of the GeoIP2 ISP database")
 
@@ -108,6 +138,13 @@ var (
 	proxiedSitesTrackingId       = flag.String("proxied-sites-tracking-id", "UA-21815217-16", "The Google Analytics property id for tracking proxied sites")
 
 	reportingRedisAddr = flag.String("reportingredis", "", "The address of the reporting Redis instance in \"redis[s]://host:port\" format")
+	usageBufferFile    = flag.String("usagebufferfile", "", "File in which to keep data usage that couldn't be reported to the reporting Redis, so that it's reported once Redis is available again even if the proxy restarts")
+
+	deviceFetchBatchSize     = flag.Int("devicefetchbatchsize", lanternredis.DefaultDeviceFetchBatchSize, "The maximum number of devices whose usage is fetched from the reporting Redis in a single pipelined request")
+	deviceFetchFlushInterval = flag.Duration("devicefetchflushinterval", lanternredis.DefaultDeviceFetchFlushInterval, "How long to wait for a batch of device usage requests to fill up before sending it anyway")
+	deviceFetchWorkers       = flag.Int("devicefetchworkers", lanternredis.DefaultDeviceFetchWorkers, "The number of batches of device usage that can be fetched from the reporting Redis concurrently")
+
+	proTokenPublicKey = flag.String("protokenpublickey", "", "Base64 encoded Ed25519 public key with which to verify the pro tokens of clients. Devices with valid pro tokens aren't throttled. Leave empty to ignore pro tokens")
 
 	// default value of tunnelPorts matches ports in flashlight/client/client.go
 	tunnelPorts         = flag.String("tunnelports", "80,443,22,110,995,143,993,8080,8443,5222,5223,5224,5228,5229,7300,19302,19303,19304,19305,19306,19307,19308,19309", "Comma seperated list of ports allowed for HTTP CONNECT tunnel. Allow all ports if empty.")
@@ -130,10 +167,13 @@ var (
 	googleSearchRegex  = flag.String("google-search-regex", googlefilter.DefaultSearchRegex, "Regex for detecting access to Google Search")
 	googleCaptchaRegex = flag.String("google-captcha-regex", googlefilter.DefaultCaptchaRegex, "Regex for detecting access to Google captcha page")
 
+	blacklistMode               = flag.String("blacklist-mode", string(blacklist.ModeOff), "Whether to blacklist IPs that repeatedly fail to send HTTP requests: off, dry-run (only log and instrument who would be blacklisted) or enforce")
 	blacklistMaxIdleTime        = flag.Duration("blacklist-max-idle-time", blacklist.DefaultMaxIdleTime, "How long to wait for an HTTP request before considering a connection failed for blacklisting")
 	blacklistMaxConnectInterval = flag.Duration("blacklist-max-connect-interval", blacklist.DefaultMaxConnectInterval, "Successive connection attempts within this interval will be treated as a single attempt for blacklisting")
 	blacklistAllowedFailures    = flag.Int("blacklist-allowed-failures", blacklist.DefaultAllowedFailures, "The number of failed connection attempts we tolerate before blacklisting an IP address")
 	blacklistExpiration         = flag.Duration("blacklist-expiration", blacklist.DefaultExpiration, "How long to wait before removing an ip from the blacklist")
+	blacklistRedis              = flag.Bool("blacklist-redis", false, "Share the blacklist with other proxies on the same track through the reporting redis, which also persists it across restarts")
+	blacklistSyncInterval       = flag.Duration("blacklist-sync-interval", blacklist.DefaultSyncInterval, "How frequently to load the shared blacklist from redis")
 
 	stackdriverProjectID        = flag.String("stackdriver-project-id", "lantern-http-proxy", "Optional project ID for stackdriver error reporting as in http-proxy-lantern")
 	stackdriverCreds            = flag.String("stackdriver-creds", "/home/lantern/lantern-stackdriver.json", "Optional full json file path containing stackdriver credentials")
@@ -144,7 +184,13 @@ var (
 	missingTicketReactionDelay = flag.Duration("missing-session-ticket-reaction-delay", 0, "Specifies the delay before reaction to ClientHellos without TLS session tickets. Apply only if require-session-tickets is set.")
 	missingTicketReflectSite   = flag.String("missing-session-ticket-reflect-site", "", "Specifies the site to mirror when seeing no TLS session ticket in ClientHellos. Useful only if missing-session-ticket-reaction is ReflectToSite.")
 
-	tlsListenerAllowTLS13 = flag.Bool("tlslistener-allow-tls13", false, "Allow tlslistener to offer tls13. Because of session ticket issues, this is likely experimental until they can be worked out")
+	enforceSessionTickets          = flag.String("enforce-session-tickets", "", "Comma-separated list of reasons (no_ticket_support, no_ticket, invalid_ticket) for which ClientHellos failing the session ticket check get a reaction rather than only being recorded. Each reason may be followed by =<reaction> to use instead of missing-session-ticket-reaction, e.g. no_ticket,invalid_ticket=CloseConnection. Apply only if require-session-tickets is set")
+	enforceSessionTicketsPercent   = flag.Float64("enforce-session-tickets-percent", 100, "The percentage (0-100) of ClientHellos failing the session ticket check on which to enforce")
+	enforceSessionTicketsCountries = flag.String("enforce-session-tickets-countries", "", "Comma-separated list of country=percent overriding enforce-session-tickets-percent for clients in those countries, e.g. ir=100,cn=50. Requires the MaxMind country database")
+
+	tlsListenerAllowTLS13    = flag.Bool("tlslistener-allow-tls13", true, "Allow tlslistener to offer tls13. Set to false to only offer tls12")
+	tlsListenerReplayHistory = flag.Int("tlslistener-replay-history", 0, "Replay buffer size (# of ClientHellos with valid session tickets). Replayed ClientHellos are treated as probing and get the missing-session-ticket-reaction. Set to 0 to disable")
+	tlsListenerReplayWindow  = flag.Duration("tlslistener-replay-window", time.Hour, "How long to remember ClientHellos for replay detection, up to tlslistener-replay-history of them")
 
 	tlsmasqAddr          = flag.String("tlsmasq-addr", "", "Address at which to listen for tlsmasq connections.")
 	tlsmasqOriginAddr    = flag.String("tlsmasq-origin-addr", "", "Address of tlsmasq origin with port.")
@@ -194,7 +240,16 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == explainThrottleCommand {
+		if err := explainThrottle(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	iniflags.SetAllowUnknownFlags(true)
+	reloader := newConfigReloader()
 	iniflags.Parse()
 	if *version {
 		fmt.Fprintf(os.Stderr, "%s: commit %s built with %s (%s)\n", os.Args[0], revision, runtime.Version(), build_type)
@@ -267,7 +322,6 @@ func main() {
 	ctx, cancel := context.WithCancel(context.Background())
 	c := make(chan os.Signal, 1)
 	signal.Notify(c,
-		syscall.SIGHUP,
 		syscall.SIGINT,
 		syscall.SIGTERM,
 		syscall.SIGQUIT)
@@ -295,33 +349,7 @@ func main() {
 		}()
 	}
 
-	var reaction tlslistener.HandshakeReaction
-	switch *missingTicketReaction {
-	case "AlertHandshakeFailure":
-		reaction = tlslistener.AlertHandshakeFailure
-	case "AlertProtocolVersion":
-		reaction = tlslistener.AlertProtocolVersion
-	case "AlertInternalError":
-		reaction = tlslistener.AlertInternalError
-	case "CloseConnection":
-		reaction = tlslistener.CloseConnection
-	case "ReflectToSite":
-		if *missingTicketReflectSite == "" {
-			log.Fatal("missing-session-ticket-reflect-site should not be empty")
-		}
-		reaction = tlslistener.ReflectToSite(*missingTicketReflectSite)
-		log.Debugf("Reflecting missing session tickets to site %v", *missingTicketReflectSite)
-	case "None":
-		log.Debug("Not reacting to missing session tickets")
-		reaction = tlslistener.None
-	default:
-		log.Errorf("bad missing-session-ticket-reaction for '%s': '%s', fallback to %s", *proxyProtocol, *missingTicketReaction, reaction.Action())
-		reaction = tlslistener.AlertInternalError
-	}
-	if *missingTicketReactionDelay != 0 {
-		reaction = tlslistener.Delayed(*missingTicketReactionDelay, reaction)
-	}
-
+	reaction := handshakeReaction(*missingTicketReaction)
 	if reaction.Action() == "" {
 		log.Debug("Not using missing-session-ticket-reaction")
 	} else {
@@ -353,6 +381,11 @@ func main() {
 		}
 	}
 
+	ticketEnforcement, err := parseTicketEnforcement(*enforceSessionTickets, *enforceSessionTicketsPercent, *enforceSessionTicketsCountries, reaction)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *packetForwardIntf != "" {
 		*externalIntf = *packetForwardIntf
 	}
@@ -384,21 +417,49 @@ func main() {
 		ConnectOKWaitsForUpstream:          *connectOKWaitsForUpstream,
 		EnableMultipath:                    *enableMultipath,
 		ThrottleRefreshInterval:            *throttleRefreshInterval,
+		ThrottleConfigFile:                 *throttleConfigFile,
+		ThrottleConfigURL:                  *throttleConfigURL,
+		DomainPolicyFile:                   *domainPolicyFile,
+		DomainPolicyRedisKey:               *domainPolicyRedisKey,
+		DomainPolicyRefreshInterval:        *domainPolicyRefreshInterval,
 		TracesSampleRate:                   *tracesSampleRate,
 		TeleportSampleRate:                 *teleportSampleRate,
 		ExternalIP:                         *externalIP,
 		HTTPS:                              *https,
 		IdleTimeout:                        time.Duration(*idleClose) * time.Second,
+		MaxConns:                           *maxConns,
+		MaxConnsPerProtocol:                *maxConnsPerProtocol,
+		IPLimitRate:                        *ipLimitRate,
+		IPLimitBurst:                       *ipLimitBurst,
+		IPLimitMaxConns:                    *ipLimitMaxConns,
+		IPLimitIPv4PrefixLen:               *ipLimitIPv4PrefixLen,
+		IPLimitIPv6PrefixLen:               *ipLimitIPv6PrefixLen,
+		IPLimitExempt:                      *ipLimitExempt,
+		AllowCIDRs:                         *allowCIDRs,
+		DenyCIDRs:                          *denyCIDRs,
+		DenyASNs:                           *denyASNs,
+		DenyCountries:                      *denyCountries,
+		ShutdownTimeout:                    *shutdownTimeout,
 		KeyFile:                            *keyfile,
 		SessionTicketKeys:                  *sessionTicketKeys,
 		SessionTicketKeyFile:               *sessionTicketKeyFile,
 		FirstSessionTicketKey:              *firstSessionTicketKey,
+		SessionTicketKeyRingFile:           *sessionTicketKeyRingFile,
+		SessionTicketKeyRingRedis:          *sessionTicketKeyRingRedis,
 		Track:                              *track,
 		Pro:                                *pro,
 		ProxiedSitesSamplePercentage:       *proxiedSitesSamplePercentage,
 		ProxiedSitesTrackingID:             *proxiedSitesTrackingId,
 		ReportingRedisClient:               reportingRedisClient,
+		UsageBufferFile:                    *usageBufferFile,
+		DeviceFetchBatchSize:               *deviceFetchBatchSize,
+		DeviceFetchFlushInterval:           *deviceFetchFlushInterval,
+		DeviceFetchWorkers:                 *deviceFetchWorkers,
+		ProTokenPublicKey:                  *proTokenPublicKey,
 		Token:                              *token,
+		Tokens:                             *tokens,
+		AdminAddr:                          *adminAddr,
+		AdminToken:                         *adminToken,
 		TunnelPorts:                        *tunnelPorts,
 		Obfs4Addr:                          *obfs4Addr,
 		Obfs4MultiplexAddr:                 *obfs4MultiplexAddr,
@@ -417,10 +478,13 @@ func main() {
 		LampshadeMaxClientInitAge:          *lampshadeMaxClientInitAge,
 		GoogleSearchRegex:                  *googleSearchRegex,
 		GoogleCaptchaRegex:                 *googleCaptchaRegex,
+		BlacklistMode:                      *blacklistMode,
 		BlacklistMaxIdleTime:               *blacklistMaxIdleTime,
 		BlacklistMaxConnectInterval:        *blacklistMaxConnectInterval,
 		BlacklistAllowedFailures:           *blacklistAllowedFailures,
 		BlacklistExpiration:                *blacklistExpiration,
+		BlacklistRedis:                     *blacklistRedis,
+		BlacklistSyncInterval:              *blacklistSyncInterval,
 		ProxyName:                          *proxyName,
 		ProxyProtocol:                      *proxyProtocol,
 		Provider:                           *provider,
@@ -436,7 +500,10 @@ func main() {
 		ExternalIntf:                       *externalIntf,
 		RequireSessionTickets:              *requireSessionTickets,
 		MissingTicketReaction:              reaction,
+		TicketEnforcement:                  ticketEnforcement,
 		TLSListenerAllowTLS13:              *tlsListenerAllowTLS13,
+		TLSListenerReplayHistory:           *tlsListenerReplayHistory,
+		TLSListenerReplayWindow:            *tlsListenerReplayWindow,
 		TLSMasqAddr:                        *tlsmasqAddr,
 		TLSMasqOriginAddr:                  *tlsmasqOriginAddr,
 		TLSMasqSecret:                      *tlsmasqSecret,
@@ -479,6 +546,9 @@ func main() {
 		p.ISPLookup = geo.FromWeb(geoip2ISPURL, "GeoIP2-ISP.mmdb", 24*time.Hour, *geoip2ISPDBFile, geo.ISP)
 	}
 
+	// iniflags reloads the config file on SIGHUP, apply what changed
+	reloader.start(p)
+
 	err = p.ListenAndServe(ctx)
 	if err != nil {
 		log.Fatal(err)
@@ -492,6 +562,95 @@ func periodicallyForceGC() {
 	}
 }
 
+// handshakeReaction returns the HandshakeReaction with the given name, delayed
+// by missing-session-ticket-reaction-delay if set.
+func handshakeReaction(name string) tlslistener.HandshakeReaction {
+	reaction, err := parseHandshakeReaction(name)
+	if err != nil {
+		reaction = tlslistener.AlertInternalError
+		log.Errorf("bad missing-session-ticket-reaction for '%s': '%s', fallback to %s", *proxyProtocol, name, reaction.Action())
+		if *missingTicketReactionDelay != 0 {
+			reaction = tlslistener.Delayed(*missingTicketReactionDelay, reaction)
+		}
+	}
+	return reaction
+}
+
+// parseHandshakeReaction is like handshakeReaction, but fails for unknown
+// names.
+func parseHandshakeReaction(name string) (tlslistener.HandshakeReaction, error) {
+	var reaction tlslistener.HandshakeReaction
+	switch name {
+	case "AlertHandshakeFailure":
+		reaction = tlslistener.AlertHandshakeFailure
+	case "AlertProtocolVersion":
+		reaction = tlslistener.AlertProtocolVersion
+	case "AlertInternalError":
+		reaction = tlslistener.AlertInternalError
+	case "CloseConnection":
+		reaction = tlslistener.CloseConnection
+	case "ReflectToSite":
+		if *missingTicketReflectSite == "" {
+			log.Fatal("missing-session-ticket-reflect-site should not be empty")
+		}
+		reaction = tlslistener.ReflectToSite(*missingTicketReflectSite)
+		log.Debugf("Reflecting missing session tickets to site %v", *missingTicketReflectSite)
+	case "None":
+		log.Debug("Not reacting to missing session tickets")
+		reaction = tlslistener.None
+	default:
+		return reaction, fmt.Errorf("unknown handshake reaction %q", name)
+	}
+	if *missingTicketReactionDelay != 0 {
+		reaction = tlslistener.Delayed(*missingTicketReactionDelay, reaction)
+	}
+	return reaction, nil
+}
+
+// parseTicketEnforcement parses the enforce-session-tickets flags. It returns
+// nil if no reasons are enforced.
+func parseTicketEnforcement(reasons string, percent float64, countryPercents string, defaultReaction tlslistener.HandshakeReaction) (*tlslistener.TicketEnforcement, error) {
+	if reasons == "" {
+		return nil, nil
+	}
+	if percent < 0 || percent > 100 {
+		return nil, fmt.Errorf("enforce-session-tickets-percent must be between 0 and 100, not %v", percent)
+	}
+	te := &tlslistener.TicketEnforcement{
+		Reactions: make(map[string]tlslistener.HandshakeReaction),
+		Percent:   percent,
+	}
+	for _, reason := range strings.Split(reasons, ",") {
+		reason, reactionName, hasReaction := strings.Cut(strings.TrimSpace(reason), "=")
+		switch reason {
+		case tlslistener.ReasonNoTicketSupport, tlslistener.ReasonNoTicket, tlslistener.ReasonInvalidTicket:
+		default:
+			return nil, fmt.Errorf("unknown enforce-session-tickets reason %q", reason)
+		}
+		te.Reactions[reason] = defaultReaction
+		if hasReaction {
+			reaction, err := parseHandshakeReaction(reactionName)
+			if err != nil {
+				return nil, fmt.Errorf("invalid enforce-session-tickets reaction for %v: %w", reason, err)
+			}
+			te.Reactions[reason] = reaction
+		}
+		log.Debugf("Enforcing session tickets for %v with %v", reason, te.Reactions[reason].Action())
+	}
+	if countryPercents != "" {
+		te.CountryPercents = make(map[string]float64)
+		for _, countryPercent := range strings.Split(countryPercents, ",") {
+			country, percentStr, _ := strings.Cut(strings.TrimSpace(countryPercent), "=")
+			value, err := strconv.ParseFloat(percentStr, 64)
+			if err != nil || value < 0 || value > 100 {
+				return nil, fmt.Errorf("invalid enforce-session-tickets-countries entry %q", countryPercent)
+			}
+			te.CountryPercents[strings.ToLower(country)] = value
+		}
+	}
+	return te, nil
+}
+
 func decodeUint16(s string) (uint16, error) {
 	b, err := hex.DecodeString(strings.TrimPrefix(s, "0x"))
 	if err != nil {
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"sync"
+
+	"github.com/vharitonsky/iniflags"
+
+	proxy "github.com/getlantern/http-proxy-lantern/v2"
+)
+
+// reloadableFlags are the flags that are applied to a running proxy when the
+// config file is reloaded on SIGHUP. Changes to any other flag are only
+// reported, as they require a restart.
+var reloadableFlags = map[string]bool{
+	"token":                          true,
+	"tokens":                         true,
+	"tunnelports":                    true,
+	"sessionticketkeys":              true,
+	"shadowsocks-secret":             true,
+	"shadowsocks-cipher":             true,
+	"throttlerefresh":                true,
+	"blacklist-mode":                 true,
+	"blacklist-max-idle-time":        true,
+	"blacklist-max-connect-interval": true,
+	"blacklist-allowed-failures":     true,
+	"blacklist-expiration":           true,
+}
+
+// configReloader applies changes to reloadable flags to a running proxy.
+// iniflags re-reads the config file given with -config on SIGHUP, including
+// any #import directives, and then notifies us of every flag that changed.
+type configReloader struct {
+	p *proxy.Proxy
+	// values are the flag values the proxy is running with
+	values map[string]string
+	mx     sync.Mutex
+}
+
+// newConfigReloader registers a configReloader for changes to all flags. It
+// has to be called before iniflags.Parse.
+func newConfigReloader() *configReloader {
+	r := &configReloader{}
+	flag.VisitAll(func(f *flag.Flag) {
+		iniflags.OnFlagChange(f.Name, r.reload)
+	})
+	return r
+}
+
+// start starts applying changes to the given proxy, which is running with the
+// current flag values.
+func (r *configReloader) start(p *proxy.Proxy) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.p = p
+	r.values = currentFlagValues()
+}
+
+// reload is called by iniflags after it has set all flags from the config
+// file, once for each flag that changed. The first call applies all changes,
+// the remaining ones find nothing left to do.
+func (r *configReloader) reload() {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.p == nil {
+		// not running yet, the proxy will be configured with the new values
+		return
+	}
+
+	hasChanges := false
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Value.String() == r.values[f.Name] {
+			return
+		}
+		if reloadableFlags[f.Name] {
+			log.Debugf("%v changed, applying", f.Name)
+			hasChanges = true
+			return
+		}
+		log.Errorf("%v changed, but this requires a restart to take effect", f.Name)
+		// keep the flag consistent with what's actually running
+		_ = f.Value.Set(r.values[f.Name])
+	})
+	if !hasChanges {
+		return
+	}
+
+	err := r.p.Reload(proxy.ReloadableSettings{
+		Token:                       *token,
+		Tokens:                      *tokens,
+		TunnelPorts:                 *tunnelPorts,
+		SessionTicketKeys:           *sessionTicketKeys,
+		ShadowsocksSecret:           *shadowsocksSecret,
+		ShadowsocksCipher:           *shadowsocksCipher,
+		ThrottleRefreshInterval:     *throttleRefreshInterval,
+		BlacklistMode:               *blacklistMode,
+		BlacklistMaxIdleTime:        *blacklistMaxIdleTime,
+		BlacklistMaxConnectInterval: *blacklistMaxConnectInterval,
+		BlacklistAllowedFailures:    *blacklistAllowedFailures,
+		BlacklistExpiration:         *blacklistExpiration,
+	})
+	if err != nil {
+		log.Errorf("Unable to reload config, keeping the current settings: %v", err)
+		flag.VisitAll(func(f *flag.Flag) {
+			if f.Value.String() != r.values[f.Name] {
+				_ = f.Value.Set(r.values[f.Name])
+			}
+		})
+		return
+	}
+	r.values = currentFlagValues()
+	log.Debug("Reloaded config")
+}
+
+func currentFlagValues() map[string]string {
+	values := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		values[f.Name] = f.Value.String()
+	})
+	return values
+}
@@ -13,8 +13,10 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/Jigsaw-Code/outline-ss-server/service"
 	rclient "github.com/go-redis/redis/v8"
 
 	"github.com/getlantern/cmux/v2"
@@ -56,15 +58,18 @@ import (
 	"github.com/getlantern/http-proxy-lantern/v2/googlefilter"
 	"github.com/getlantern/http-proxy-lantern/v2/httpsupgrade"
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/ipfilter"
 	"github.com/getlantern/http-proxy-lantern/v2/lampshade"
 	"github.com/getlantern/http-proxy-lantern/v2/mimic"
 	"github.com/getlantern/http-proxy-lantern/v2/obfs4listener"
 	"github.com/getlantern/http-proxy-lantern/v2/ping"
+	"github.com/getlantern/http-proxy-lantern/v2/protoken"
 	"github.com/getlantern/http-proxy-lantern/v2/redis"
 	"github.com/getlantern/http-proxy-lantern/v2/throttle"
 	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
 	"github.com/getlantern/http-proxy-lantern/v2/tlsmasq"
 	"github.com/getlantern/http-proxy-lantern/v2/tokenfilter"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
 	"github.com/getlantern/http-proxy-lantern/v2/wss"
 
 	algeneva "github.com/getlantern/lantern-algeneva"
@@ -73,6 +78,14 @@ import (
 const (
 	timeoutToDialOriginSite = 10 * time.Second
 
+	// DefaultShutdownTimeout is used for ShutdownTimeout if a non-positive
+	// value is specified.
+	DefaultShutdownTimeout = 1 * time.Minute
+
+	// timeoutToFlushReports bounds how long we wait to submit the final usage
+	// stats on shutdown, after all connections have been drained or closed.
+	timeoutToFlushReports = 30 * time.Second
+
 	teleportHost = "telemetry.iantem.io:443"
 )
 
@@ -100,14 +113,38 @@ type Proxy struct {
 	EnableMultipath                    bool
 	HTTPS                              bool
 	IdleTimeout                        time.Duration
+	MaxConns                           uint64
+	MaxConnsPerProtocol                string
+	IPLimitRate                        float64
+	IPLimitBurst                       int64
+	IPLimitMaxConns                    int64
+	IPLimitIPv4PrefixLen               int
+	IPLimitIPv6PrefixLen               int
+	IPLimitExempt                      string
+	AllowCIDRs                         string
+	DenyCIDRs                          string
+	DenyASNs                           string
+	DenyCountries                      string
+	ShutdownTimeout                    time.Duration
 	KeyFile                            string
 	Track                              string
 	Pro                                bool
 	ProxiedSitesSamplePercentage       float64
 	ProxiedSitesTrackingID             string
 	ReportingRedisClient               *rclient.Client
+	UsageBufferFile                    string
+	DeviceFetchBatchSize               int
+	DeviceFetchFlushInterval           time.Duration
+	DeviceFetchWorkers                 int
+	ProTokenPublicKey                  string
 	ThrottleRefreshInterval            time.Duration
+	ThrottleConfigFile                 string
+	ThrottleConfigURL                  string
+	DomainPolicyFile                   string
+	DomainPolicyRedisKey               string
+	DomainPolicyRefreshInterval        time.Duration
 	Token                              string
+	Tokens                             string
 	TunnelPorts                        string
 	Obfs4Addr                          string
 	Obfs4MultiplexAddr                 string
@@ -123,10 +160,13 @@ type Proxy struct {
 	LampshadeMaxClientInitAge          time.Duration
 	GoogleSearchRegex                  string
 	GoogleCaptchaRegex                 string
+	BlacklistMode                      string
 	BlacklistMaxIdleTime               time.Duration
 	BlacklistMaxConnectInterval        time.Duration
 	BlacklistAllowedFailures           int
 	BlacklistExpiration                time.Duration
+	BlacklistRedis                     bool
+	BlacklistSyncInterval              time.Duration
 	ProxyName                          string
 	ProxyProtocol                      string
 	Provider                           string
@@ -143,9 +183,14 @@ type Proxy struct {
 	SessionTicketKeys                  string
 	SessionTicketKeyFile               string
 	FirstSessionTicketKey              string
+	SessionTicketKeyRingFile           string
+	SessionTicketKeyRingRedis          bool
 	RequireSessionTickets              bool
 	MissingTicketReaction              tlslistener.HandshakeReaction
+	TicketEnforcement                  *tlslistener.TicketEnforcement
 	TLSListenerAllowTLS13              bool
+	TLSListenerReplayHistory           int
+	TLSListenerReplayWindow            time.Duration
 	TLSMasqAddr                        string
 	TLSMasqOriginAddr                  string
 	TLSMasqSecret                      string
@@ -184,8 +229,30 @@ type Proxy struct {
 
 	AlgenevaAddr string
 
-	throttleConfig throttle.Config
-	instrument     instrument.Instrument
+	AdminAddr  string
+	AdminToken string
+
+	throttleConfig       throttle.Config
+	usage                *usage.Cache
+	instrument           instrument.Instrument
+	sessionTicketKeyRing *tlslistener.SessionTicketKeyRing
+	tlsReplayCache       *tlslistener.ReplayCache
+	ipLimiter            *listeners.IPLimiter
+	ipFilter             *ipfilter.Filter
+
+	// the following are kept around so that settings can be changed with Reload
+	reloadMx                 sync.Mutex
+	reloaded                 *ReloadableSettings
+	tokenFilter              *tokenfilter.TokenFilter
+	blacklist                *blacklist.Blacklist
+	tunnelPorts              []int
+	tunnelPortsMx            sync.RWMutex
+	sessionTicketKeyUpdaters []tlslistener.SessionTicketKeysUpdater
+	shadowsocksCipherLists   []service.CipherList
+
+	// the following are reported by the admin API
+	activeListeners            []*activeListener
+	sessionTicketKeyInspectors []tlslistener.SessionTicketKeysInspector
 }
 
 type listenerBuilderFN func(addr string) (net.Listener, error)
@@ -200,6 +267,9 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		log.Debugf("Maxmind not configured, will not report ISP data with telemetry")
 		p.ISPLookup = geo.NoLookup{}
 	}
+	if p.TicketEnforcement != nil && p.TicketEnforcement.CountryLookup == nil {
+		p.TicketEnforcement.CountryLookup = p.CountryLookup
+	}
 
 	var err error
 	p.instrument, err = instrument.NewDefault(
@@ -215,18 +285,31 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		log.Errorf("Unable to set up packet forwarding, will continue to start up: %v", err)
 	}
 	p.setBenchmarkMode()
-	p.loadThrottleConfig()
+	if err := p.loadThrottleConfig(); err != nil {
+		return err
+	}
+	p.usage = usage.New(usage.Options{Instrument: p.instrument})
+	p.loadSessionTicketKeyRing(ctx)
+	p.tlsReplayCache = tlslistener.NewReplayCache(p.TLSListenerReplayHistory, p.TLSListenerReplayWindow)
+	if err := p.loadDomainPolicy(ctx); err != nil {
+		return err
+	}
 
 	if p.ENHTTPAddr != "" {
 		return p.ListenAndServeENHTTP()
 	}
 
 	// Only allow connections from remote IPs that are not blacklisted
-	blacklist := p.createBlacklist()
+	blacklist, err := p.createBlacklist()
+	if err != nil {
+		return err
+	}
+	p.blacklist = blacklist
 	filterChain, dial, err := p.createFilterChain(blacklist)
 	if err != nil {
 		return err
 	}
+	p.enableReload()
 
 	if p.WSSAddr != "" {
 		filterChain = filterChain.Append(wss.NewMiddleware())
@@ -269,6 +352,19 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 	listenerProtocols := make([]string, 0)
 
 	listenerArgs := getProtoListenersArgs(p)
+	maxConnsPerProtocol, err := p.maxConnsPerProtocol(listenerArgs)
+	if err != nil {
+		return err
+	}
+	globalConnLimit := listeners.NewConnLimit(p.MaxConns)
+	p.ipLimiter, err = p.createIPLimiter(ctx)
+	if err != nil {
+		return err
+	}
+	p.ipFilter, err = p.createIPFilter()
+	if err != nil {
+		return err
+	}
 	for _, args := range listenerArgs {
 		if args.addr == "" {
 			continue
@@ -280,9 +376,15 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		}
 
 		listenerProtocols = append(listenerProtocols, args.protocol)
-		// Although we include blacklist functionality, it's currently only used to
-		// track potential blacklisting ad doesn't actually blacklist anyone.
-		allListeners = append(allListeners, listeners.NewAllowingListener(l, blacklist.OnConnect))
+		l = p.trackActiveListener(args.protocol, args.addr, l)
+		l = p.limitConnections(args.protocol, l, listeners.NewConnLimit(maxConnsPerProtocol[args.protocol]), globalConnLimit)
+		allListeners = append(allListeners, l)
+	}
+
+	if p.AdminAddr != "" {
+		if err := p.listenAndServeAdmin(ctx); err != nil {
+			return err
+		}
 	}
 
 	errCh := make(chan error, len(allListeners))
@@ -309,10 +411,34 @@ func (p *Proxy) ListenAndServe(ctx context.Context) error {
 		return err
 	case <-ctx.Done():
 		// this is an expected path for closing, no error
-		return err
+		p.shutdown(srv, bwReporting)
+		return nil
 	}
 }
 
+// shutdown stops accepting new connections, waits up to ShutdownTimeout for
+// active connections to finish and then flushes any usage data that hasn't
+// been reported yet.
+func (p *Proxy) shutdown(srv *server.Server, bwReporting *reportingConfig) {
+	shutdownTimeout := p.ShutdownTimeout
+	if shutdownTimeout <= 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	log.Debugf("Shutting down, waiting up to %v for active connections to finish", shutdownTimeout)
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelDrain()
+	if err := srv.Shutdown(drainCtx); err != nil {
+		log.Errorf("Unable to drain all connections, closed remaining connections: %v", err)
+	}
+
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), timeoutToFlushReports)
+	defer cancelFlush()
+	if err := bwReporting.flush(flushCtx); err != nil {
+		log.Errorf("Unable to flush usage reports: %v", err)
+	}
+	log.Debug("Finished shutting down")
+}
+
 func (p *Proxy) ListenAndServeENHTTP() error {
 	el, err := net.Listen("tcp", p.ENHTTPAddr)
 	if err != nil {
@@ -323,7 +449,11 @@ func (p *Proxy) ListenAndServeENHTTP() error {
 	if err != nil {
 		return errors.New("unable to instrument ping filter: %v", err)
 	}
-	filterChain := filters.Join(tokenfilter.New(p.Token, p.instrument), instrumentedPingFilter)
+	tokens, err := p.authTokens()
+	if err != nil {
+		return err
+	}
+	filterChain := filters.Join(tokenfilter.NewWithTokens(tokens, p.instrument), instrumentedPingFilter)
 	enhttpHandler := enhttp.NewServerHandler(p.ENHTTPReapIdleTime, p.ENHTTPServerURL)
 	instrumentedProxyFilter, err := p.instrument.WrapFilter("proxy", filterChain)
 	if err != nil {
@@ -343,13 +473,16 @@ func (p *Proxy) wrapTLSIfNecessary(fn listenerBuilderFN) listenerBuilderFN {
 		}
 
 		if p.HTTPS {
+			sessionTicketKeys := p.reloadableSettings().SessionTicketKeys
 			l, err = tlslistener.Wrap(
-				l, p.KeyFile, p.CertFile, p.SessionTicketKeyFile, p.FirstSessionTicketKey, p.SessionTicketKeys,
-				p.RequireSessionTickets, p.MissingTicketReaction, p.TLSListenerAllowTLS13,
+				l, p.KeyFile, p.CertFile, p.SessionTicketKeyFile, p.FirstSessionTicketKey, sessionTicketKeys, p.sessionTicketKeyRing,
+				p.RequireSessionTickets, p.MissingTicketReaction, p.TicketEnforcement, p.tlsReplayCache, p.TLSListenerAllowTLS13,
 				p.instrument)
 			if err != nil {
 				return nil, err
 			}
+			p.trackSessionTicketKeyUpdater(l, sessionTicketKeys)
+			p.trackSessionTicketKeysInspector(l)
 
 			log.Debugf("Using TLS on %v", l.Addr())
 		}
@@ -462,13 +595,68 @@ func (p *Proxy) setBenchmarkMode() {
 	}
 }
 
-func (p *Proxy) createBlacklist() *blacklist.Blacklist {
-	return blacklist.New(blacklist.Options{
+// authTokens returns the tokens accepted by the token filter, which are the
+// labeled tokens in Tokens plus Token, if set.
+func (p *Proxy) authTokens() ([]tokenfilter.Token, error) {
+	return parseAuthTokens(p.Token, p.Tokens)
+}
+
+func parseAuthTokens(token, labeledTokens string) ([]tokenfilter.Token, error) {
+	tokens, err := tokenfilter.ParseTokens(labeledTokens)
+	if err != nil {
+		return nil, errors.New("invalid auth tokens: %v", err)
+	}
+	if token != "" {
+		tokens = append(tokens, tokenfilter.Token{Token: token, Label: tokenfilter.DefaultLabel})
+	}
+	return tokens, nil
+}
+
+func (p *Proxy) createBlacklist() (*blacklist.Blacklist, error) {
+	mode, err := blacklist.ParseMode(p.BlacklistMode)
+	if err != nil {
+		return nil, err
+	}
+	opts := blacklist.Options{
+		Mode:               mode,
 		MaxIdleTime:        p.BlacklistMaxIdleTime,        // 30 * time.Second,
 		MaxConnectInterval: p.BlacklistMaxConnectInterval, // 5 * time.Second,
 		AllowedFailures:    p.BlacklistAllowedFailures,    // 10,
 		Expiration:         p.BlacklistExpiration,         // 6 * time.Hour,
-	})
+		SyncInterval:       p.BlacklistSyncInterval,
+		CountryLookup:      p.CountryLookup,
+		Instrument:         p.instrument,
+	}
+	if p.BlacklistRedis {
+		if p.ReportingRedisClient == nil {
+			log.Error("No reporting redis client configured, not sharing blacklist through redis")
+		} else {
+			log.Debugf("Sharing blacklist through redis on track %q", p.Track)
+			opts.Store = redis.NewBlacklistStore(p.ReportingRedisClient, p.Track)
+		}
+	}
+	return blacklist.New(opts), nil
+}
+
+// loadSessionTicketKeyRing starts maintaining the session ticket key ring
+// shared by all TLS listeners, if one is configured.
+func (p *Proxy) loadSessionTicketKeyRing(ctx context.Context) {
+	var source tlslistener.KeyRingSource
+	if p.SessionTicketKeyRingRedis {
+		if p.ReportingRedisClient != nil {
+			log.Debugf("Loading session ticket key ring for track %q from redis", p.Track)
+			source = redis.NewSessionTicketKeyRing(p.ReportingRedisClient, p.Track, p.ProxyName)
+		} else {
+			log.Error("No reporting redis client configured, not loading session ticket key ring from redis")
+		}
+	}
+	if source == nil && p.SessionTicketKeyRingFile != "" {
+		log.Debugf("Loading session ticket key ring from %v", p.SessionTicketKeyRingFile)
+		source = tlslistener.NewKeyRingFile(p.SessionTicketKeyRingFile)
+	}
+	if source != nil {
+		p.sessionTicketKeyRing = tlslistener.MaintainSessionTicketKeyRing(ctx, source)
+	}
 }
 
 // createFilterChain creates a chain of filters that modify the default behavior
@@ -479,6 +667,12 @@ func (p *Proxy) createBlacklist() *blacklist.Blacklist {
 func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy.DialFunc, error) {
 	filterChain := filters.Join()
 
+	tunnelPorts, err := p.allowedTunnelPorts()
+	if err != nil {
+		return nil, nil, err
+	}
+	p.setTunnelPorts(tunnelPorts)
+
 	if p.Benchmark {
 		filterChain = filterChain.Append(proxyfilters.RateLimit(5000, map[string]time.Duration{
 			"www.google.com":      30 * time.Minute,
@@ -489,15 +683,33 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 			"ping-chained-server": 1 * time.Nanosecond, // Internal ping-chained-server protocol
 		}))
 	} else {
-		filterChain = filterChain.Append(proxy.OnFirstOnly(tokenfilter.New(p.Token, p.instrument)))
+		tokens, err := p.authTokens()
+		if err != nil {
+			return nil, nil, err
+		}
+		p.tokenFilter = tokenfilter.NewWithTokens(tokens, p.instrument)
+		filterChain = filterChain.Append(proxy.OnFirstOnly(p.tokenFilter))
 	}
 
 	if p.ReportingRedisClient == nil {
 		log.Debug("Not enabling bandwidth limiting")
 	} else {
+		if p.ProTokenPublicKey != "" {
+			publicKey, err := protoken.ParsePublicKey(p.ProTokenPublicKey)
+			if err != nil {
+				return nil, nil, err
+			}
+			log.Debug("Exempting devices with valid pro tokens from bandwidth limiting")
+			filterChain = filterChain.Append(proxy.OnFirstOnly(protoken.NewFilter(publicKey)))
+		}
+		deviceFetcher := redis.NewDeviceFetcher(p.ReportingRedisClient, p.usage, redis.DeviceFetcherOptions{
+			BatchSize:     p.DeviceFetchBatchSize,
+			FlushInterval: p.DeviceFetchFlushInterval,
+			Workers:       p.DeviceFetchWorkers,
+		})
 		filterChain = filterChain.Append(
 			proxy.OnFirstOnly(devicefilter.NewPre(
-				redis.NewDeviceFetcher(p.ReportingRedisClient), p.throttleConfig, !p.Pro, p.instrument)),
+				deviceFetcher, p.usage, p.throttleConfig, !p.Pro, p.instrument)),
 		)
 	}
 
@@ -558,7 +770,7 @@ func (p *Proxy) createFilterChain(bl *blacklist.Blacklist) (filters.Chain, proxy
 			return next(cs, req)
 		}),
 		httpsupgrade.NewHTTPSUpgrade(p.CfgSvrAuthToken),
-		proxyfilters.RestrictConnectPorts(p.allowedTunnelPorts()),
+		proxyfilters.RestrictConnectPortsWith(p.getTunnelPorts),
 		proxyfilters.RecordOp,
 		cleanheadersfilter.New(), // IMPORTANT, this should be the last filter in the chain to avoid stripping any headers that other filters might need
 	)
@@ -657,28 +869,81 @@ func (p *Proxy) buildOTELOpts(endpoint string, includeProxyName bool) *otel.Opts
 }
 
 func (p *Proxy) configureBandwidthReporting() *reportingConfig {
-	return newReportingConfig(p.CountryLookup, p.ReportingRedisClient, p.instrument, p.throttleConfig)
+	return newReportingConfig(p.CountryLookup, p.ReportingRedisClient, p.instrument, p.throttleConfig, p.usage, p.UsageBufferFile)
 }
 
-func (p *Proxy) loadThrottleConfig() {
-	if !p.Pro && p.ThrottleRefreshInterval > 0 && p.ReportingRedisClient != nil {
+// loadThrottleConfig starts loading the throttle config from a file, a URL or
+// redis, if applicable.
+func (p *Proxy) loadThrottleConfig() error {
+	switch {
+	case p.ThrottleConfigFile != "" && p.ThrottleConfigURL != "":
+		return errors.New("Throttle config can be loaded from a file or from a URL, but not both")
+	case p.Pro:
+		log.Debug("Not loading throttle config for pro proxy")
+	case p.ThrottleConfigFile != "":
+		log.Debugf("Loading throttle config from %v", p.ThrottleConfigFile)
+		p.throttleConfig = throttle.NewFileConfig(p.ThrottleConfigFile, p.ThrottleRefreshInterval)
+	case p.ThrottleConfigURL != "":
+		log.Debugf("Loading throttle config from %v", p.ThrottleConfigURL)
+		p.throttleConfig = throttle.NewHTTPConfig(p.ThrottleConfigURL, p.ThrottleRefreshInterval)
+	case p.ThrottleRefreshInterval > 0 && p.ReportingRedisClient != nil:
 		p.throttleConfig = throttle.NewRedisConfig(p.ReportingRedisClient, p.ThrottleRefreshInterval)
-	} else {
+	default:
 		log.Debug("Not loading throttle config")
-		return
 	}
+	return nil
 }
 
-func (p *Proxy) allowedTunnelPorts() []int {
-	if p.TunnelPorts == "" {
+// loadDomainPolicy starts loading the domain policy from a file or redis, if
+// configured. Otherwise, the built-in policy is used.
+func (p *Proxy) loadDomainPolicy(ctx context.Context) error {
+	switch {
+	case p.DomainPolicyFile != "" && p.DomainPolicyRedisKey != "":
+		return errors.New("Domain policy can be loaded from a file or from redis, but not both")
+	case p.DomainPolicyFile != "":
+		if err := domains.KeepCurrent(ctx, domains.NewFileSource(p.DomainPolicyFile), p.DomainPolicyRefreshInterval); err != nil {
+			return errors.New("Unable to load domain policy: %v", err)
+		}
+	case p.DomainPolicyRedisKey != "":
+		if p.ReportingRedisClient == nil {
+			return errors.New("Loading domain policy from redis requires a reporting redis client")
+		}
+		if err := domains.KeepCurrent(ctx, domains.NewRedisSource(p.ReportingRedisClient, p.DomainPolicyRedisKey), p.DomainPolicyRefreshInterval); err != nil {
+			// the key may not have been populated yet, keep checking in the background
+			log.Errorf("Unable to load domain policy, using built-in policy for now: %v", err)
+		}
+	default:
+		log.Debug("Using built-in domain policy")
+	}
+	return nil
+}
+
+func (p *Proxy) allowedTunnelPorts() ([]int, error) {
+	return parseTunnelPorts(p.TunnelPorts)
+}
+
+func parseTunnelPorts(tunnelPorts string) ([]int, error) {
+	if tunnelPorts == "" {
 		log.Debug("tunnelling all ports")
-		return nil
+		return nil, nil
 	}
-	ports, err := portsFromCSV(p.TunnelPorts)
+	ports, err := portsFromCSV(tunnelPorts)
 	if err != nil {
-		log.Fatal(err)
+		return nil, errors.New("Unable to parse tunnel ports %v: %v", tunnelPorts, err)
 	}
-	return ports
+	return ports, nil
+}
+
+func (p *Proxy) setTunnelPorts(ports []int) {
+	p.tunnelPortsMx.Lock()
+	p.tunnelPorts = ports
+	p.tunnelPortsMx.Unlock()
+}
+
+func (p *Proxy) getTunnelPorts() []int {
+	p.tunnelPortsMx.RLock()
+	defer p.tunnelPortsMx.RUnlock()
+	return p.tunnelPorts
 }
 
 func (p *Proxy) listenHTTP(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
@@ -769,6 +1034,11 @@ func (p *Proxy) listenTCP(addr string) (net.Listener, error) {
 	return l, nil
 }
 
+// listenRawTCP listens on TCP without any of the wrapping done by listenTCP.
+func listenRawTCP(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
 func (p *Proxy) listenKCP(kcpConf string) (net.Listener, error) {
 	cfg := &kcpwrapper.ListenerConfig{}
 	file, err := os.Open(kcpConf) // For read access.
@@ -811,52 +1081,53 @@ func (p *Proxy) listenQUICIETF(addr string) (net.Listener, error) {
 	return l, err
 }
 
-func (p *Proxy) listenShadowsocks(addr string) (net.Listener, error) {
-	// This is not using p.ListenTCP on purpose to avoid additional wrapping with idle timing.
-	// The idea here is to be as close to what outline shadowsocks does without any intervention,
-	// especially with respect to draining connections and the timing of closures.
+func (p *Proxy) listenShadowsocks(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
+	return func(addr string) (net.Listener, error) {
+		ciphers, err := p.newShadowsocksCipherList()
+		if err != nil {
+			return nil, errors.New("Unable to create shadowsocks cipher: %v", err)
+		}
+		var tlsConfig *tls.Config
+		if p.ShadowsocksWithTLS {
+			var cert tls.Certificate
+			cert, err = tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+			if err != nil {
+				return nil, errors.New("unable to load cert: %v", err)
+			}
 
-	configs := []shadowsocks.CipherConfig{
-		{
-			ID:     "default",
-			Secret: p.ShadowsocksSecret,
-			Cipher: p.ShadowsocksCipher,
-		},
-	}
-	ciphers, err := shadowsocks.NewCipherListWithConfigs(configs)
-	if err != nil {
-		return nil, errors.New("Unable to create shadowsocks cipher: %v", err)
-	}
-	var tlsConfig *tls.Config
-	if p.ShadowsocksWithTLS {
-		var cert tls.Certificate
-		cert, err = tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+
+		base, err := baseListen(addr)
 		if err != nil {
-			return nil, errors.New("unable to load cert: %v", err)
+			return nil, err
 		}
 
-		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
-	}
+		l, err := shadowsocks.ListenLocalTCP(
+			base, ciphers,
+			p.ShadowsocksReplayHistory,
+		)
+		if err != nil {
+			return nil, errors.New("Unable to listen for shadowsocks: %v", err)
+		}
 
-	base, err := net.Listen("tcp", addr)
-	if err != nil {
-		return nil, err
-	}
+		if tlsConfig != nil {
+			l = tls.NewListener(l, tlsConfig)
+		}
 
-	l, err := shadowsocks.ListenLocalTCP(
-		base, ciphers,
-		p.ShadowsocksReplayHistory,
-	)
-	if err != nil {
-		return nil, errors.New("Unable to listen for shadowsocks: %v", err)
+		log.Debugf("Listening for shadowsocks at %v", l.Addr())
+		return l, nil
 	}
+}
 
-	if tlsConfig != nil {
-		l = tls.NewListener(l, tlsConfig)
+func shadowsocksCipherConfigs(secret, cipher string) []shadowsocks.CipherConfig {
+	return []shadowsocks.CipherConfig{
+		{
+			ID:     "default",
+			Secret: secret,
+			Cipher: cipher,
+		},
 	}
-
-	log.Debugf("Listening for shadowsocks at %v", l.Addr())
-	return l, nil
 }
 
 func (p *Proxy) listenStarbridge(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
@@ -888,12 +1159,15 @@ func (p *Proxy) listenWSS(addr string) (net.Listener, error) {
 	}
 
 	if p.HTTPS {
+		sessionTicketKeys := p.reloadableSettings().SessionTicketKeys
 		l, err = tlslistener.Wrap(
-			l, p.KeyFile, p.CertFile, p.SessionTicketKeyFile, p.FirstSessionTicketKey, p.SessionTicketKeys,
-			p.RequireSessionTickets, p.MissingTicketReaction, p.TLSListenerAllowTLS13, p.instrument)
+			l, p.KeyFile, p.CertFile, p.SessionTicketKeyFile, p.FirstSessionTicketKey, sessionTicketKeys, p.sessionTicketKeyRing,
+			p.RequireSessionTickets, p.MissingTicketReaction, p.TicketEnforcement, p.tlsReplayCache, p.TLSListenerAllowTLS13, p.instrument)
 		if err != nil {
 			return nil, err
 		}
+		p.trackSessionTicketKeyUpdater(l, sessionTicketKeys)
+		p.trackSessionTicketKeysInspector(l)
 		log.Debugf("Using TLS on %v", l.Addr())
 	}
 	opts := &tinywss.ListenOpts{
@@ -911,7 +1185,7 @@ func (p *Proxy) listenWSS(addr string) (net.Listener, error) {
 
 func (p *Proxy) listenBroflake(baseListen func(string) (net.Listener, error)) listenerBuilderFN {
 	return func(addr string) (net.Listener, error) {
-		l, err := net.Listen("tcp", addr)
+		l, err := baseListen(addr)
 		if err != nil {
 			return nil, err
 		}
@@ -994,6 +1268,166 @@ func (p *Proxy) setupPacketForward() error {
 	return nil
 }
 
+// maxConnsPerProtocol parses MaxConnsPerProtocol, which is a comma-separated
+// list of protocol=maxconns pairs, for example "https=1000,shadowsocks=500".
+func (p *Proxy) maxConnsPerProtocol(listenerArgs []protoListenerArgs) (map[string]uint64, error) {
+	result := make(map[string]uint64)
+	if p.MaxConnsPerProtocol == "" {
+		return result, nil
+	}
+	knownProtocols := make(map[string]bool, len(listenerArgs))
+	for _, args := range listenerArgs {
+		knownProtocols[args.protocol] = true
+	}
+	for _, f := range strings.Split(p.MaxConnsPerProtocol, ",") {
+		parts := strings.Split(strings.TrimSpace(f), "=")
+		if len(parts) != 2 {
+			return nil, errors.New("Unable to parse max connections per protocol %v: expected protocol=maxconns", f)
+		}
+		protocol := strings.TrimSpace(parts[0])
+		if !knownProtocols[protocol] {
+			return nil, errors.New("Unable to parse max connections per protocol: unknown protocol %v", protocol)
+		}
+		maxConns, err := strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return nil, errors.New("Unable to parse max connections for %v: %v", protocol, err)
+		}
+		result[protocol] = maxConns
+	}
+	return result, nil
+}
+
+// limitConnections wraps the given protocol listener so that it stops
+// accepting connections while either limit is reached.
+func (p *Proxy) limitConnections(protocol string, l net.Listener, limits ...*listeners.ConnLimit) net.Listener {
+	return listeners.NewSharedLimitedListener(l, func(pausedFor time.Duration) {
+		p.instrument.ListenerPaused(context.Background(), protocol, pausedFor)
+	}, limits...)
+}
+
+// createIPLimiter creates the IPLimiter shared by all protocol listeners, or nil
+// if per-IP limits aren't configured. It stops forgetting idle clients when the
+// context is done.
+func (p *Proxy) createIPLimiter(ctx context.Context) (*listeners.IPLimiter, error) {
+	exempt, err := cidrsFromCSV(p.IPLimitExempt)
+	if err != nil {
+		return nil, errors.New("Unable to parse IP limit exemptions %v: %v", p.IPLimitExempt, err)
+	}
+	return listeners.NewIPLimiter(ctx, listeners.IPLimiterOptions{
+		Rate:          p.IPLimitRate,
+		Burst:         p.IPLimitBurst,
+		MaxConns:      p.IPLimitMaxConns,
+		IPv4PrefixLen: p.IPLimitIPv4PrefixLen,
+		IPv6PrefixLen: p.IPLimitIPv6PrefixLen,
+		Exempt:        exempt,
+	}), nil
+}
+
+// screenIPs wraps the listener created by listen so that connections from IPs
+// that are filtered, blacklisted or over their per-IP limits are closed as soon
+// as they're accepted. listen should create the base listener that a protocol
+// wraps, so that rejected clients never get to the protocol's handshake.
+func (p *Proxy) screenIPs(protocol string, listen listenerBuilderFN) listenerBuilderFN {
+	return func(addr string) (net.Listener, error) {
+		l, err := listen(addr)
+		if err != nil {
+			return nil, err
+		}
+		l = listeners.NewAllowingListener(l, p.allowIP(protocol, p.ipFilter, p.blacklist))
+		return p.limitIPs(protocol, l, p.ipLimiter), nil
+	}
+}
+
+// limitIPs wraps the given listener to reject connections from clients that
+// exceed the per-IP limits.
+func (p *Proxy) limitIPs(protocol string, l net.Listener, limiter *listeners.IPLimiter) net.Listener {
+	return listeners.NewIPLimitingListener(l, limiter, func(ip net.IP, reason string) {
+		p.instrument.IPLimited(context.Background(), protocol, ip, reason)
+	})
+}
+
+// createIPFilter creates the ipfilter.Filter for client IPs, or nil if there
+// are no allow or deny rules.
+func (p *Proxy) createIPFilter() (*ipfilter.Filter, error) {
+	allow, err := cidrsFromCSV(p.AllowCIDRs)
+	if err != nil {
+		return nil, errors.New("Unable to parse allowed CIDRs %v: %v", p.AllowCIDRs, err)
+	}
+	deny, err := cidrsFromCSV(p.DenyCIDRs)
+	if err != nil {
+		return nil, errors.New("Unable to parse denied CIDRs %v: %v", p.DenyCIDRs, err)
+	}
+	return ipfilter.New(ipfilter.Options{
+		Allow:         allow,
+		Deny:          deny,
+		DenyASNs:      valuesFromCSV(p.DenyASNs),
+		DenyCountries: valuesFromCSV(p.DenyCountries),
+		CountryLookup: p.CountryLookup,
+		ISPLookup:     p.ISPLookup,
+	}), nil
+}
+
+// allowIP returns the function used by the protocol listener to decide whether
+// to accept connections from a given IP. IPs rejected by the filter never make
+// it to the blacklist. Depending on BlacklistMode, the blacklist either allows
+// everyone, only tracks potential blacklisting or actually rejects blacklisted
+// IPs.
+func (p *Proxy) allowIP(protocol string, filter *ipfilter.Filter, bl *blacklist.Blacklist) func(string) bool {
+	if filter == nil {
+		return bl.OnConnect
+	}
+	return func(ip string) bool {
+		parsedIP := net.ParseIP(ip)
+		if reason := filter.Check(parsedIP); reason != "" {
+			log.Tracef("Rejecting %v connection from %v: %v", protocol, ip, reason)
+			p.instrument.IPFiltered(context.Background(), protocol, parsedIP, reason)
+			return false
+		}
+		return bl.OnConnect(ip)
+	}
+}
+
+// valuesFromCSV splits a comma-separated list, ignoring empty values.
+func valuesFromCSV(csv string) []string {
+	var result []string
+	for _, v := range strings.Split(csv, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// cidrsFromCSV parses a comma-separated list of CIDRs. Plain IP addresses are
+// treated as single-address networks.
+func cidrsFromCSV(csv string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, f := range strings.Split(csv, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, errors.New("invalid IP address %v", f)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
 func portsFromCSV(csv string) ([]int, error) {
 	fields := strings.Split(csv, ",")
 	ports := make([]int, len(fields))
@@ -620,6 +620,36 @@ func TestPortsFromCSV(t *testing.T) {
 	}
 }
 
+func TestCIDRsFromCSV(t *testing.T) {
+	cidrs, err := cidrsFromCSV("10.0.0.0/8, 1.2.3.4,2001:db8::/32")
+	if assert.NoError(t, err) && assert.Len(t, cidrs, 3) {
+		assert.Equal(t, "10.0.0.0/8", cidrs[0].String())
+		assert.Equal(t, "1.2.3.4/32", cidrs[1].String())
+		assert.Equal(t, "2001:db8::/32", cidrs[2].String())
+	}
+	cidrs, err = cidrsFromCSV("")
+	assert.NoError(t, err)
+	assert.Empty(t, cidrs)
+	_, err = cidrsFromCSV("10.0.0.0/33")
+	assert.Error(t, err)
+	_, err = cidrsFromCSV("localhost")
+	assert.Error(t, err)
+}
+
+func TestMaxConnsPerProtocol(t *testing.T) {
+	p := &Proxy{MaxConnsPerProtocol: "https=1000, shadowsocks = 500"}
+	limits, err := p.maxConnsPerProtocol(getProtoListenersArgs(p))
+	if assert.NoError(t, err) {
+		assert.Equal(t, map[string]uint64{"https": 1000, "shadowsocks": 500}, limits)
+	}
+
+	for _, invalid := range []string{"https", "https=lots", "gopher=10", "https=-1"} {
+		p.MaxConnsPerProtocol = invalid
+		_, err = p.maxConnsPerProtocol(getProtoListenersArgs(p))
+		assert.Error(t, err, invalid)
+	}
+}
+
 //
 // Auxiliary functions
 //
@@ -0,0 +1,94 @@
+package instrument
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// maxReportedFingerprints bounds the number of distinct ClientHello
+	// fingerprints that are reported as such. Since anyone can send arbitrary
+	// ClientHellos, all other fingerprints are reported as otherFingerprint.
+	maxReportedFingerprints = 200
+
+	// fingerprintReportingThreshold is how often a fingerprint has to be seen
+	// within fingerprintCandidateWindow before it's reported as such.
+	fingerprintReportingThreshold = 100
+
+	// maxFingerprintCandidates bounds the number of fingerprints counted
+	// towards the fingerprintReportingThreshold.
+	maxFingerprintCandidates = 10000
+
+	fingerprintCandidateWindow = 1 * time.Hour
+
+	otherFingerprint = "other"
+)
+
+type fingerprintPair struct {
+	ja3 string
+	ja4 string
+}
+
+// reportedFingerprints keeps the cardinality of ClientHello fingerprint
+// metrics bounded by only reporting common fingerprints. Fingerprints are
+// counted until they've been seen threshold times within window, from then on
+// they're reported until the proxy restarts, up to maxReported fingerprints.
+type reportedFingerprints struct {
+	maxReported     int
+	maxCandidates   int
+	threshold       int
+	window          time.Duration
+	reported        map[fingerprintPair]bool
+	candidates      map[fingerprintPair]int
+	candidatesSince time.Time
+	mx              sync.Mutex
+}
+
+func newReportedFingerprints(maxReported, maxCandidates, threshold int, window time.Duration) *reportedFingerprints {
+	return &reportedFingerprints{
+		maxReported:     maxReported,
+		maxCandidates:   maxCandidates,
+		threshold:       threshold,
+		window:          window,
+		reported:        make(map[fingerprintPair]bool),
+		candidates:      make(map[fingerprintPair]int),
+		candidatesSince: time.Now(),
+	}
+}
+
+// report counts the given fingerprints and returns them if they're reported,
+// otherwise otherFingerprint for both.
+func (f *reportedFingerprints) report(ja3, ja4 string) (string, string) {
+	pair := fingerprintPair{ja3, ja4}
+
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	if f.reported[pair] {
+		return ja3, ja4
+	}
+	if len(f.reported) >= f.maxReported {
+		return otherFingerprint, otherFingerprint
+	}
+
+	if time.Since(f.candidatesSince) >= f.window {
+		f.candidates = make(map[fingerprintPair]int)
+		f.candidatesSince = time.Now()
+	}
+	count, counted := f.candidates[pair]
+	if !counted && len(f.candidates) >= f.maxCandidates {
+		return otherFingerprint, otherFingerprint
+	}
+	count++
+	if count < f.threshold {
+		f.candidates[pair] = count
+		return otherFingerprint, otherFingerprint
+	}
+
+	delete(f.candidates, pair)
+	f.reported[pair] = true
+	if len(f.reported) >= f.maxReported {
+		// nothing else will be reported, so stop counting
+		f.candidates = make(map[fingerprintPair]int)
+	}
+	return ja3, ja4
+}
@@ -2,11 +2,13 @@ package instrument
 
 import (
 	"context"
+	"math"
 	"math/rand"
 	"net"
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.opentelemetry.io/otel/attribute"
@@ -30,13 +32,21 @@ var (
 type Instrument interface {
 	WrapFilter(prefix string, f filters.Filter) (filters.Filter, error)
 	WrapConnErrorHandler(prefix string, f func(conn net.Conn, err error)) (func(conn net.Conn, err error), error)
-	Blacklist(ctx context.Context, b bool)
+	Blacklist(ctx context.Context, fromIP net.IP, mode string, blacklisted bool, reason string)
 	Mimic(ctx context.Context, m bool)
+	AuthToken(ctx context.Context, label string, expired bool)
 	MultipathStats([]string) []multipath.StatsTracker
 	Throttle(ctx context.Context, m bool, reason string)
 	XBQHeaderSent(ctx context.Context)
+	DeviceLimiters(tracked int)
+	DeviceLimiterEvicted(ctx context.Context, reason string)
+	UsageCache(entries int, hits, misses int64)
+	ListenerPaused(ctx context.Context, protocol string, pausedFor time.Duration)
+	IPLimited(ctx context.Context, protocol string, fromIP net.IP, reason string)
+	IPFiltered(ctx context.Context, protocol string, fromIP net.IP, reason string)
 	SuspectedProbing(ctx context.Context, fromIP net.IP, reason string)
-	ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch string)
+	ClientHelloFingerprint(ctx context.Context, fromIP net.IP, ja3, ja4 string)
+	ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch, authTokenLabel string)
 	ReportProxiedBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider)
 	ReportProxiedBytes(tp *sdktrace.TracerProvider)
 	ReportOriginBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider)
@@ -58,8 +68,10 @@ func (i NoInstrument) WrapFilter(prefix string, f filters.Filter) (filters.Filte
 func (i NoInstrument) WrapConnErrorHandler(prefix string, f func(conn net.Conn, err error)) (func(conn net.Conn, err error), error) {
 	return f, nil
 }
-func (i NoInstrument) Blacklist(ctx context.Context, b bool) {}
-func (i NoInstrument) Mimic(ctx context.Context, m bool)     {}
+func (i NoInstrument) Blacklist(ctx context.Context, fromIP net.IP, mode string, blacklisted bool, reason string) {
+}
+func (i NoInstrument) Mimic(ctx context.Context, m bool)                         {}
+func (i NoInstrument) AuthToken(ctx context.Context, label string, expired bool) {}
 func (i NoInstrument) MultipathStats(protocols []string) (trackers []multipath.StatsTracker) {
 	for range protocols {
 		trackers = append(trackers, multipath.NullTracker{})
@@ -68,9 +80,17 @@ func (i NoInstrument) MultipathStats(protocols []string) (trackers []multipath.S
 }
 func (i NoInstrument) Throttle(ctx context.Context, m bool, reason string) {}
 
-func (i NoInstrument) XBQHeaderSent(ctx context.Context)                                  {}
-func (i NoInstrument) SuspectedProbing(ctx context.Context, fromIP net.IP, reason string) {}
-func (i NoInstrument) ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch string) {
+func (i NoInstrument) XBQHeaderSent(ctx context.Context)                                            {}
+func (i NoInstrument) DeviceLimiters(tracked int)                                                   {}
+func (i NoInstrument) DeviceLimiterEvicted(ctx context.Context, reason string)                      {}
+func (i NoInstrument) UsageCache(entries int, hits, misses int64)                                   {}
+func (i NoInstrument) SuspectedProbing(ctx context.Context, fromIP net.IP, reason string)           {}
+func (i NoInstrument) ClientHelloFingerprint(ctx context.Context, fromIP net.IP, ja3, ja4 string)   {}
+func (i NoInstrument) ListenerPaused(ctx context.Context, protocol string, pausedFor time.Duration) {}
+func (i NoInstrument) IPLimited(ctx context.Context, protocol string, fromIP net.IP, reason string) {}
+func (i NoInstrument) IPFiltered(ctx context.Context, protocol string, fromIP net.IP, reason string) {
+}
+func (i NoInstrument) ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch, authTokenLabel string) {
 }
 func (i NoInstrument) ReportProxiedBytesPeriodically(interval time.Duration, tp *sdktrace.TracerProvider) {
 }
@@ -100,6 +120,7 @@ type defaultInstrument struct {
 	clientStats   map[clientDetails]*usage
 	originStats   map[originDetails]*usage
 	statsMx       sync.Mutex
+	fingerprints  *reportedFingerprints
 }
 
 func NewDefault(countryLookup geo.CountryLookup, ispLookup geo.ISPLookup) (*defaultInstrument, error) {
@@ -114,6 +135,7 @@ func NewDefault(countryLookup geo.CountryLookup, ispLookup geo.ISPLookup) (*defa
 		errorHandlers: make(map[string]func(conn net.Conn, err error)),
 		clientStats:   make(map[clientDetails]*usage),
 		originStats:   make(map[originDetails]*usage),
+		fingerprints:  newReportedFingerprints(maxReportedFingerprints, maxFingerprintCandidates, fingerprintReportingThreshold, fingerprintCandidateWindow),
 	}
 
 	return p, nil
@@ -176,10 +198,24 @@ func (ins *defaultInstrument) WrapConnErrorHandler(prefix string, f func(conn ne
 	return h, nil
 }
 
-// Blacklist instruments the blacklist checking.
-func (ins *defaultInstrument) Blacklist(ctx context.Context, b bool) {
+// Blacklist instruments the blacklist checking. The country and reason are only
+// recorded for blacklisted IPs.
+func (ins *defaultInstrument) Blacklist(ctx context.Context, fromIP net.IP, mode string, blacklisted bool, reason string) {
+	if !blacklisted {
+		otelinstrument.Blacklist.Add(ctx, 1,
+			metric.WithAttributes(
+				attribute.KeyValue{"mode", attribute.StringValue(mode)},
+				attribute.KeyValue{"blacklisted", attribute.BoolValue(false)},
+			))
+		return
+	}
 	otelinstrument.Blacklist.Add(ctx, 1,
-		metric.WithAttributes(attribute.KeyValue{"blacklisted", attribute.BoolValue(b)}))
+		metric.WithAttributes(
+			attribute.KeyValue{"mode", attribute.StringValue(mode)},
+			attribute.KeyValue{"blacklisted", attribute.BoolValue(true)},
+			attribute.KeyValue{"country", attribute.StringValue(ins.countryLookup.CountryCode(fromIP))},
+			attribute.KeyValue{"reason", attribute.StringValue(reason)},
+		))
 }
 
 // Mimic instruments the Apache mimicry.
@@ -192,6 +228,15 @@ func (ins *defaultInstrument) Mimic(ctx context.Context, m bool) {
 	}
 }
 
+// AuthToken instruments requests carrying a known auth token, by token label.
+func (ins *defaultInstrument) AuthToken(ctx context.Context, label string, expired bool) {
+	otelinstrument.AuthTokens.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.KeyValue{"label", attribute.StringValue(label)},
+			attribute.KeyValue{"expired", attribute.BoolValue(expired)},
+		))
+}
+
 // Throttle instruments the device based throttling.
 func (ins *defaultInstrument) Throttle(ctx context.Context, m bool, reason string) {
 	otelinstrument.Throttling.Add(ctx, 1,
@@ -207,6 +252,58 @@ func (ins *defaultInstrument) XBQHeaderSent(ctx context.Context) {
 	otelinstrument.XBQ.Add(ctx, 1)
 }
 
+// DeviceLimiters records the number of devices for which we currently keep a
+// rate limiter.
+func (ins *defaultInstrument) DeviceLimiters(tracked int) {
+	atomic.StoreInt64(&otelinstrument.TrackedDeviceLimiters, int64(tracked))
+}
+
+// UsageCache records the number of devices whose usage is cached, along with
+// the ratio of cache hits to lookups since it was last called.
+func (ins *defaultInstrument) UsageCache(entries int, hits, misses int64) {
+	atomic.StoreInt64(&otelinstrument.UsageCacheEntries, int64(entries))
+	if total := hits + misses; total > 0 {
+		atomic.StoreUint64(&otelinstrument.UsageCacheHitRatio, math.Float64bits(float64(hits)/float64(total)))
+	}
+}
+
+// DeviceLimiterEvicted counts the rate limiters that were dropped, either
+// because they were idle or to make room for other devices.
+func (ins *defaultInstrument) DeviceLimiterEvicted(ctx context.Context, reason string) {
+	otelinstrument.DeviceLimitersEvicted.Add(ctx, 1,
+		metric.WithAttributes(attribute.KeyValue{"reason", attribute.StringValue(reason)}))
+}
+
+// ListenerPaused records that a listener stopped accepting connections for
+// pausedFor because it reached its connection limit.
+func (ins *defaultInstrument) ListenerPaused(ctx context.Context, protocol string, pausedFor time.Duration) {
+	attrs := metric.WithAttributes(attribute.KeyValue{"protocol", attribute.StringValue(protocol)})
+	otelinstrument.ListenerPauses.Add(ctx, 1, attrs)
+	otelinstrument.ListenerPausedDuration.Record(ctx, pausedFor.Seconds(), attrs)
+}
+
+// IPLimited records connections rejected because the client exceeded its
+// per-IP connection limits.
+func (ins *defaultInstrument) IPLimited(ctx context.Context, protocol string, fromIP net.IP, reason string) {
+	otelinstrument.IPLimited.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.KeyValue{"protocol", attribute.StringValue(protocol)},
+			attribute.KeyValue{"country", attribute.StringValue(ins.countryLookup.CountryCode(fromIP))},
+			attribute.KeyValue{"reason", attribute.StringValue(reason)},
+		))
+}
+
+// IPFiltered records connections rejected because the client's network, ASN or
+// country isn't allowed.
+func (ins *defaultInstrument) IPFiltered(ctx context.Context, protocol string, fromIP net.IP, reason string) {
+	otelinstrument.IPFiltered.Add(ctx, 1,
+		metric.WithAttributes(
+			attribute.KeyValue{"protocol", attribute.StringValue(protocol)},
+			attribute.KeyValue{"country", attribute.StringValue(ins.countryLookup.CountryCode(fromIP))},
+			attribute.KeyValue{"reason", attribute.StringValue(reason)},
+		))
+}
+
 // SuspectedProbing records the number of visits which looks like active
 // probing.
 func (ins *defaultInstrument) SuspectedProbing(ctx context.Context, fromIP net.IP, reason string) {
@@ -221,9 +318,26 @@ func (ins *defaultInstrument) SuspectedProbing(ctx context.Context, fromIP net.I
 	)
 }
 
+// ClientHelloFingerprint records the number of ClientHellos seen with the given
+// JA3 and JA4 fingerprints by country, which helps spotting probes and broken
+// client builds. Only common fingerprints are recorded as such, see
+// reportedFingerprints.
+func (ins *defaultInstrument) ClientHelloFingerprint(ctx context.Context, fromIP net.IP, ja3, ja4 string) {
+	ja3, ja4 = ins.fingerprints.report(ja3, ja4)
+	otelinstrument.ClientHelloFingerprints.Add(
+		ctx,
+		1,
+		metric.WithAttributes(
+			attribute.KeyValue{"country", attribute.StringValue(ins.countryLookup.CountryCode(fromIP))},
+			attribute.KeyValue{common.JA3, attribute.StringValue(ja3)},
+			attribute.KeyValue{common.JA4, attribute.StringValue(ja4)},
+		),
+	)
+}
+
 // ProxiedBytes records the volume of application data clients sent and
 // received via the proxy.
-func (ins *defaultInstrument) ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch string) {
+func (ins *defaultInstrument) ProxiedBytes(ctx context.Context, sent, recv int, platform, platformVersion, libVersion, appVersion, app, locale, dataCapCohort, probingError string, clientIP net.IP, deviceID, originHost, arch, authTokenLabel string) {
 	// Track the cardinality of clients.
 	otelinstrument.DistinctClients1m.Add(deviceID)
 	otelinstrument.DistinctClients10m.Add(deviceID)
@@ -243,6 +357,7 @@ func (ins *defaultInstrument) ProxiedBytes(ctx context.Context, sent, recv int,
 		{"country", attribute.StringValue(country)},
 		{"client_isp", attribute.StringValue(isp)},
 		{"client_asn", attribute.StringValue(asn)},
+		{common.AuthTokenLabel, attribute.StringValue(authTokenLabel)},
 	}
 
 	otelinstrument.ProxyIO.Add(
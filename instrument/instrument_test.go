@@ -3,6 +3,7 @@ package instrument
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -28,6 +29,36 @@ func TestOriginRoot(t *testing.T) {
 	requireSuccess("AS62041", ipWithASN) // Telegram IP addresses don't resolve, but we can get their ASN
 }
 
+func TestReportedFingerprints(t *testing.T) {
+	f := newReportedFingerprints(2, 2, 3, time.Hour)
+	requireReported := func(expected, ja3 string) {
+		actualJA3, actualJA4 := f.report(ja3, ja3+"_ja4")
+		if expected == otherFingerprint {
+			require.Equal(t, otherFingerprint, actualJA3, ja3)
+			require.Equal(t, otherFingerprint, actualJA4, ja3)
+		} else {
+			require.Equal(t, expected, actualJA3, ja3)
+			require.Equal(t, expected+"_ja4", actualJA4, ja3)
+		}
+	}
+
+	requireReported(otherFingerprint, "a")
+	requireReported(otherFingerprint, "a")
+	requireReported(otherFingerprint, "b")
+	requireReported(otherFingerprint, "c") // too many candidates to count c
+	requireReported("a", "a")
+	requireReported("a", "a")
+	requireReported(otherFingerprint, "c")
+	requireReported(otherFingerprint, "c")
+	requireReported("c", "c")
+	requireReported(otherFingerprint, "b") // too many reported fingerprints
+	requireReported("a", "a")
+
+	f = newReportedFingerprints(2, 2, 2, 0)
+	requireReported(otherFingerprint, "a")
+	requireReported(otherFingerprint, "a") // candidates are forgotten after the window
+}
+
 type mockISPLookup struct {
 	ASNS map[string]string
 }
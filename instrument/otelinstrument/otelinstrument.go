@@ -7,8 +7,10 @@ package otelinstrument
 
 import (
 	"context"
+	"math"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.opentelemetry.io/otel"
@@ -26,11 +28,24 @@ var (
 	ProxyIO                                                  metric.Int64Counter
 	QuicPackets                                              metric.Int64Counter
 	Mimicked                                                 metric.Int64Counter
+	AuthTokens                                               metric.Int64Counter
 	MultipathFrames                                          metric.Int64Counter
 	MultipathIO                                              metric.Int64Counter
 	XBQ                                                      metric.Int64Counter
 	Throttling                                               metric.Int64Counter
 	SuspectedProbing                                         metric.Int64Counter
+	ClientHelloFingerprints                                  metric.Int64Counter
+	ListenerPauses                                           metric.Int64Counter
+	ListenerPausedDuration                                   metric.Float64Histogram
+	IPLimited                                                metric.Int64Counter
+	IPFiltered                                               metric.Int64Counter
+	DeviceLimitersEvicted                                    metric.Int64Counter
+	TrackedDeviceLimiters                                    int64 // accessed atomically
+	trackedDeviceLimiters                                    metric.Int64ObservableGauge
+	UsageCacheEntries                                        int64  // accessed atomically
+	UsageCacheHitRatio                                       uint64 // bits of a float64, accessed atomically
+	usageCacheEntries                                        metric.Int64ObservableGauge
+	usageCacheHitRatio                                       metric.Float64ObservableGauge
 	DistinctClients1m, DistinctClients10m, DistinctClients1h *distinct.SlidingWindowDistinctCount
 	distinctClients                                          metric.Int64ObservableGauge
 )
@@ -57,6 +72,9 @@ func initialize() error {
 	if Mimicked, err = meter.Int64Counter("proxy.apache.mimicked"); err != nil {
 		return err
 	}
+	if AuthTokens, err = meter.Int64Counter("proxy.auth.tokens"); err != nil {
+		return err
+	}
 	if MultipathFrames, err = meter.Int64Counter("proxy.multipath.frames"); err != nil {
 		return err
 	}
@@ -75,6 +93,48 @@ func initialize() error {
 	if SuspectedProbing, err = meter.Int64Counter("proxy.probing.suspected"); err != nil {
 		return err
 	}
+	if ClientHelloFingerprints, err = meter.Int64Counter("proxy.clienthello.fingerprints"); err != nil {
+		return err
+	}
+	if ListenerPauses, err = meter.Int64Counter("proxy.listener.pauses"); err != nil {
+		return err
+	}
+	if ListenerPausedDuration, err = meter.Float64Histogram("proxy.listener.paused.duration", metric.WithUnit("s")); err != nil {
+		return err
+	}
+	if IPLimited, err = meter.Int64Counter("proxy.clients.iplimited"); err != nil {
+		return err
+	}
+	if IPFiltered, err = meter.Int64Counter("proxy.clients.ipfiltered"); err != nil {
+		return err
+	}
+	if DeviceLimitersEvicted, err = meter.Int64Counter("proxy.devices.limiters.evicted"); err != nil {
+		return err
+	}
+	if trackedDeviceLimiters, err = meter.Int64ObservableGauge(
+		"proxy.devices.limiters",
+		metric.WithInt64Callback(func(ctx context.Context, io metric.Int64Observer) error {
+			io.Observe(atomic.LoadInt64(&TrackedDeviceLimiters))
+			return nil
+		})); err != nil {
+		return err
+	}
+	if usageCacheEntries, err = meter.Int64ObservableGauge(
+		"proxy.usage.entries",
+		metric.WithInt64Callback(func(ctx context.Context, io metric.Int64Observer) error {
+			io.Observe(atomic.LoadInt64(&UsageCacheEntries))
+			return nil
+		})); err != nil {
+		return err
+	}
+	if usageCacheHitRatio, err = meter.Float64ObservableGauge(
+		"proxy.usage.hitratio",
+		metric.WithFloat64Callback(func(ctx context.Context, io metric.Float64Observer) error {
+			io.Observe(math.Float64frombits(atomic.LoadUint64(&UsageCacheHitRatio)))
+			return nil
+		})); err != nil {
+		return err
+	}
 
 	DistinctClients1m = distinct.NewSlidingWindowDistinctCount(time.Minute, time.Second)
 	DistinctClients10m = distinct.NewSlidingWindowDistinctCount(10*time.Minute, 10*time.Second)
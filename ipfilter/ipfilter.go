@@ -0,0 +1,126 @@
+// Package ipfilter decides which clients may connect to the proxy based on the
+// network, ASN and country of their IP address.
+package ipfilter
+
+import (
+	"net"
+	"strings"
+
+	"github.com/getlantern/geo"
+)
+
+const (
+	// ReasonNotAllowed means that the IP isn't in any of the allowed networks.
+	ReasonNotAllowed = "not_allowed"
+
+	// ReasonDeniedNetwork means that the IP is in one of the denied networks.
+	ReasonDeniedNetwork = "denied_network"
+
+	// ReasonDeniedASN means that the IP belongs to one of the denied ASNs.
+	ReasonDeniedASN = "denied_asn"
+
+	// ReasonDeniedCountry means that the IP is located in one of the denied
+	// countries.
+	ReasonDeniedCountry = "denied_country"
+)
+
+// Options configures a Filter.
+type Options struct {
+	// If not empty, only IPs in these networks are allowed.
+	Allow []*net.IPNet
+
+	// IPs in these networks are denied, even if they're also allowed.
+	Deny []*net.IPNet
+
+	// IPs belonging to these autonomous systems are denied, for example
+	// "AS12345" or "12345". Requires ISPLookup.
+	DenyASNs []string
+
+	// IPs located in these countries (ISO 3166-1 alpha-2 codes) are denied.
+	// Requires CountryLookup.
+	DenyCountries []string
+
+	CountryLookup geo.CountryLookup
+	ISPLookup     geo.ISPLookup
+}
+
+// Filter checks client IPs against allow and deny rules.
+type Filter struct {
+	allow         []*net.IPNet
+	deny          []*net.IPNet
+	denyASNs      map[string]bool
+	denyCountries map[string]bool
+	countryLookup geo.CountryLookup
+	ispLookup     geo.ISPLookup
+}
+
+// New creates a new Filter. If no rules are configured, it returns nil, which
+// allows everyone.
+func New(opts Options) *Filter {
+	if len(opts.Allow) == 0 && len(opts.Deny) == 0 && len(opts.DenyASNs) == 0 && len(opts.DenyCountries) == 0 {
+		return nil
+	}
+	f := &Filter{
+		allow:         opts.Allow,
+		deny:          opts.Deny,
+		denyASNs:      make(map[string]bool, len(opts.DenyASNs)),
+		denyCountries: make(map[string]bool, len(opts.DenyCountries)),
+		countryLookup: opts.CountryLookup,
+		ispLookup:     opts.ISPLookup,
+	}
+	if f.countryLookup == nil {
+		f.countryLookup = geo.NoLookup{}
+	}
+	if f.ispLookup == nil {
+		f.ispLookup = geo.NoLookup{}
+	}
+	for _, asn := range opts.DenyASNs {
+		if asn = normalizeASN(asn); asn != "" {
+			f.denyASNs[asn] = true
+		}
+	}
+	for _, country := range opts.DenyCountries {
+		if country = strings.ToUpper(strings.TrimSpace(country)); country != "" {
+			f.denyCountries[country] = true
+		}
+	}
+	return f
+}
+
+// Check returns the reason for which the given IP is denied, or an empty
+// string if it's allowed. Loopback addresses are always allowed. A nil Filter
+// allows everyone.
+func (f *Filter) Check(ip net.IP) string {
+	if f == nil || ip == nil || ip.IsLoopback() {
+		return ""
+	}
+	if containsIP(f.deny, ip) {
+		return ReasonDeniedNetwork
+	}
+	if len(f.allow) > 0 && !containsIP(f.allow, ip) {
+		return ReasonNotAllowed
+	}
+	if len(f.denyASNs) > 0 && f.denyASNs[normalizeASN(f.ispLookup.ASN(ip))] {
+		return ReasonDeniedASN
+	}
+	if len(f.denyCountries) > 0 && f.denyCountries[strings.ToUpper(f.countryLookup.CountryCode(ip))] {
+		return ReasonDeniedCountry
+	}
+	return ""
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeASN strips the optional "AS" prefix so that "AS12345" and "12345"
+// are treated the same.
+func normalizeASN(asn string) string {
+	asn = strings.ToUpper(strings.TrimSpace(asn))
+	return strings.TrimPrefix(asn, "AS")
+}
@@ -0,0 +1,74 @@
+package ipfilter
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeLookup struct {
+	countries map[string]string
+	asns      map[string]string
+}
+
+func (l *fakeLookup) CountryCode(ip net.IP) string {
+	return l.countries[ip.String()]
+}
+
+func (l *fakeLookup) ISP(ip net.IP) string {
+	return ""
+}
+
+func (l *fakeLookup) ASN(ip net.IP) string {
+	return l.asns[ip.String()]
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var result []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		result = append(result, network)
+	}
+	return result
+}
+
+func TestNoRules(t *testing.T) {
+	f := New(Options{})
+	assert.Nil(t, f)
+	assert.Empty(t, f.Check(net.ParseIP("1.2.3.4")), "nil filter should allow everyone")
+}
+
+func TestCheck(t *testing.T) {
+	lookup := &fakeLookup{
+		countries: map[string]string{"10.0.0.3": "IR", "10.0.0.4": "US"},
+		asns:      map[string]string{"10.0.0.5": "64500"},
+	}
+	f := New(Options{
+		Allow:         mustParseCIDRs("10.0.0.0/8", "2001:db8::/32"),
+		Deny:          mustParseCIDRs("10.1.0.0/16"),
+		DenyASNs:      []string{"AS64500"},
+		DenyCountries: []string{"ir"},
+		CountryLookup: lookup,
+		ISPLookup:     lookup,
+	})
+
+	assert.Empty(t, f.Check(net.ParseIP("10.0.0.1")))
+	assert.Empty(t, f.Check(net.ParseIP("2001:db8::1")))
+	assert.Empty(t, f.Check(net.ParseIP("10.0.0.4")))
+	assert.Empty(t, f.Check(net.ParseIP("127.0.0.1")), "loopback should always be allowed")
+	assert.Equal(t, ReasonNotAllowed, f.Check(net.ParseIP("1.2.3.4")))
+	assert.Equal(t, ReasonNotAllowed, f.Check(net.ParseIP("2001:db9::1")))
+	assert.Equal(t, ReasonDeniedNetwork, f.Check(net.ParseIP("10.1.2.3")), "deny should take precedence over allow")
+	assert.Equal(t, ReasonDeniedCountry, f.Check(net.ParseIP("10.0.0.3")))
+	assert.Equal(t, ReasonDeniedASN, f.Check(net.ParseIP("10.0.0.5")))
+}
+
+func TestDenyOnly(t *testing.T) {
+	f := New(Options{Deny: mustParseCIDRs("192.0.2.0/24")})
+	assert.Empty(t, f.Check(net.ParseIP("1.2.3.4")), "without an allow list, everything not denied should be allowed")
+	assert.Equal(t, ReasonDeniedNetwork, f.Check(net.ParseIP("192.0.2.10")))
+}
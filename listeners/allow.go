@@ -10,34 +10,41 @@ type allowingListener struct {
 	allow   func(string) bool
 }
 
+// NewAllowingListener wraps the given listener so that connections from IPs
+// for which allow returns false are closed as soon as they're accepted. To
+// keep rejected clients from getting to a protocol's handshake, it has to wrap
+// the base listener that the protocol listener wraps.
 func NewAllowingListener(l net.Listener, allow func(string) bool) net.Listener {
 	return &allowingListener{l, allow}
 }
 
 func (l *allowingListener) Accept() (net.Conn, error) {
-	conn, err := l.wrapped.Accept()
-	if err != nil {
-		return conn, err
-	}
+	for {
+		conn, err := l.wrapped.Accept()
+		if err != nil {
+			return conn, err
+		}
+
+		ip := ""
+		remoteAddr := conn.RemoteAddr()
+		switch addr := remoteAddr.(type) {
+		case *net.TCPAddr:
+			ip = addr.IP.String()
+		case *net.UDPAddr:
+			ip = addr.IP.String()
+		default:
+			log.Errorf("Remote addr %v is of unknown type %v, unable to determine IP", remoteAddr, reflect.TypeOf(remoteAddr))
+			return conn, err
+		}
+		if !l.allow(ip) {
+			// Note - we don't return an error, because that causes http.Server to
+			// stop serving. Instead, we wait for the next connection.
+			conn.Close()
+			continue
+		}
 
-	ip := ""
-	remoteAddr := conn.RemoteAddr()
-	switch addr := remoteAddr.(type) {
-	case *net.TCPAddr:
-		ip = addr.IP.String()
-	case *net.UDPAddr:
-		ip = addr.IP.String()
-	default:
-		log.Errorf("Remote addr %v is of unknown type %v, unable to determine IP", remoteAddr, reflect.TypeOf(remoteAddr))
 		return conn, err
 	}
-	if !l.allow(ip) {
-		conn.Close()
-		// Note - we don't return an error, because that causes http.Server to stop
-		// serving.
-	}
-
-	return conn, err
 }
 
 func (l *allowingListener) Close() error {
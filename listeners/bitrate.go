@@ -3,6 +3,7 @@ package listeners
 import (
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/getlantern/ratelimit"
@@ -12,11 +13,14 @@ const (
 	minSleep = 5 * time.Millisecond // don't bother sleeping for less than this amount of time
 )
 
+// RateLimiter limits the rate at which connections that share it can read and
+// write. Its rates can be changed while in use with SetRates.
 type RateLimiter struct {
 	r         *ratelimit.Bucket
 	w         *ratelimit.Bucket
 	rateRead  int64
 	rateWrite int64
+	mx        sync.RWMutex
 }
 
 func NewRateLimiter(rateRead, rateWrite int64) *RateLimiter {
@@ -24,32 +28,78 @@ func NewRateLimiter(rateRead, rateWrite int64) *RateLimiter {
 		rateRead:  rateRead,
 		rateWrite: rateWrite,
 	}
-	if rateRead > 0 {
-		l.r = ratelimit.NewBucketWithRate(float64(rateRead), rateRead)
+	l.r = newBucket(rateRead, nil)
+	l.w = newBucket(rateWrite, nil)
+	return l
+}
+
+// newBucket creates a bucket for the given rate, or nil if the rate is
+// unlimited. If previous is not nil, the new bucket starts out as full (or as
+// far in debt) as previous is now, so that changing the rate neither grants a
+// fresh burst nor forgives what was already taken.
+func newBucket(rate int64, previous *ratelimit.Bucket) *ratelimit.Bucket {
+	if rate <= 0 {
+		return nil
 	}
-	if rateWrite > 0 {
-		l.w = ratelimit.NewBucketWithRate(float64(rateWrite), rateWrite)
+	b := ratelimit.NewBucketWithRate(float64(rate), rate)
+	if previous != nil {
+		available := previous.Available()
+		if available > rate {
+			available = rate
+		}
+		b.Take(rate - available)
 	}
-	return l
+	return b
 }
 
 func (l *RateLimiter) GetRateRead() int64 {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
 	return l.rateRead
 }
 
 func (l *RateLimiter) GetRateWrite() int64 {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
 	return l.rateWrite
 }
 
+// SetRates changes the rates of this limiter in place, affecting all
+// connections that currently use it.
+func (l *RateLimiter) SetRates(rateRead, rateWrite int64) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if rateRead != l.rateRead {
+		l.r = newBucket(rateRead, l.r)
+		l.rateRead = rateRead
+	}
+	if rateWrite != l.rateWrite {
+		l.w = newBucket(rateWrite, l.w)
+		l.rateWrite = rateWrite
+	}
+}
+
 func (l *RateLimiter) waitRead(n int) {
-	d := l.wait(l.r, n)
+	l.mx.RLock()
+	b := l.r
+	l.mx.RUnlock()
+	if b == nil {
+		return
+	}
+	d := l.wait(b, n)
 	if d > 0 {
 		sleep(d)
 	}
 }
 
 func (l *RateLimiter) waitWrite(n int) {
-	d := l.wait(l.w, n)
+	l.mx.RLock()
+	b := l.w
+	l.mx.RUnlock()
+	if b == nil {
+		return
+	}
+	d := l.wait(b, n)
 	if d > 0 {
 		sleep(d)
 	}
@@ -98,7 +148,7 @@ type bitrateConn struct {
 }
 
 func (c *bitrateConn) Read(p []byte) (n int, err error) {
-	if c.limiter.rateRead == 0 {
+	if c.limiter.GetRateRead() == 0 {
 		return c.Conn.Read(p)
 	}
 
@@ -110,7 +160,7 @@ func (c *bitrateConn) Read(p []byte) (n int, err error) {
 }
 
 func (c *bitrateConn) Write(p []byte) (n int, err error) {
-	if c.limiter.rateWrite == 0 {
+	if c.limiter.GetRateWrite() == 0 {
 		return c.Conn.Write(p)
 	}
 
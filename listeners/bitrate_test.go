@@ -186,3 +186,20 @@ func BenchmarkThrottledReader(b *testing.B) {
 		conn.Write(benchBuf)
 	}
 }
+
+func TestSetRates(t *testing.T) {
+	l := NewRateLimiter(100, 100)
+	l.w.Take(100)
+	l.SetRates(100, 1000)
+	assert.EqualValues(t, 100, l.GetRateRead())
+	assert.EqualValues(t, 1000, l.GetRateWrite())
+	assert.EqualValues(t, 100, l.r.Available(), "unchanged read bucket shouldn't be touched")
+	assert.True(t, l.w.Available() < 100, "raising the rate shouldn't refill the write bucket")
+
+	l.SetRates(0, 1000)
+	assert.Nil(t, l.r, "zero rate should be unlimited")
+	l.waitRead(1000)
+
+	l.SetRates(50, 1000)
+	assert.EqualValues(t, 50, l.r.Available(), "bucket should start full when previously unlimited")
+}
@@ -0,0 +1,66 @@
+package listeners
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+type countingListener struct {
+	net.Listener
+	count *int64
+}
+
+// NewCountingListener wraps the given listener to keep track of the number of
+// open connections accepted from it in count.
+func NewCountingListener(l net.Listener, count *int64) net.Listener {
+	return &countingListener{Listener: l, count: count}
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(l.count, 1)
+	sac, _ := c.(WrapConnEmbeddable)
+	return &countingConn{
+		WrapConnEmbeddable: sac,
+		Conn:               c,
+		count:              l.count,
+	}, nil
+}
+
+type countingConn struct {
+	WrapConnEmbeddable
+	net.Conn
+	count  *int64
+	closed uint32
+}
+
+func (c *countingConn) Close() error {
+	if atomic.SwapUint32(&c.closed, 1) == 1 {
+		return errors.New("network connection already closed")
+	}
+	atomic.AddInt64(c.count, -1)
+	return c.Conn.Close()
+}
+
+func (c *countingConn) OnState(s http.ConnState) {
+	// Pass down to wrapped connections
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+func (c *countingConn) ControlMessage(msgType string, data interface{}) {
+	// Simply pass down the control message to the wrapped connection
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+func (c *countingConn) Wrapped() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,265 @@
+package listeners
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/getlantern/ratelimit"
+)
+
+const (
+	// IPLimitRate is the reason given to OnReject when a client connects too
+	// frequently.
+	IPLimitRate = "rate"
+
+	// IPLimitConcurrent is the reason given to OnReject when a client has too
+	// many open connections.
+	IPLimitConcurrent = "concurrent"
+
+	ipLimitCleanupInterval = time.Minute
+)
+
+// IPLimiterOptions configures an IPLimiter.
+type IPLimiterOptions struct {
+	// Rate is the sustained number of new connections per second allowed from a
+	// single client. 0 means unlimited.
+	Rate float64
+
+	// Burst is the number of connections a client can open in quick succession
+	// before being limited to Rate. Defaults to 1 if Rate is set.
+	Burst int64
+
+	// MaxConns is the maximum number of concurrent connections from a single
+	// client. 0 means unlimited.
+	MaxConns int64
+
+	// IPv4PrefixLen and IPv6PrefixLen determine which addresses count as the
+	// same client. They default to 32 (single address) and 64.
+	IPv4PrefixLen int
+	IPv6PrefixLen int
+
+	// Exempt lists networks that are never limited. Loopback addresses are
+	// always exempt.
+	Exempt []*net.IPNet
+}
+
+// IPLimiter tracks the connection rate and the number of open connections per
+// client. One IPLimiter can be shared by listeners for several protocols to
+// limit clients across all of them.
+type IPLimiter struct {
+	opts      IPLimiterOptions
+	ipv4Mask  net.IPMask
+	ipv6Mask  net.IPMask
+	refillAll time.Duration
+	clients   map[string]*ipLimitClient
+	mx        sync.Mutex
+}
+
+type ipLimitClient struct {
+	bucket   *ratelimit.Bucket
+	conns    int64
+	lastSeen time.Time
+}
+
+// NewIPLimiter creates a new IPLimiter, which forgets idle clients until the
+// given context is done. If neither Rate nor MaxConns are set, it returns nil,
+// which doesn't limit anything.
+func NewIPLimiter(ctx context.Context, opts IPLimiterOptions) *IPLimiter {
+	if opts.Rate <= 0 && opts.MaxConns <= 0 {
+		return nil
+	}
+	if opts.Rate > 0 && opts.Burst <= 0 {
+		opts.Burst = 1
+	}
+	if opts.IPv4PrefixLen <= 0 || opts.IPv4PrefixLen > 32 {
+		opts.IPv4PrefixLen = 32
+	}
+	if opts.IPv6PrefixLen <= 0 || opts.IPv6PrefixLen > 128 {
+		opts.IPv6PrefixLen = 64
+	}
+	il := &IPLimiter{
+		opts:     opts,
+		ipv4Mask: net.CIDRMask(opts.IPv4PrefixLen, 32),
+		ipv6Mask: net.CIDRMask(opts.IPv6PrefixLen, 128),
+		clients:  make(map[string]*ipLimitClient),
+	}
+	if opts.Rate > 0 {
+		il.refillAll = time.Duration(float64(opts.Burst) / opts.Rate * float64(time.Second))
+	}
+	go il.cleanup(ctx, ipLimitCleanupInterval)
+	return il
+}
+
+// clientKey identifies the client to which the given IP belongs, returning
+// false if the IP is exempt from limiting.
+func (il *IPLimiter) clientKey(ip net.IP) (string, bool) {
+	if ip == nil || ip.IsLoopback() {
+		return "", false
+	}
+	for _, exempt := range il.opts.Exempt {
+		if exempt.Contains(ip) {
+			return "", false
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(il.ipv4Mask).String(), true
+	}
+	return ip.Mask(il.ipv6Mask).String(), true
+}
+
+// acquire records a new connection from the given IP, returning the key under
+// which it was recorded (empty if exempt) or the reason for rejecting it.
+func (il *IPLimiter) acquire(ip net.IP) (key string, rejectReason string) {
+	key, limited := il.clientKey(ip)
+	if !limited {
+		return "", ""
+	}
+
+	il.mx.Lock()
+	defer il.mx.Unlock()
+	client := il.clients[key]
+	if client == nil {
+		client = &ipLimitClient{}
+		if il.opts.Rate > 0 {
+			client.bucket = ratelimit.NewBucketWithRate(il.opts.Rate, il.opts.Burst)
+		}
+		il.clients[key] = client
+	}
+	client.lastSeen = time.Now()
+	if il.opts.MaxConns > 0 && client.conns >= il.opts.MaxConns {
+		return "", IPLimitConcurrent
+	}
+	if client.bucket != nil && client.bucket.TakeAvailable(1) == 0 {
+		return "", IPLimitRate
+	}
+	client.conns++
+	return key, ""
+}
+
+func (il *IPLimiter) release(key string) {
+	il.mx.Lock()
+	defer il.mx.Unlock()
+	if client := il.clients[key]; client != nil {
+		client.conns--
+		client.lastSeen = time.Now()
+	}
+}
+
+// cleanup periodically forgets clients that have no open connections and whose
+// buckets have refilled, so that they'd be treated the same as new clients.
+func (il *IPLimiter) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			il.removeIdle()
+		}
+	}
+}
+
+func (il *IPLimiter) removeIdle() {
+	idleSince := time.Now().Add(-il.refillAll)
+	il.mx.Lock()
+	defer il.mx.Unlock()
+	for key, client := range il.clients {
+		if client.conns <= 0 && client.lastSeen.Before(idleSince) {
+			delete(il.clients, key)
+		}
+	}
+}
+
+type ipLimitingListener struct {
+	net.Listener
+	limiter  *IPLimiter
+	onReject func(ip net.IP, reason string)
+}
+
+// NewIPLimitingListener wraps the given listener so that connections from
+// clients exceeding the limits of the given IPLimiter are closed right away.
+// onReject, if given, is called for every rejected connection.
+func NewIPLimitingListener(l net.Listener, limiter *IPLimiter, onReject func(ip net.IP, reason string)) net.Listener {
+	if limiter == nil {
+		return l
+	}
+	return &ipLimitingListener{Listener: l, limiter: limiter, onReject: onReject}
+}
+
+func (l *ipLimitingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return conn, err
+		}
+
+		var ip net.IP
+		switch addr := conn.RemoteAddr().(type) {
+		case *net.TCPAddr:
+			ip = addr.IP
+		case *net.UDPAddr:
+			ip = addr.IP
+		}
+		key, rejectReason := l.limiter.acquire(ip)
+		if rejectReason != "" {
+			log.Tracef("Rejecting connection from %v: %v limit exceeded", ip, rejectReason)
+			conn.Close()
+			if l.onReject != nil {
+				l.onReject(ip, rejectReason)
+			}
+			continue
+		}
+		if key == "" {
+			// exempt
+			return conn, nil
+		}
+
+		sac, _ := conn.(WrapConnEmbeddable)
+		return &ipLimitedConn{
+			WrapConnEmbeddable: sac,
+			Conn:               conn,
+			limiter:            l.limiter,
+			key:                key,
+		}, nil
+	}
+}
+
+type ipLimitedConn struct {
+	WrapConnEmbeddable
+	net.Conn
+	limiter *IPLimiter
+	key     string
+	closed  uint32
+}
+
+func (c *ipLimitedConn) Close() error {
+	if atomic.SwapUint32(&c.closed, 1) == 1 {
+		return errors.New("network connection already closed")
+	}
+	c.limiter.release(c.key)
+	return c.Conn.Close()
+}
+
+func (c *ipLimitedConn) OnState(s http.ConnState) {
+	// Pass down to wrapped connections
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.OnState(s)
+	}
+}
+
+func (c *ipLimitedConn) ControlMessage(msgType string, data interface{}) {
+	// Simply pass down the control message to the wrapped connection
+	if c.WrapConnEmbeddable != nil {
+		c.WrapConnEmbeddable.ControlMessage(msgType, data)
+	}
+}
+
+func (c *ipLimitedConn) Wrapped() net.Conn {
+	return c.Conn
+}
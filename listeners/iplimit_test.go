@@ -0,0 +1,154 @@
+package listeners
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPLimiterConcurrent(t *testing.T) {
+	_, exempt, _ := net.ParseCIDR("10.0.0.0/8")
+	il := NewIPLimiter(context.Background(), IPLimiterOptions{
+		MaxConns:      2,
+		IPv6PrefixLen: 48,
+		Exempt:        []*net.IPNet{exempt},
+	})
+
+	key1, reason := il.acquire(net.ParseIP("1.2.3.4"))
+	assert.Empty(t, reason)
+	key2, reason := il.acquire(net.ParseIP("1.2.3.4"))
+	assert.Empty(t, reason)
+	_, reason = il.acquire(net.ParseIP("1.2.3.4"))
+	assert.Equal(t, IPLimitConcurrent, reason)
+	_, reason = il.acquire(net.ParseIP("1.2.3.5"))
+	assert.Empty(t, reason, "other IPs shouldn't be affected")
+
+	il.release(key1)
+	_, reason = il.acquire(net.ParseIP("1.2.3.4"))
+	assert.Empty(t, reason, "closing a connection should make room for another")
+	il.release(key2)
+
+	il.acquire(net.ParseIP("2001:db8:1:1::1"))
+	il.acquire(net.ParseIP("2001:db8:1:2::1"))
+	_, reason = il.acquire(net.ParseIP("2001:db8:1:3::1"))
+	assert.Equal(t, IPLimitConcurrent, reason, "IPv6 addresses in the same prefix should count as one client")
+
+	for i := 0; i < 5; i++ {
+		key, reason := il.acquire(net.ParseIP("10.1.2.3"))
+		assert.Empty(t, key)
+		assert.Empty(t, reason, "exempt network shouldn't be limited")
+		key, reason = il.acquire(net.ParseIP("127.0.0.1"))
+		assert.Empty(t, key)
+		assert.Empty(t, reason, "loopback shouldn't be limited")
+	}
+}
+
+func TestIPLimiterRate(t *testing.T) {
+	il := NewIPLimiter(context.Background(), IPLimiterOptions{
+		Rate:  0.001,
+		Burst: 3,
+	})
+	ip := net.ParseIP("1.2.3.4")
+	for i := 0; i < 3; i++ {
+		key, reason := il.acquire(ip)
+		assert.Empty(t, reason, "burst should be allowed")
+		il.release(key)
+	}
+	_, reason := il.acquire(ip)
+	assert.Equal(t, IPLimitRate, reason)
+}
+
+func TestIPLimiterCleanup(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	il := NewIPLimiter(ctx, IPLimiterOptions{MaxConns: 1})
+	key, _ := il.acquire(net.ParseIP("1.2.3.4"))
+	il.acquire(net.ParseIP("1.2.3.5"))
+	il.release(key)
+
+	stopped := make(chan struct{})
+	go func() {
+		il.cleanup(ctx, 10*time.Millisecond)
+		close(stopped)
+	}()
+	require.Eventually(t, func() bool {
+		il.mx.Lock()
+		defer il.mx.Unlock()
+		return len(il.clients) == 1
+	}, time.Second, 10*time.Millisecond, "idle clients should be forgotten")
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("cleanup should stop when the context is done")
+	}
+}
+
+func TestNoIPLimiter(t *testing.T) {
+	assert.Nil(t, NewIPLimiter(context.Background(), IPLimiterOptions{}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	assert.Equal(t, ln, NewIPLimitingListener(ln, nil, nil))
+}
+
+type remoteAddrConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *remoteAddrConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+type fakeListener struct {
+	net.Listener
+	conns chan net.Conn
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func TestIPLimitingListener(t *testing.T) {
+	fl := &fakeListener{conns: make(chan net.Conn, 10)}
+	remote := &net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1234}
+	var pipes []net.Conn
+	for i := 0; i < 3; i++ {
+		client, server := net.Pipe()
+		pipes = append(pipes, client)
+		fl.conns <- &remoteAddrConn{Conn: server, remoteAddr: remote}
+	}
+	close(fl.conns)
+	defer func() {
+		for _, pipe := range pipes {
+			pipe.Close()
+		}
+	}()
+
+	var rejections []string
+	l := NewIPLimitingListener(fl, NewIPLimiter(context.Background(), IPLimiterOptions{MaxConns: 1}), func(ip net.IP, reason string) {
+		assert.Equal(t, "1.2.3.4", ip.String())
+		rejections = append(rejections, reason)
+	})
+
+	conn, err := l.Accept()
+	require.NoError(t, err)
+	_, err = l.Accept()
+	assert.ErrorIs(t, err, net.ErrClosed, "connections over the limit should be skipped")
+	assert.Equal(t, []string{IPLimitConcurrent, IPLimitConcurrent}, rejections)
+
+	_, err = pipes[1].Read(make([]byte, 1))
+	assert.Error(t, err, "rejected connection should be closed")
+
+	require.NoError(t, conn.Close())
+	assert.Error(t, conn.Close(), "closing twice should fail")
+}
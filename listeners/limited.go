@@ -2,93 +2,208 @@ package listeners
 
 import (
 	"errors"
-	"math"
 	"net"
 	"net/http"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ConnLimit caps the number of concurrent connections. A ConnLimit can be
+// shared by several limited listeners to cap their combined connections.
+type ConnLimit struct {
+	maxConns uint64
+	numConns uint64
+	// freed is closed and replaced whenever a connection is released
+	freed chan struct{}
+	mx    sync.Mutex
+}
+
+// NewConnLimit creates a ConnLimit allowing up to maxConns concurrent
+// connections. If maxConns is 0, this returns nil, which doesn't limit
+// anything.
+func NewConnLimit(maxConns uint64) *ConnLimit {
+	if maxConns == 0 {
+		return nil
+	}
+	return &ConnLimit{
+		maxConns: maxConns,
+		freed:    make(chan struct{}),
+	}
+}
+
+// NumConns returns the number of connections currently counted against this
+// limit.
+func (cl *ConnLimit) NumConns() int {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	return int(cl.numConns)
+}
+
+// full returns whether the limit is reached, along with a channel that's
+// closed once a connection is released.
+func (cl *ConnLimit) full() (bool, <-chan struct{}) {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	return cl.numConns >= cl.maxConns, cl.freed
+}
+
+func (cl *ConnLimit) tryAcquire() bool {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	if cl.numConns >= cl.maxConns {
+		return false
+	}
+	cl.numConns++
+	return true
+}
+
+func (cl *ConnLimit) release() {
+	cl.mx.Lock()
+	defer cl.mx.Unlock()
+	cl.numConns--
+	close(cl.freed)
+	cl.freed = make(chan struct{})
+}
+
 type limitedListener struct {
 	net.Listener
 
-	maxConns    uint64
-	numConns    uint64
-	idleTimeout time.Duration
+	limits  []*ConnLimit
+	onPause func(pausedFor time.Duration)
 
-	stopped int32
-	stop    chan bool
-	restart chan bool
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
+// NewLimitedListener wraps the given listener so that it accepts at most
+// maxConns concurrent connections. If maxConns is 0, connections are
+// unlimited.
 func NewLimitedListener(l net.Listener, maxConns uint64) net.Listener {
-	if maxConns <= 0 {
-		maxConns = math.MaxUint64
-	}
+	return NewSharedLimitedListener(l, nil, NewConnLimit(maxConns))
+}
 
-	return &limitedListener{
-		Listener:    l,
-		stopped:     0,
-		stop:        make(chan bool, 1),
-		restart:     make(chan bool),
-		maxConns:    maxConns,
-		idleTimeout: 30 * time.Second,
+// NewSharedLimitedListener wraps the given listener so that it stops accepting
+// new connections while any of the given limits is reached and resumes once
+// enough connections have been closed. Nil limits are ignored. If onPause is
+// given, it's called every time Accept resumes after having been paused, with
+// the duration of the pause.
+//
+// Connections only count against the limits once they've been accepted, so an
+// idle listener doesn't take up any room in limits shared with other
+// listeners. If another listener used up the room while this one was
+// accepting, the accepted connection is closed.
+func NewSharedLimitedListener(l net.Listener, onPause func(pausedFor time.Duration), limits ...*ConnLimit) net.Listener {
+	sl := &limitedListener{
+		Listener: l,
+		onPause:  onPause,
+		closed:   make(chan struct{}),
 	}
+	for _, limit := range limits {
+		if limit != nil {
+			sl.limits = append(sl.limits, limit)
+		}
+	}
+	return sl
 }
 
 func (sl *limitedListener) Accept() (net.Conn, error) {
-	select {
-	case <-sl.stop:
-		<-sl.restart
-	default:
-	}
+	for {
+		if err := sl.waitForRoom(); err != nil {
+			return nil, err
+		}
 
-	c, err := sl.Listener.Accept()
-	if err != nil {
-		return nil, err
-	}
+		c, err := sl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
 
-	atomic.AddUint64(&sl.numConns, 1)
+		acquired, ok := sl.acquire()
+		if !ok {
+			log.Debugf("Connection limit was reached while accepting at %v, closing connection from %v", sl.Addr(), c.RemoteAddr())
+			c.Close()
+			continue
+		}
 
-	if log.IsTraceEnabled() {
-		if sl.maxConns == math.MaxUint64 {
-			log.Tracef("Accepted a new connection, %v in total now, of unlimited connections", sl.numConns)
-		} else {
-			log.Tracef("Accepted a new connection, %v in total now, %v max allowed", sl.numConns, sl.maxConns)
+		if log.IsTraceEnabled() {
+			for _, limit := range acquired {
+				log.Tracef("Accepted a new connection, %v in total now, %v max allowed", limit.NumConns(), limit.maxConns)
+			}
 		}
-	}
 
-	sac, _ := c.(WrapConnEmbeddable)
-	return &limitedConn{
-		WrapConnEmbeddable: sac,
-		Conn:               c,
-		listener:           sl,
-	}, err
+		sac, _ := c.(WrapConnEmbeddable)
+		return &limitedConn{
+			WrapConnEmbeddable: sac,
+			Conn:               c,
+			limits:             acquired,
+		}, nil
+	}
 }
 
-func (sl *limitedListener) IsStopped() bool {
-	return atomic.LoadInt32(&sl.stopped) == 1
+// waitForRoom blocks while any of the limits is reached, without reserving
+// anything.
+func (sl *limitedListener) waitForRoom() error {
+	var pausedAt time.Time
+	for _, limit := range sl.limits {
+		for {
+			full, freed := limit.full()
+			if !full {
+				break
+			}
+			if pausedAt.IsZero() {
+				pausedAt = time.Now()
+				log.Debugf("Reached %v max allowed connections, stop accepting new connections at %v", limit.maxConns, sl.Addr())
+			}
+			select {
+			case <-freed:
+			case <-sl.closed:
+				return net.ErrClosed
+			}
+		}
+	}
+
+	if !pausedAt.IsZero() {
+		pausedFor := time.Since(pausedAt)
+		log.Debugf("Accepting new connections again at %v after %v", sl.Addr(), pausedFor)
+		if sl.onPause != nil {
+			sl.onPause(pausedFor)
+		}
+	}
+	return nil
 }
 
-func (sl *limitedListener) Stop() {
-	if !sl.IsStopped() {
-		sl.stop <- true
-		atomic.StoreInt32(&sl.stopped, 1)
+// acquire reserves room in every limit for an accepted connection. If any
+// limit is reached, nothing is reserved.
+func (sl *limitedListener) acquire() ([]*ConnLimit, bool) {
+	acquired := make([]*ConnLimit, 0, len(sl.limits))
+	for _, limit := range sl.limits {
+		if !limit.tryAcquire() {
+			releaseAll(acquired)
+			return nil, false
+		}
+		acquired = append(acquired, limit)
 	}
+	return acquired, true
 }
 
-func (sl *limitedListener) Restart() {
-	if sl.IsStopped() {
-		sl.restart <- true
-		atomic.StoreInt32(&sl.stopped, 0)
+func releaseAll(limits []*ConnLimit) {
+	for _, limit := range limits {
+		limit.release()
 	}
 }
 
+func (sl *limitedListener) Close() error {
+	sl.closeOnce.Do(func() {
+		close(sl.closed)
+	})
+	return sl.Listener.Close()
+}
+
 type limitedConn struct {
 	WrapConnEmbeddable
 	net.Conn
-	listener *limitedListener
-	closed   uint32
+	limits []*ConnLimit
+	closed uint32
 }
 
 func (c *limitedConn) Close() (err error) {
@@ -96,44 +211,16 @@ func (c *limitedConn) Close() (err error) {
 		return errors.New("network connection already closed")
 	}
 
-	// Substract 1 by adding the two-complement of -1
-	numConns := atomic.AddUint64(&c.listener.numConns, ^uint64(0))
-	log.Tracef("Closed a connection and left %v remaining", numConns)
-	return c.Conn.Close()
-}
-
-func (c *limitedConn) OnState(s http.ConnState) {
-	l := c.listener
+	releaseAll(c.limits)
 	if log.IsTraceEnabled() {
-		if l.maxConns == math.MaxUint64 {
-			log.Tracef("OnState(%s), numConns = %v, of unlimited connections", s, l.numConns)
-		} else {
-			log.Tracef("OnState(%s), numConns = %v, maxConns = %v", s, l.numConns, l.maxConns)
-		}
-	}
-
-	if s == http.StateNew {
-		if atomic.LoadUint64(&l.numConns) >= l.maxConns {
-			if log.IsTraceEnabled() {
-				if l.maxConns == math.MaxUint64 {
-					log.Tracef("numConns %v (unlimited connections), stop accepting new connections", l.numConns)
-				} else {
-					log.Tracef("numConns %v >= maxConns %v, stop accepting new connections", l.numConns, l.maxConns)
-				}
-			}
-			l.Stop()
-		} else if l.IsStopped() {
-			if log.IsTraceEnabled() {
-				if l.maxConns == math.MaxUint64 {
-					log.Tracef("numConns %v < maxConns (unlimited connections), accept new connections again", l.numConns)
-				} else {
-					log.Tracef("numConns %v < maxConns %v, accept new connections again", l.numConns, l.maxConns)
-				}
-			}
-			l.Restart()
+		for _, limit := range c.limits {
+			log.Tracef("Closed a connection and left %v remaining", limit.NumConns())
 		}
 	}
+	return c.Conn.Close()
+}
 
+func (c *limitedConn) OnState(s http.ConnState) {
 	// Pass down to wrapped connections
 	if c.WrapConnEmbeddable != nil {
 		c.WrapConnEmbeddable.OnState(s)
@@ -0,0 +1,164 @@
+package listeners
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func acceptAsync(l net.Listener) chan net.Conn {
+	result := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(result)
+			return
+		}
+		result <- conn
+	}()
+	return result
+}
+
+func dialN(t *testing.T, addr string, n int) {
+	for i := 0; i < n; i++ {
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+	}
+}
+
+func TestLimitedListenerPausesAndResumes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	var pauses int32
+	l := NewSharedLimitedListener(ln, func(pausedFor time.Duration) {
+		atomic.AddInt32(&pauses, 1)
+	}, NewConnLimit(2))
+	defer l.Close()
+
+	dialN(t, ln.Addr().String(), 3)
+
+	conn1 := <-acceptAsync(l)
+	conn2 := <-acceptAsync(l)
+	require.NotNil(t, conn1)
+	require.NotNil(t, conn2)
+
+	third := acceptAsync(l)
+	select {
+	case <-third:
+		t.Fatal("Accept should be paused once the limit is reached")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, conn1.Close())
+	select {
+	case conn3 := <-third:
+		require.NotNil(t, conn3)
+		conn3.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Accept should resume once a connection is closed")
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&pauses))
+	assert.Error(t, conn1.Close(), "closing twice should fail")
+	conn2.Close()
+}
+
+func TestSharedConnLimit(t *testing.T) {
+	ln1, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	global := NewConnLimit(2)
+	l1 := NewSharedLimitedListener(ln1, nil, NewConnLimit(1), global)
+	defer l1.Close()
+	l2 := NewSharedLimitedListener(ln2, nil, nil, global)
+
+	dialN(t, ln1.Addr().String(), 2)
+	dialN(t, ln2.Addr().String(), 2)
+
+	conn1 := <-acceptAsync(l1)
+	require.NotNil(t, conn1)
+	defer conn1.Close()
+	second1 := acceptAsync(l1)
+
+	conn2 := <-acceptAsync(l2)
+	require.NotNil(t, conn2)
+	defer conn2.Close()
+	assert.Equal(t, 2, global.NumConns())
+
+	second2 := acceptAsync(l2)
+	select {
+	case <-second1:
+		t.Fatal("Accept should be paused by per-listener limit")
+	case <-second2:
+		t.Fatal("Accept should be paused by global limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.NoError(t, l2.Close())
+	select {
+	case conn, ok := <-second2:
+		assert.False(t, ok, "closing the listener should unblock a paused Accept, got %v", conn)
+	case <-time.After(time.Second):
+		t.Fatal("Accept should return once the listener is closed")
+	}
+	assert.Equal(t, 2, global.NumConns(), "unblocked Accept shouldn't hold on to any slots")
+}
+
+func TestIdleListenerDoesntHoldSharedLimit(t *testing.T) {
+	ln1, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	global := NewConnLimit(1)
+	l1 := NewSharedLimitedListener(ln1, nil, global)
+	defer l1.Close()
+	l2 := NewSharedLimitedListener(ln2, nil, global)
+	defer l2.Close()
+
+	// l1 is waiting for connections that never come
+	idle := acceptAsync(l1)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 0, global.NumConns())
+
+	dialN(t, ln2.Addr().String(), 1)
+	select {
+	case conn := <-acceptAsync(l2):
+		require.NotNil(t, conn)
+		defer conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("an idle listener shouldn't use up the shared limit")
+	}
+	assert.Equal(t, 1, global.NumConns())
+
+	// once the shared limit is reached, connections to l1 are closed rather
+	// than exceeding it
+	dialN(t, ln1.Addr().String(), 1)
+	select {
+	case <-idle:
+		t.Fatal("Accept should not return a connection over the shared limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.Equal(t, 1, global.NumConns())
+}
+
+func TestUnlimitedListener(t *testing.T) {
+	assert.Nil(t, NewConnLimit(0))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	l := NewLimitedListener(ln, 0)
+	defer l.Close()
+
+	dialN(t, ln.Addr().String(), 5)
+	for i := 0; i < 5; i++ {
+		conn := <-acceptAsync(l)
+		require.NotNil(t, conn)
+		defer conn.Close()
+	}
+}
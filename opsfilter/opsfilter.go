@@ -85,6 +85,12 @@ func (f *opsfilter) Apply(cs *filters.ConnectionState, req *http.Request, next f
 		pdc, ok := conn.(tlslistener.ProbingDetectingConn)
 		if ok {
 			addVal(common.ProbingError, pdc.ProbingError())
+			if fc, ok := conn.(tlslistener.ClientHelloFingerprintingConn); ok {
+				if fingerprints := fc.ClientHelloFingerprints(); fingerprints != nil {
+					addVal(common.JA3, fingerprints.JA3)
+					addVal(common.JA4, fingerprints.JA4)
+				}
+			}
 			return false
 		}
 		return true
@@ -6,28 +6,41 @@ type protoListenerArgs struct {
 	fn       listenerBuilderFN
 }
 
+// getProtoListenersArgs returns the listeners for all protocols. Connections
+// are screened by IP on the base listener that each protocol wraps, so that
+// rejected clients never get to any handshake. QUIC handshakes happen inside
+// its listener, so QUIC connections can only be screened once established.
+// Broflake connections aren't screened at all, since they come from volunteers
+// relaying traffic for many clients rather than from the clients themselves.
 func getProtoListenersArgs(p *Proxy) []protoListenerArgs {
+	tcp := func(protocol string) listenerBuilderFN {
+		return p.screenIPs(protocol, p.listenTCP)
+	}
 	return []protoListenerArgs{
 		/**********   listeners for base transport   **********/
-		{"https", p.HTTPAddr, p.wrapTLSIfNecessary(p.listenHTTP(p.listenTCP))},
+		{"https", p.HTTPAddr, p.wrapTLSIfNecessary(p.listenHTTP(tcp("https")))},
 		{
 			"https_multiplex",
 			p.HTTPMultiplexAddr,
-			p.wrapMultiplexing(p.wrapTLSIfNecessary(p.listenHTTP(p.listenTCP))),
+			p.wrapMultiplexing(p.wrapTLSIfNecessary(p.listenHTTP(tcp("https_multiplex")))),
 		},
-		{"tlsmasq", p.TLSMasqAddr, p.wrapMultiplexing(p.listenTLSMasq(p.listenTCP))},
-		{"starbridge", p.StarbridgeAddr, p.wrapMultiplexing(p.listenStarbridge(p.listenTCP))},
+		{"tlsmasq", p.TLSMasqAddr, p.wrapMultiplexing(p.listenTLSMasq(tcp("tlsmasq")))},
+		{"starbridge", p.StarbridgeAddr, p.wrapMultiplexing(p.listenStarbridge(tcp("starbridge")))},
 		{"broflake", p.BroflakeAddr, p.listenBroflake(p.listenTCP)},
-		{"algeneva", p.AlgenevaAddr, p.wrapMultiplexing(p.listenAlgeneva(p.listenTCP))},
+		{"algeneva", p.AlgenevaAddr, p.wrapMultiplexing(p.listenAlgeneva(tcp("algeneva")))},
 		/******************************************************/
 
-		{"kcp", p.KCPConf, p.wrapTLSIfNecessary(p.listenKCP)},
-		{"quic_ietf", p.QUICIETFAddr, p.listenQUICIETF},
-		{"shadowsocks", p.ShadowsocksAddr, p.listenShadowsocks},
+		{"kcp", p.KCPConf, p.wrapTLSIfNecessary(p.screenIPs("kcp", p.listenKCP))},
+		{"quic_ietf", p.QUICIETFAddr, p.screenIPs("quic_ietf", p.listenQUICIETF)},
+		// shadowsocks doesn't use listenTCP on purpose to avoid additional wrapping
+		// with idle timing. The idea here is to be as close to what outline
+		// shadowsocks does without any intervention, especially with respect to
+		// draining connections and the timing of closures.
+		{"shadowsocks", p.ShadowsocksAddr, p.listenShadowsocks(p.screenIPs("shadowsocks", listenRawTCP))},
 		{
 			"shadowsocks_multiplex",
 			p.ShadowsocksMultiplexAddr,
-			p.wrapMultiplexing(p.listenShadowsocks),
+			p.wrapMultiplexing(p.listenShadowsocks(p.screenIPs("shadowsocks_multiplex", listenRawTCP))),
 		},
 	}
 }
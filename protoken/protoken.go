@@ -0,0 +1,143 @@
+// Package protoken recognizes Pro users by the signed token that they send in
+// common.ProTokenHeader, so that free proxies don't cap their data usage.
+//
+// A token is the base64url encoded (without padding) JSON claims, followed by a
+// dot and the base64url encoded Ed25519 signature of the encoded claims, for
+// example:
+//
+//	eyJkZXZpY2VJZCI6ImFiYyIsImV4cCI6MTcwMDAwMDAwMH0.<signature>
+//
+// Tokens are bound to a device ID and expire, and are verified locally with the
+// public key of the signer.
+package protoken
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/golog"
+	"github.com/getlantern/proxy/v3/filters"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+var (
+	log = golog.LoggerFor("protoken")
+
+	ErrMalformed        = errors.New("malformed pro token")
+	ErrInvalidSignature = errors.New("invalid pro token signature")
+	ErrExpired          = errors.New("expired pro token")
+	ErrWrongDevice      = errors.New("pro token issued for a different device")
+)
+
+type proCtxKey struct{}
+
+// Claims are the signed contents of a pro token.
+type Claims struct {
+	// DeviceID is the device to which the token was issued
+	DeviceID string `json:"deviceId"`
+
+	// ExpiresAt is the time (in seconds since the epoch) after which the
+	// token is no longer valid
+	ExpiresAt int64 `json:"exp"`
+}
+
+// ParsePublicKey parses a base64 encoded (standard or URL encoding) Ed25519
+// public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	s = strings.TrimSpace(s)
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		key, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+	}
+	if err != nil {
+		return nil, errors.New("unable to decode pro token public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("pro token public key should be %d bytes, not %d", ed25519.PublicKeySize, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Sign creates a token for the given device that expires at the given time.
+func Sign(privateKey ed25519.PrivateKey, deviceID string, expiresAt time.Time) (string, error) {
+	claims, err := json.Marshal(&Claims{DeviceID: deviceID, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", err
+	}
+	encodedClaims := base64.RawURLEncoding.EncodeToString(claims)
+	signature := ed25519.Sign(privateKey, []byte(encodedClaims))
+	return encodedClaims + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// Verify checks that token was signed with publicKey, was issued for deviceID
+// and hasn't expired as of now.
+func Verify(publicKey ed25519.PublicKey, token, deviceID string, now time.Time) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	if !ed25519.Verify(publicKey, []byte(parts[0]), signature) {
+		return nil, ErrInvalidSignature
+	}
+	encodedClaims, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	claims := &Claims{}
+	if err := json.Unmarshal(encodedClaims, claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if claims.DeviceID == "" || claims.DeviceID != deviceID {
+		return nil, ErrWrongDevice
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+// IsPro indicates whether the request with the given context carried a valid
+// pro token.
+func IsPro(ctx context.Context) bool {
+	pro, _ := ctx.Value(proCtxKey{}).(bool)
+	return pro
+}
+
+type proTokenFilter struct {
+	publicKey ed25519.PublicKey
+}
+
+// NewFilter creates a filter that verifies the pro token in
+// common.ProTokenHeader with the given publicKey, marking requests with a valid
+// token so that IsPro returns true for their context. The header is always
+// removed before passing the request along.
+func NewFilter(publicKey ed25519.PublicKey) filters.Filter {
+	return &proTokenFilter{publicKey: publicKey}
+}
+
+func (f *proTokenFilter) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+	token := req.Header.Get(common.ProTokenHeader)
+	if token == "" {
+		return next(cs, req)
+	}
+	req.Header.Del(common.ProTokenHeader)
+
+	deviceID := req.Header.Get(common.DeviceIdHeader)
+	if _, err := Verify(f.publicKey, token, deviceID, time.Now()); err != nil {
+		log.Debugf("Ignoring pro token from device %v: %v", deviceID, err)
+		return next(cs, req)
+	}
+	log.Tracef("Recognized device %v as pro", deviceID)
+	return next(cs, req.WithContext(context.WithValue(req.Context(), proCtxKey{}, true)))
+}
@@ -0,0 +1,103 @@
+package protoken
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/getlantern/proxy/v3/filters"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+func TestVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	_, otherPrivateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	now := time.Now()
+	token, err := Sign(privateKey, "device1", now.Add(time.Hour))
+	require.NoError(t, err)
+
+	claims, err := Verify(publicKey, token, "device1", now)
+	require.NoError(t, err)
+	assert.Equal(t, "device1", claims.DeviceID)
+
+	_, err = Verify(publicKey, token, "device2", now)
+	assert.Equal(t, ErrWrongDevice, err)
+	_, err = Verify(publicKey, token, "device1", now.Add(2*time.Hour))
+	assert.Equal(t, ErrExpired, err)
+
+	forged, err := Sign(otherPrivateKey, "device1", now.Add(time.Hour))
+	require.NoError(t, err)
+	_, err = Verify(publicKey, forged, "device1", now)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	otherDevice, err := Sign(privateKey, "device2", now.Add(time.Hour))
+	require.NoError(t, err)
+	tampered := strings.Split(otherDevice, ".")[0] + "." + strings.Split(token, ".")[1]
+	_, err = Verify(publicKey, tampered, "device2", now)
+	assert.Equal(t, ErrInvalidSignature, err, "claims shouldn't be interchangeable between tokens")
+
+	for _, malformed := range []string{"", "abc", "a.b.c", "abc.!!!"} {
+		_, err = Verify(publicKey, malformed, "device1", now)
+		assert.Error(t, err, malformed)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+
+	parsed, err := ParsePublicKey(base64.StdEncoding.EncodeToString(publicKey))
+	require.NoError(t, err)
+	assert.Equal(t, publicKey, parsed)
+	parsed, err = ParsePublicKey(base64.RawURLEncoding.EncodeToString(publicKey))
+	require.NoError(t, err)
+	assert.Equal(t, publicKey, parsed)
+
+	_, err = ParsePublicKey(base64.StdEncoding.EncodeToString(publicKey[:16]))
+	assert.Error(t, err)
+	_, err = ParsePublicKey("not base64!")
+	assert.Error(t, err)
+}
+
+func TestFilter(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	token, err := Sign(privateKey, "device1", time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	filter := NewFilter(publicKey)
+	apply := func(deviceID, token string) (isPro bool, forwardedToken string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+		req.Header.Set(common.DeviceIdHeader, deviceID)
+		if token != "" {
+			req.Header.Set(common.ProTokenHeader, token)
+		}
+		filter.Apply(nil, req, func(cs *filters.ConnectionState, req *http.Request) (*http.Response, *filters.ConnectionState, error) {
+			isPro = IsPro(req.Context())
+			forwardedToken = req.Header.Get(common.ProTokenHeader)
+			return nil, cs, nil
+		})
+		return
+	}
+
+	isPro, forwardedToken := apply("device1", token)
+	assert.True(t, isPro)
+	assert.Empty(t, forwardedToken, "pro token shouldn't be forwarded")
+
+	isPro, forwardedToken = apply("device2", token)
+	assert.False(t, isPro, "token for another device shouldn't be accepted")
+	assert.Empty(t, forwardedToken, "pro token shouldn't be forwarded")
+
+	isPro, _ = apply("device1", "")
+	assert.False(t, isPro)
+}
@@ -13,7 +13,15 @@ import (
 // ports and returns either a 400 error if the request is missing a port or a
 // 403 error if the port is not allowed.
 func RestrictConnectPorts(allowedPorts []int) filters.Filter {
+	return RestrictConnectPortsWith(func() []int { return allowedPorts })
+}
+
+// RestrictConnectPortsWith is like RestrictConnectPorts but obtains the list of
+// allowed ports from getAllowedPorts on every request, allowing it to change
+// at runtime.
+func RestrictConnectPortsWith(getAllowedPorts func() []int) filters.Filter {
 	return filters.FilterFunc(func(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+		allowedPorts := getAllowedPorts()
 		if req.Method != http.MethodConnect || len(allowedPorts) == 0 {
 			return next(cs, req)
 		}
@@ -0,0 +1,124 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+)
+
+const (
+	// Blacklisted IPs are kept in a sorted set scored by the time (in unix
+	// milliseconds) at which they were blacklisted.
+	addToBlacklistScript = `
+	local blacklistKey = KEYS[1]
+
+	redis.call("zadd", blacklistKey, ARGV[1], ARGV[2])
+	-- forget expired entries and the whole set if nothing gets blacklisted for a while
+	redis.call("zremrangebyscore", blacklistKey, "-inf", ARGV[3])
+	redis.call("pexpire", blacklistKey, ARGV[4])
+	return redis.call("zcard", blacklistKey)
+`
+
+	getBlacklistScript = `
+	local blacklistKey = KEYS[1]
+
+	redis.call("zremrangebyscore", blacklistKey, "-inf", ARGV[1])
+	return redis.call("zrange", blacklistKey, 0, -1, "withscores")
+`
+)
+
+type blacklistStore struct {
+	rc        *redis.Client
+	key       string
+	addSHA    string
+	getSHA    string
+	scriptsMx sync.Mutex
+}
+
+// NewBlacklistStore creates a blacklist.Store that shares blacklisted IPs with
+// all proxies on the same track.
+func NewBlacklistStore(rc *redis.Client, track string) blacklist.Store {
+	key := "_blacklist"
+	if track != "" {
+		key += ":" + track
+	}
+	return &blacklistStore{rc: rc, key: key}
+}
+
+// loadScripts loads the Lua scripts if they haven't been loaded yet.
+func (s *blacklistStore) loadScripts() (addSHA string, getSHA string, err error) {
+	s.scriptsMx.Lock()
+	defer s.scriptsMx.Unlock()
+	if s.addSHA == "" {
+		s.addSHA, err = s.rc.ScriptLoad(context.Background(), addToBlacklistScript).Result()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	if s.getSHA == "" {
+		s.getSHA, err = s.rc.ScriptLoad(context.Background(), getBlacklistScript).Result()
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return s.addSHA, s.getSHA, nil
+}
+
+// evalSha runs the script with the given SHA, making sure that scripts are
+// loaded again next time if Redis lost them, for example because it restarted.
+func (s *blacklistStore) evalSha(sha string, args ...interface{}) *redis.Cmd {
+	cmd := s.rc.EvalSha(context.Background(), sha, []string{s.key}, args...)
+	if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		s.scriptsMx.Lock()
+		s.addSHA, s.getSHA = "", ""
+		s.scriptsMx.Unlock()
+	}
+	return cmd
+}
+
+func (s *blacklistStore) Add(ip string, blacklistedAt time.Time, expiration time.Duration) error {
+	addSHA, _, err := s.loadScripts()
+	if err != nil {
+		return err
+	}
+	return s.evalSha(addSHA,
+		strconv.FormatInt(blacklistedAt.UnixMilli(), 10),
+		ip,
+		strconv.FormatInt(time.Now().Add(-expiration).UnixMilli(), 10),
+		strconv.FormatInt(expiration.Milliseconds(), 10)).Err()
+}
+
+func (s *blacklistStore) Remove(ip string) error {
+	return s.rc.ZRem(context.Background(), s.key, ip).Err()
+}
+
+func (s *blacklistStore) All(expiration time.Duration) (map[string]time.Time, error) {
+	_, getSHA, err := s.loadScripts()
+	if err != nil {
+		return nil, err
+	}
+	_result, err := s.evalSha(getSHA,
+		strconv.FormatInt(time.Now().Add(-expiration).UnixMilli(), 10)).Result()
+	if err != nil {
+		return nil, err
+	}
+	result, _ := _result.([]interface{})
+	blacklisted := make(map[string]time.Time, len(result)/2)
+	for i := 0; i+1 < len(result); i += 2 {
+		ip, _ := result[i].(string)
+		score, _ := result[i+1].(string)
+		millis, err := strconv.ParseFloat(score, 64)
+		if ip == "" || err != nil {
+			log.Errorf("Ignoring invalid blacklist entry %v with score %v", result[i], result[i+1])
+			continue
+		}
+		blacklisted[ip] = time.UnixMilli(int64(millis))
+	}
+	return blacklisted, nil
+}
@@ -0,0 +1,61 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/internal/testutil"
+)
+
+func TestBlacklistStore(t *testing.T) {
+	redisClient := testutil.TestRedis(t)
+	store := NewBlacklistStore(redisClient, "test")
+	otherTrack := NewBlacklistStore(redisClient, "other")
+
+	now := time.Now().Truncate(time.Millisecond)
+	require.NoError(t, store.Add("1.1.1.1", now, time.Hour))
+	require.NoError(t, store.Add("2.2.2.2", now.Add(-2*time.Hour), time.Hour))
+	require.NoError(t, otherTrack.Add("3.3.3.3", now, time.Hour))
+
+	blacklisted, err := store.All(time.Hour)
+	require.NoError(t, err)
+	assert.Len(t, blacklisted, 1, "expired and other tracks' IPs should be excluded")
+	assert.True(t, now.Equal(blacklisted["1.1.1.1"]))
+	assert.True(t, redisClient.PTTL(context.Background(), "_blacklist:test").Val() > 0, "should have set TTL to the key")
+
+	require.NoError(t, store.Remove("1.1.1.1"))
+	blacklisted, err = store.All(time.Hour)
+	require.NoError(t, err)
+	assert.Empty(t, blacklisted)
+}
+
+func TestBlacklistStoreReloadsScripts(t *testing.T) {
+	redisClient := testutil.TestRedis(t)
+	restart := &fakeRestart{}
+	opts := *redisClient.Options()
+	opts.Limiter = restart
+	opts.MaxRetries = -1
+	flakyClient := redis.NewClient(&opts)
+	flakyClient.AddHook(restart)
+	defer flakyClient.Close()
+
+	store := NewBlacklistStore(flakyClient, "restart")
+	now := time.Now().Truncate(time.Millisecond)
+	require.NoError(t, store.Add("1.1.1.1", now, time.Hour))
+
+	restart.goDown()
+	assert.Error(t, store.Add("2.2.2.2", now, time.Hour))
+	restart.comeBack()
+	_, err := store.All(time.Hour)
+	assert.Error(t, err, "scripts should have been lost")
+
+	require.NoError(t, store.Add("2.2.2.2", now, time.Hour), "scripts should have been loaded again")
+	blacklisted, err := store.All(time.Hour)
+	require.NoError(t, err)
+	assert.Len(t, blacklisted, 2)
+}
@@ -3,13 +3,22 @@ package redis
 import (
 	"context"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/getlantern/errors"
 	"github.com/getlantern/http-proxy-lantern/v2/usage"
 	"github.com/go-redis/redis/v8"
 )
 
+const (
+	DefaultDeviceFetchBatchSize     = 100
+	DefaultDeviceFetchFlushInterval = 50 * time.Millisecond
+	DefaultDeviceFetchWorkers       = 4
+	DefaultDeviceFetchQueueSize     = 10000
+)
+
 const getUsageScript = `
 	local clientKey = KEYS[1]
 
@@ -24,10 +33,15 @@ type ongoingSet struct {
 	sync.RWMutex
 }
 
-func (s *ongoingSet) add(dev string) {
+// tryAdd adds dev to the set, returning false if it was already a member.
+func (s *ongoingSet) tryAdd(dev string) bool {
 	s.Lock()
+	defer s.Unlock()
+	if s.set[dev] {
+		return false
+	}
 	s.set[dev] = true
-	s.Unlock()
+	return true
 }
 
 func (s *ongoingSet) del(dev string) {
@@ -43,88 +57,199 @@ func (s *ongoingSet) isMember(dev string) bool {
 	return ok
 }
 
+// DeviceFetcherOptions configures a DeviceFetcher
+type DeviceFetcherOptions struct {
+	// BatchSize is the maximum number of devices to fetch with a single
+	// pipelined request. Defaults to DefaultDeviceFetchBatchSize.
+	BatchSize int
+
+	// FlushInterval is the longest that a request waits for its batch to fill
+	// up before being sent anyway. Defaults to DefaultDeviceFetchFlushInterval.
+	FlushInterval time.Duration
+
+	// Workers is the number of batches that can be fetched concurrently.
+	// Defaults to DefaultDeviceFetchWorkers.
+	Workers int
+
+	// QueueSize is the number of requests that can be waiting to be batched.
+	// Requests beyond this are dropped. Defaults to DefaultDeviceFetchQueueSize.
+	QueueSize int
+}
+
 // DeviceFetcher retrieves device information from Redis
 type DeviceFetcher struct {
-	rc      *redis.Client
-	ongoing *ongoingSet
-	queue   chan string
-	ctx     context.Context
+	rc        *redis.Client
+	usage     *usage.Cache
+	opts      DeviceFetcherOptions
+	ongoing   *ongoingSet
+	queue     chan string
+	batches   chan []string
+	ctx       context.Context
+	scriptSHA string
+	scriptMx  sync.Mutex
 }
 
-// NewDeviceFetcher creates a new DeviceFetcher
-func NewDeviceFetcher(rc *redis.Client) *DeviceFetcher {
+// NewDeviceFetcher creates a new DeviceFetcher that stores the device usage it
+// fetches in the given usage.Cache
+func NewDeviceFetcher(rc *redis.Client, usageCache *usage.Cache, opts DeviceFetcherOptions) *DeviceFetcher {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultDeviceFetchBatchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = DefaultDeviceFetchFlushInterval
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultDeviceFetchWorkers
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = DefaultDeviceFetchQueueSize
+	}
 	df := &DeviceFetcher{
 		rc:      rc,
-		ongoing: &ongoingSet{set: make(map[string]bool, 512)},
-		queue:   make(chan string, 512),
+		usage:   usageCache,
+		opts:    opts,
+		ongoing: &ongoingSet{set: make(map[string]bool, opts.QueueSize)},
+		queue:   make(chan string, opts.QueueSize),
+		batches: make(chan []string, opts.Workers),
 		ctx:     context.Background(),
 	}
 
-	go df.processDeviceUsageRequests()
+	go df.batchDeviceUsageRequests()
+	for i := 0; i < opts.Workers; i++ {
+		go df.processDeviceUsageRequests()
+	}
 
 	return df
 }
 
 // RequestNewDeviceUsage adds a new request for device usage to the queue
 func (df *DeviceFetcher) RequestNewDeviceUsage(deviceID string) {
-	if df.ongoing.isMember(deviceID) {
+	if !df.ongoing.tryAdd(deviceID) {
 		return
 	}
 	select {
 	case df.queue <- deviceID:
-		df.ongoing.add(deviceID)
 		// ok
 	default:
 		// queue full, ignore
+		df.ongoing.del(deviceID)
 	}
 }
 
-func (df *DeviceFetcher) processDeviceUsageRequests() {
-	var scriptSHA string
-	for deviceID := range df.queue {
-		if scriptSHA == "" {
-			var err error
-			scriptSHA, err = df.rc.ScriptLoad(df.ctx, getUsageScript).Result()
-			if err != nil {
-				log.Errorf("Unable to load script, skip fetching usage: %v", err)
-				continue
+// batchDeviceUsageRequests groups queued requests into batches of up to
+// BatchSize, sending incomplete batches after FlushInterval.
+func (df *DeviceFetcher) batchDeviceUsageRequests() {
+	ticker := time.NewTicker(df.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]string, 0, df.opts.BatchSize)
+	send := func() {
+		df.batches <- batch
+		batch = make([]string, 0, df.opts.BatchSize)
+	}
+
+	for {
+		select {
+		case deviceID := <-df.queue:
+			batch = append(batch, deviceID)
+			if len(batch) >= df.opts.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				send()
 			}
 		}
+	}
+}
 
-		if err := df.retrieveDeviceUsage(scriptSHA, deviceID); err != nil {
+func (df *DeviceFetcher) processDeviceUsageRequests() {
+	for batch := range df.batches {
+		if err := df.retrieveDeviceUsages(batch); err != nil {
 			log.Errorf("Error retrieving device usage: %v", err)
 		}
+		// whether or not we succeeded, we're done with these devices so that
+		// they can be requested again
+		for _, deviceID := range batch {
+			df.ongoing.del(deviceID)
+		}
+	}
+}
+
+func (df *DeviceFetcher) getScriptSHA() (string, error) {
+	df.scriptMx.Lock()
+	defer df.scriptMx.Unlock()
+	if df.scriptSHA == "" {
+		scriptSHA, err := df.rc.ScriptLoad(df.ctx, getUsageScript).Result()
+		if err != nil {
+			return "", errors.New("Unable to load script, skip fetching usage: %v", err)
+		}
+		df.scriptSHA = scriptSHA
 	}
+	return df.scriptSHA, nil
 }
 
-func (df *DeviceFetcher) retrieveDeviceUsage(scriptSHA string, deviceID string) error {
-	clientKey := "_client:" + deviceID
-	_vals, err := df.rc.EvalSha(df.ctx, scriptSHA, []string{clientKey}).Result()
+func (df *DeviceFetcher) resetScriptSHA() {
+	df.scriptMx.Lock()
+	df.scriptSHA = ""
+	df.scriptMx.Unlock()
+}
+
+// retrieveDeviceUsages fetches the usage of all the given devices with a single
+// pipelined request.
+func (df *DeviceFetcher) retrieveDeviceUsages(deviceIDs []string) error {
+	scriptSHA, err := df.getScriptSHA()
 	if err != nil {
 		return err
 	}
-	vals := _vals.([]interface{})
+
+	pl := df.rc.Pipeline()
+	cmds := make([]*redis.Cmd, 0, len(deviceIDs))
+	for _, deviceID := range deviceIDs {
+		cmds = append(cmds, pl.EvalSha(df.ctx, scriptSHA, []string{"_client:" + deviceID}))
+	}
+	// Errors are checked for each command below
+	pl.Exec(df.ctx)
+
+	var lastErr error
+	for i, cmd := range cmds {
+		_vals, err := cmd.Result()
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "NOSCRIPT") {
+				// Redis lost our script, load it again next time
+				df.resetScriptSHA()
+			}
+			lastErr = err
+			continue
+		}
+		df.storeDeviceUsage(deviceIDs[i], _vals.([]interface{}))
+	}
+	if lastErr != nil {
+		return errors.New("Unable to fetch usage for some of %d devices: %v", len(deviceIDs), lastErr)
+	}
+	return nil
+}
+
+func (df *DeviceFetcher) storeDeviceUsage(deviceID string, vals []interface{}) {
 	if vals[0] == nil || vals[1] == nil || vals[2] == nil || vals[3] == nil {
 		// No entry found or partially stored, means no usage data so far.
-		usage.Set(deviceID, "", 0, time.Now(), 0)
-		return nil
+		df.usage.Set(deviceID, "", 0, 0, time.Now(), 0)
+		return
 	}
 
 	_bytesIn := vals[0].(string)
 	bytesIn, err := strconv.ParseInt(_bytesIn, 10, 64)
 	if err != nil {
 		log.Debugf("Error parsing bytesIn: %v", err)
-		return nil
+		return
 	}
 	_bytesOut := vals[1].(string)
 	bytesOut, err := strconv.ParseInt(_bytesOut, 10, 64)
 	if err != nil {
 		log.Debugf("Error parsing bytesOut: %v", err)
-		return nil
+		return
 	}
 	countryCode := vals[2].(string)
 	ttl := vals[3].(int64)
-	usage.Set(deviceID, countryCode, bytesIn+bytesOut, time.Now(), ttl)
-	df.ongoing.del(deviceID)
-	return nil
+	df.usage.Set(deviceID, countryCode, bytesIn, bytesOut, time.Now(), ttl)
 }
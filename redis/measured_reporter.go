@@ -6,6 +6,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -59,63 +60,201 @@ func (sac *statsAndContext) add(other *statsAndContext) *statsAndContext {
 	return &statsAndContext{other.ctx, &newStats}
 }
 
-func NewMeasuredReporter(countryLookup geo.CountryLookup, rc *redis.Client, reportInterval time.Duration, throttleConfig throttle.Config) listeners.MeasuredReportFN {
+// statsOverflow holds stats that didn't fit into the stats channel, combined
+// by device, until they're picked up with the next submission.
+type statsOverflow struct {
+	statsByDeviceID map[string]*statsAndContext
+	mx              sync.Mutex
+}
+
+func newStatsOverflow() *statsOverflow {
+	return &statsOverflow{statsByDeviceID: make(map[string]*statsAndContext)}
+}
+
+func (o *statsOverflow) add(sac *statsAndContext) {
+	deviceID, _ := sac.ctx[common.DeviceID].(string)
+	if deviceID == "" {
+		return
+	}
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	existing := o.statsByDeviceID[deviceID]
+	if existing == nil && len(o.statsByDeviceID) >= maxBufferedDevices {
+		log.Tracef("Already holding overflowing usage for %d devices, dropping usage for %v", len(o.statsByDeviceID), deviceID)
+		return
+	}
+	o.statsByDeviceID[deviceID] = existing.add(sac)
+}
+
+// take returns all stats held so far and starts over.
+func (o *statsOverflow) take() map[string]*statsAndContext {
+	if o == nil {
+		return nil
+	}
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	result := o.statsByDeviceID
+	o.statsByDeviceID = make(map[string]*statsAndContext)
+	return result
+}
+
+// NewMeasuredReporter creates a listeners.MeasuredReportFN that periodically
+// submits data usage to Redis. The returned flush function submits any
+// buffered stats immediately and blocks until that submission has finished or
+// ctx is done. It's meant to be called once on shutdown, after all measured
+// connections have reported their final stats.
+//
+// Usage that can't be submitted because Redis is unavailable is kept and
+// retried with the next submission. If usageBufferFile is specified, it's also
+// saved there so that it survives restarts.
+//
+// The usage totals returned by Redis are stored in usageCache.
+func NewMeasuredReporter(countryLookup geo.CountryLookup, rc *redis.Client, reportInterval time.Duration, throttleConfig throttle.Config, usageCache *usage.Cache, usageBufferFile string) (report listeners.MeasuredReportFN, flush func(ctx context.Context) error) {
 	// Provide some buffering so that we don't lose data while submitting to Redis
 	statsCh := make(chan *statsAndContext, 10000)
-	go reportPeriodically(countryLookup, rc, reportInterval, throttleConfig, statsCh)
-	return func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+	overflow := newStatsOverflow()
+	flushCh := make(chan chan struct{})
+	go reportPeriodically(countryLookup, rc, reportInterval, throttleConfig, usageCache, newUsageBuffer(usageBufferFile), statsCh, overflow, flushCh)
+	report = func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+		sac := &statsAndContext{ctx, deltaStats}
 		select {
-		case statsCh <- &statsAndContext{ctx, deltaStats}:
+		case statsCh <- sac:
 			// submitted successfully
 		default:
-			// data lost, probably because Redis submission is taking longer than expected
+			// probably because Redis submission is taking longer than expected,
+			// hold on to the stats until the next submission
+			overflow.add(sac)
 		}
 	}
+	flush = func(ctx context.Context) error {
+		flushed := make(chan struct{})
+		select {
+		case flushCh <- flushed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		select {
+		case <-flushed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return
 }
 
-func reportPeriodically(countryLookup geo.CountryLookup, rc *redis.Client, reportInterval time.Duration, throttleConfig throttle.Config, statsCh chan *statsAndContext) {
+func reportPeriodically(countryLookup geo.CountryLookup, rc *redis.Client, reportInterval time.Duration, throttleConfig throttle.Config, usageCache *usage.Cache, buffer *usageBuffer, statsCh chan *statsAndContext, overflow *statsOverflow, flushCh chan chan struct{}) {
 	// randomize the interval to evenly distribute traffic to reporting Redis.
 	randomized := time.Duration(reportInterval.Nanoseconds()/2 + rand.Int63n(reportInterval.Nanoseconds()))
 	log.Debugf("Will report data usage to Redis every %v", randomized)
 	ticker := time.NewTicker(randomized)
-	statsByDeviceID := make(map[string]*statsAndContext)
+	statsByDeviceID, err := buffer.load()
+	if err != nil {
+		log.Errorf("Unable to load buffered usage, ignoring: %v", err)
+	} else if len(statsByDeviceID) > 0 {
+		log.Debugf("Loaded buffered usage for %d devices", len(statsByDeviceID))
+	}
+	buffered := len(statsByDeviceID) > 0
 	var scriptSHA string
+
+	add := func(sac *statsAndContext) {
+		_deviceID := sac.ctx[common.DeviceID]
+		if _deviceID == nil {
+			// ignore
+			return
+		}
+		deviceID := _deviceID.(string)
+		existing := statsByDeviceID[deviceID]
+		if existing == nil && len(statsByDeviceID) >= maxBufferedDevices {
+			log.Tracef("Already tracking usage for %d devices, dropping usage for %v", len(statsByDeviceID), deviceID)
+			return
+		}
+		statsByDeviceID[deviceID] = existing.add(sac)
+		// Count the usage locally until Redis tells us the new total
+		usageCache.Add(deviceID, int64(sac.stats.RecvTotal), int64(sac.stats.SentTotal))
+	}
+
+	// keepUnsubmitted holds on to whatever couldn't be submitted, saving it to
+	// the buffer file if configured.
+	keepUnsubmitted := func() {
+		log.Debugf("Keeping usage for %d devices until Redis is available", len(statsByDeviceID))
+		if err := buffer.save(statsByDeviceID); err != nil {
+			log.Errorf("Unable to buffer usage: %v", err)
+		}
+		buffered = true
+	}
+
+	submitAll := func() {
+		if overflowed := overflow.take(); len(overflowed) > 0 {
+			log.Debugf("Picking up usage for %d devices that didn't fit into the stats channel", len(overflowed))
+			for _, sac := range overflowed {
+				add(sac)
+			}
+		}
+		if log.IsTraceEnabled() {
+			log.Tracef("Submitting %d stats", len(statsByDeviceID))
+		}
+		if scriptSHA == "" {
+			var err error
+			scriptSHA, err = rc.ScriptLoad(context.Background(), updateUsageScript).Result()
+			if err != nil {
+				log.Errorf("Unable to load script, skip submitting stats: %v", err)
+				keepUnsubmitted()
+				return
+			}
+		}
+
+		err := submit(countryLookup, rc, scriptSHA, statsByDeviceID, throttleConfig, usageCache)
+		if err != nil {
+			if strings.HasPrefix(err.Error(), "NOSCRIPT") {
+				// Redis lost our script, probably because it restarted, load it again next time
+				scriptSHA = ""
+			}
+			log.Errorf("Unable to submit stats: %v", err)
+			keepUnsubmitted()
+			return
+		}
+		if buffered {
+			if err := buffer.save(nil); err != nil {
+				log.Errorf("Unable to clear usage buffer: %v", err)
+			}
+			buffered = false
+		}
+		// Reset stats
+		statsByDeviceID = make(map[string]*statsAndContext)
+	}
+
 	for {
 		select {
 		case sac := <-statsCh:
-			_deviceID := sac.ctx[common.DeviceID]
-			if _deviceID == nil {
-				// ignore
-				continue
-			}
-			deviceID := _deviceID.(string)
-			statsByDeviceID[deviceID] = statsByDeviceID[deviceID].add(sac)
+			add(sac)
 		case <-ticker.C:
-			if log.IsTraceEnabled() {
-				log.Tracef("Submitting %d stats", len(statsByDeviceID))
-			}
-			if scriptSHA == "" {
-				var err error
-				scriptSHA, err = rc.ScriptLoad(context.Background(), updateUsageScript).Result()
-				if err != nil {
-					log.Errorf("Unable to load script, skip submitting stats: %v", err)
-					continue
+			submitAll()
+		case flushed := <-flushCh:
+			// pick up whatever is still buffered before submitting
+		drain:
+			for {
+				select {
+				case sac := <-statsCh:
+					add(sac)
+				default:
+					break drain
 				}
 			}
-
-			err := submit(countryLookup, rc, scriptSHA, statsByDeviceID, throttleConfig)
-			if err != nil {
-				log.Errorf("Unable to submit stats: %v", err)
-			}
-			// Reset stats
-			statsByDeviceID = make(map[string]*statsAndContext)
+			log.Debugf("Flushing %d stats to Redis", len(statsByDeviceID))
+			submitAll()
+			close(flushed)
 		}
 	}
 }
 
-func submit(countryLookup geo.CountryLookup, rc *redis.Client, scriptSHA string, statsByDeviceID map[string]*statsAndContext, throttleConfig throttle.Config) error {
+// submit submits the given stats to Redis, removing each device from
+// statsByDeviceID once its stats have been submitted. On error, the devices
+// that haven't been submitted yet are left in statsByDeviceID.
+func submit(countryLookup geo.CountryLookup, rc *redis.Client, scriptSHA string, statsByDeviceID map[string]*statsAndContext, throttleConfig throttle.Config, usageCache *usage.Cache) error {
 	for deviceID, sac := range statsByDeviceID {
 		now := time.Now()
+		delete(statsByDeviceID, deviceID)
 
 		_clientIP := sac.ctx[common.ClientIP]
 		if _clientIP == nil {
@@ -194,8 +333,10 @@ func submit(countryLookup geo.CountryLookup, rc *redis.Client, scriptSHA string,
 
 		_, err := pl.Exec(context.Background())
 		if err != nil {
+			statsByDeviceID[deviceID] = sac
 			return err
 		}
+		usageCache.Submitted(deviceID, int64(sac.stats.RecvTotal), int64(sac.stats.SentTotal))
 
 		if hasThrottleSettings {
 			_result, err := updateUsage.Result()
@@ -214,7 +355,7 @@ func submit(countryLookup geo.CountryLookup, rc *redis.Client, scriptSHA string,
 				countryCode = _countryCode.(string)
 			}
 			ttlSeconds := result[3].(int64)
-			usage.Set(deviceID, countryCode, bytesIn+bytesOut, now, ttlSeconds)
+			usageCache.Set(deviceID, countryCode, bytesIn, bytesOut, now, ttlSeconds)
 		}
 	}
 	return nil
@@ -2,12 +2,16 @@ package redis
 
 import (
 	"context"
+	"errors"
 	"net"
+	"path/filepath"
 	"strconv"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/getlantern/measured"
+	"github.com/go-redis/redis/v8"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -32,17 +36,18 @@ func TestReportPeriodically(t *testing.T) {
 
 	deviceID := "device12"
 	clientIP := "1.1.1.1"
-	fetcher := NewDeviceFetcher(redisClient)
+	usageCache := usage.New(usage.Options{})
+	fetcher := NewDeviceFetcher(redisClient, usageCache, DeviceFetcherOptions{})
 	statsCh := make(chan *statsAndContext, 10000)
 	newStats := func() {
 		statsCh <- &statsAndContext{map[string]interface{}{common.DeviceID: deviceID, "client_ip": clientIP, "app_platform": "windows", "throttled": true}, &measured.Stats{RecvTotal: 2, SentTotal: 1}}
 	}
 	lookup := &fakeLookup{}
-	go reportPeriodically(lookup, redisClient, time.Millisecond, throttle.NewForcedConfig(5000, 500, throttle.Monthly), statsCh)
+	go reportPeriodically(lookup, redisClient, time.Millisecond, throttle.NewForcedConfig(5000, 500, throttle.Monthly), usageCache, nil, statsCh, nil, nil)
 
 	fetcher.RequestNewDeviceUsage(deviceID)
 	time.Sleep(100 * time.Millisecond)
-	localCopy := usage.Get(deviceID)
+	localCopy, _ := usageCache.Get(deviceID)
 	assert.Equal(t, "", localCopy.CountryCode)
 	assert.EqualValues(t, 0, localCopy.Bytes)
 	newStats()
@@ -52,9 +57,11 @@ func TestReportPeriodically(t *testing.T) {
 	assert.Equal(t, "1", result["bytesOut"])
 	assert.Equal(t, "", result["countryCode"])
 	assert.True(t, redisClient.TTL(context.Background(), "_client:"+deviceID).Val() > 0, "should have set TTL to the key")
-	localCopy = usage.Get(deviceID)
+	localCopy, _ = usageCache.Get(deviceID)
 	assert.Equal(t, "", localCopy.CountryCode)
 	assert.EqualValues(t, 3, localCopy.Bytes)
+	assert.EqualValues(t, 2, localCopy.BytesIn)
+	assert.EqualValues(t, 1, localCopy.BytesOut)
 
 	lookup.countryCode = "ir"
 	newStats()
@@ -63,7 +70,7 @@ func TestReportPeriodically(t *testing.T) {
 	assert.Equal(t, "4", result["bytesIn"])
 	assert.Equal(t, "2", result["bytesOut"])
 	assert.Equal(t, "ir", result["countryCode"])
-	localCopy = usage.Get(deviceID)
+	localCopy, _ = usageCache.Get(deviceID)
 	assert.Equal(t, "ir", localCopy.CountryCode)
 	assert.EqualValues(t, 6, localCopy.Bytes)
 
@@ -89,6 +96,123 @@ func TestReportPeriodically(t *testing.T) {
 	assert.Less(t, deviceFirstThrottled, nowUnix+10)
 }
 
+func TestFlushMeasuredReporter(t *testing.T) {
+	redisClient := testutil.TestRedis(t)
+
+	deviceID := "device13"
+	report, flush := NewMeasuredReporter(&fakeLookup{}, redisClient, time.Hour, throttle.NewForcedConfig(5000, 500, throttle.Monthly), usage.New(usage.Options{}), "")
+	report(map[string]interface{}{common.DeviceID: deviceID, common.ClientIP: "1.1.1.1"}, nil, &measured.Stats{RecvTotal: 2, SentTotal: 1}, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, flush(ctx))
+
+	result := redisClient.HGetAll(context.Background(), "_client:"+deviceID).Val()
+	assert.Equal(t, "2", result["bytesIn"], "flush should have submitted stats without waiting for the report interval")
+	assert.Equal(t, "1", result["bytesOut"], "flush should have submitted stats without waiting for the report interval")
+}
+
+func TestMeasuredReporterReplaysAfterOutage(t *testing.T) {
+	redisClient := testutil.TestRedis(t)
+	restart := &fakeRestart{}
+	opts := *redisClient.Options()
+	opts.Limiter = restart
+	opts.MaxRetries = -1
+	flakyClient := redis.NewClient(&opts)
+	flakyClient.AddHook(restart)
+	defer flakyClient.Close()
+
+	deviceID := "device14"
+	usageCache := usage.New(usage.Options{})
+	report, flush := NewMeasuredReporter(&fakeLookup{}, flakyClient, time.Hour, throttle.NewForcedConfig(5000, 500, throttle.Monthly), usageCache, filepath.Join(t.TempDir(), "usage"))
+	doFlush := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		require.NoError(t, flush(ctx))
+	}
+	reportAndFlush := func() {
+		report(map[string]interface{}{common.DeviceID: deviceID, common.ClientIP: "1.1.1.1"}, nil, &measured.Stats{RecvTotal: 2, SentTotal: 1}, false)
+		doFlush()
+	}
+	submitted := func() map[string]string {
+		return redisClient.HGetAll(context.Background(), "_client:"+deviceID).Val()
+	}
+
+	reportAndFlush()
+	assert.Equal(t, "2", submitted()["bytesIn"])
+
+	restart.goDown()
+	reportAndFlush()
+	reportAndFlush()
+	assert.Equal(t, "2", submitted()["bytesIn"], "nothing should be submitted while Redis is down")
+	localCopy, _ := usageCache.Get(deviceID)
+	require.NotNil(t, localCopy)
+	assert.EqualValues(t, 9, localCopy.Bytes, "usage should be counted locally while Redis is down")
+
+	restart.comeBack()
+	// the first submission finds out that Redis lost our script
+	reportAndFlush()
+	doFlush()
+	result := submitted()
+	assert.Equal(t, "8", result["bytesIn"], "usage from the outage should have been replayed")
+	assert.Equal(t, "4", result["bytesOut"], "usage from the outage should have been replayed")
+}
+
+// fakeRestart is a redis.Limiter and redis.Hook that makes a client behave as
+// if Redis went down and then restarted, losing all loaded scripts.
+type fakeRestart struct {
+	down        int32
+	scriptsLost int32
+}
+
+func (r *fakeRestart) goDown() {
+	atomic.StoreInt32(&r.down, 1)
+	atomic.StoreInt32(&r.scriptsLost, 1)
+}
+
+func (r *fakeRestart) comeBack() {
+	atomic.StoreInt32(&r.down, 0)
+}
+
+func (r *fakeRestart) Allow() error {
+	if atomic.LoadInt32(&r.down) == 1 {
+		return errors.New("redis is down")
+	}
+	return nil
+}
+
+func (r *fakeRestart) ReportResult(err error) {}
+
+func (r *fakeRestart) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	r.loseScript(cmd)
+	return ctx, nil
+}
+
+func (r *fakeRestart) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if cmd.Name() == "script" && cmd.Err() == nil {
+		atomic.StoreInt32(&r.scriptsLost, 0)
+	}
+	return nil
+}
+
+func (r *fakeRestart) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	for _, cmd := range cmds {
+		r.loseScript(cmd)
+	}
+	return ctx, nil
+}
+
+func (r *fakeRestart) loseScript(cmd redis.Cmder) {
+	if atomic.LoadInt32(&r.scriptsLost) == 1 && cmd.Name() == "evalsha" {
+		// refer to a script that Redis doesn't know
+		cmd.Args()[1] = "0000000000000000000000000000000000000000"
+	}
+}
+
+func (r *fakeRestart) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
 type fakeLookup struct{ countryCode string }
 
 func (l *fakeLookup) CountryCode(ip net.IP) string {
@@ -116,3 +240,36 @@ func TestExpirationFor(t *testing.T) {
 	require.Equal(t, nextMonday.Unix(), expirationFor(thursday.Add(5*time.Minute), throttle.Weekly, timeZone), 0)
 	require.Equal(t, nextMonday.Unix(), expirationFor(sunday, throttle.Weekly, timeZone), 0)
 }
+
+func TestDeviceFetcherBatches(t *testing.T) {
+	redisClient := testutil.TestRedis(t)
+
+	usageCache := usage.New(usage.Options{})
+	fetcher := NewDeviceFetcher(redisClient, usageCache, DeviceFetcherOptions{BatchSize: 2, FlushInterval: 10 * time.Millisecond})
+	deviceIDs := []string{"batched1", "batched2", "batched3", "batched4", "batched5"}
+	for i, deviceID := range deviceIDs {
+		require.NoError(t, redisClient.HSet(context.Background(), "_client:"+deviceID, "bytesIn", i, "bytesOut", 1, "countryCode", "ir").Err())
+		require.NoError(t, redisClient.Expire(context.Background(), "_client:"+deviceID, time.Hour).Err())
+		fetcher.RequestNewDeviceUsage(deviceID)
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	for i, deviceID := range deviceIDs {
+		u, _ := usageCache.Get(deviceID)
+		if assert.NotNil(t, u, deviceID) {
+			assert.EqualValues(t, i+1, u.Bytes, deviceID)
+			assert.Equal(t, "ir", u.CountryCode, deviceID)
+		}
+		assert.False(t, fetcher.ongoing.isMember(deviceID), "%v should no longer be ongoing", deviceID)
+	}
+}
+
+func TestDeviceFetcherReleasesFailedRequests(t *testing.T) {
+	// nothing is listening on this port
+	redisClient := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	fetcher := NewDeviceFetcher(redisClient, usage.New(usage.Options{}), DeviceFetcherOptions{FlushInterval: 10 * time.Millisecond})
+	fetcher.RequestNewDeviceUsage("failing")
+	assert.Eventually(t, func() bool {
+		return !fetcher.ongoing.isMember("failing")
+	}, 5*time.Second, 10*time.Millisecond, "failed request should no longer be ongoing")
+}
@@ -0,0 +1,68 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
+)
+
+// activeSessionTicketKeysTTL is how long reports of the active session ticket
+// keys are kept if proxies stop reporting.
+const activeSessionTicketKeysTTL = 24 * time.Hour
+
+type sessionTicketKeyRing struct {
+	rc        *redis.Client
+	key       string
+	activeKey string
+	proxyName string
+}
+
+// NewSessionTicketKeyRing creates a tlslistener.KeyRingSource that loads the
+// session ticket key ring shared by all proxies on the same track. The ring is
+// stored as a JSON-encoded tlslistener.KeyRing. Each proxy reports the
+// version and active key fingerprint it's using to a hash keyed by proxyName,
+// so that we can check that the whole track rotated together.
+func NewSessionTicketKeyRing(rc *redis.Client, track, proxyName string) tlslistener.KeyRingSource {
+	key := "_sessionticketkeys"
+	if track != "" {
+		key += ":" + track
+	}
+	if proxyName == "" {
+		proxyName, _ = os.Hostname()
+	}
+	return &sessionTicketKeyRing{rc: rc, key: key, activeKey: key + ":active", proxyName: proxyName}
+}
+
+func (s *sessionTicketKeyRing) Load() (*tlslistener.KeyRing, error) {
+	encoded, err := s.rc.Get(context.Background(), s.key).Bytes()
+	if err != nil {
+		return nil, err
+	}
+	ring := &tlslistener.KeyRing{}
+	if err := json.Unmarshal(encoded, ring); err != nil {
+		return nil, errors.New("unable to decode key ring in %v: %v", s.key, err)
+	}
+	return ring, nil
+}
+
+func (s *sessionTicketKeyRing) ReportActive(version int64, fingerprint string) error {
+	ctx := context.Background()
+	_, err := s.rc.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, s.activeKey, s.proxyName, fmt.Sprintf("%d:%v", version, fingerprint))
+		pipe.Expire(ctx, s.activeKey, activeSessionTicketKeysTTL)
+		return nil
+	})
+	return err
+}
+
+func (s *sessionTicketKeyRing) String() string {
+	return "redis " + s.key
+}
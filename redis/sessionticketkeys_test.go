@@ -0,0 +1,30 @@
+package redis
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/internal/testutil"
+)
+
+func TestSessionTicketKeyRing(t *testing.T) {
+	redisClient := testutil.TestRedis(t)
+	ctx := context.Background()
+
+	ring := NewSessionTicketKeyRing(redisClient, "track1", "proxy1")
+	_, err := ring.Load()
+	require.Error(t, err, "loading missing key ring should fail")
+
+	require.NoError(t, redisClient.Set(ctx, "_sessionticketkeys:track1", `{"version": 3, "keys": ["a2V5"]}`, 0).Err())
+	loaded, err := ring.Load()
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, loaded.Version)
+	assert.Equal(t, []string{"a2V5"}, loaded.Keys)
+
+	require.NoError(t, ring.ReportActive(3, "0123456789abcdef"))
+	assert.Equal(t, map[string]string{"proxy1": "3:0123456789abcdef"}, redisClient.HGetAll(ctx, "_sessionticketkeys:track1:active").Val())
+	assert.True(t, redisClient.TTL(ctx, "_sessionticketkeys:track1:active").Val() > 0, "should have set TTL on active keys")
+}
@@ -0,0 +1,151 @@
+package redis
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/getlantern/errors"
+	"github.com/getlantern/measured"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+const (
+	// maxBufferedDevices bounds the number of devices whose usage we buffer
+	// while Redis is unavailable.
+	maxBufferedDevices = 100000
+)
+
+// bufferedUsage is the part of a statsAndContext that's needed to submit it to
+// Redis, in a form that survives being encoded to JSON.
+type bufferedUsage struct {
+	DeviceID          string   `json:"deviceID"`
+	ClientIP          string   `json:"clientIP"`
+	Platform          string   `json:"platform,omitempty"`
+	App               string   `json:"app,omitempty"`
+	TimeZone          string   `json:"timeZone,omitempty"`
+	SupportedDataCaps []string `json:"supportedDataCaps,omitempty"`
+	Throttled         bool     `json:"throttled,omitempty"`
+	BytesIn           int      `json:"bytesIn"`
+	BytesOut          int      `json:"bytesOut"`
+}
+
+func (sac *statsAndContext) buffered(deviceID string) *bufferedUsage {
+	str := func(key string) string {
+		s, _ := sac.ctx[key].(string)
+		return s
+	}
+	supportedDataCaps, _ := sac.ctx[common.SupportedDataCaps].([]string)
+	return &bufferedUsage{
+		DeviceID:          deviceID,
+		ClientIP:          str(common.ClientIP),
+		Platform:          str(common.Platform),
+		App:               str(common.App),
+		TimeZone:          str(common.TimeZone),
+		SupportedDataCaps: supportedDataCaps,
+		Throttled:         sac.ctx["throttled"] == true,
+		BytesIn:           sac.stats.RecvTotal,
+		BytesOut:          sac.stats.SentTotal,
+	}
+}
+
+func (bu *bufferedUsage) statsAndContext() *statsAndContext {
+	ctx := map[string]interface{}{
+		common.DeviceID: bu.DeviceID,
+		common.ClientIP: bu.ClientIP,
+		"throttled":     bu.Throttled,
+	}
+	if bu.Platform != "" {
+		ctx[common.Platform] = bu.Platform
+	}
+	if bu.App != "" {
+		ctx[common.App] = bu.App
+	}
+	if bu.TimeZone != "" {
+		ctx[common.TimeZone] = bu.TimeZone
+	}
+	if len(bu.SupportedDataCaps) > 0 {
+		ctx[common.SupportedDataCaps] = bu.SupportedDataCaps
+	}
+	return &statsAndContext{ctx, &measured.Stats{RecvTotal: bu.BytesIn, SentTotal: bu.BytesOut}}
+}
+
+// usageBuffer persists usage that couldn't be submitted to Redis to a local
+// file, so that it can be submitted once Redis is reachable again, even if the
+// proxy restarts in the meantime.
+type usageBuffer struct {
+	path string
+}
+
+func newUsageBuffer(path string) *usageBuffer {
+	if path == "" {
+		return nil
+	}
+	return &usageBuffer{path: path}
+}
+
+// load returns the buffered usage by device ID. It's safe to call on a nil
+// usageBuffer.
+func (ub *usageBuffer) load() (map[string]*statsAndContext, error) {
+	result := make(map[string]*statsAndContext)
+	if ub == nil {
+		return result, nil
+	}
+	encoded, err := os.ReadFile(ub.path)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return result, errors.New("Unable to read usage buffer %v: %v", ub.path, err)
+	}
+	var buffered []*bufferedUsage
+	if err := json.Unmarshal(encoded, &buffered); err != nil {
+		return result, errors.New("Unable to decode usage buffer %v: %v", ub.path, err)
+	}
+	for _, bu := range buffered {
+		result[bu.DeviceID] = result[bu.DeviceID].add(bu.statsAndContext())
+	}
+	return result, nil
+}
+
+// save replaces the buffered usage with the given statsByDeviceID, removing
+// the file if there's nothing left to buffer. It's safe to call on a nil
+// usageBuffer.
+func (ub *usageBuffer) save(statsByDeviceID map[string]*statsAndContext) error {
+	if ub == nil {
+		return nil
+	}
+	if len(statsByDeviceID) == 0 {
+		if err := os.Remove(ub.path); err != nil && !os.IsNotExist(err) {
+			return errors.New("Unable to remove usage buffer %v: %v", ub.path, err)
+		}
+		return nil
+	}
+	buffered := make([]*bufferedUsage, 0, len(statsByDeviceID))
+	for deviceID, sac := range statsByDeviceID {
+		buffered = append(buffered, sac.buffered(deviceID))
+	}
+	encoded, err := json.Marshal(buffered)
+	if err != nil {
+		return errors.New("Unable to encode usage buffer: %v", err)
+	}
+	// write to a temp file and rename so that we never leave a partially
+	// written buffer behind
+	tmp, err := os.CreateTemp(filepath.Dir(ub.path), filepath.Base(ub.path)+".*")
+	if err != nil {
+		return errors.New("Unable to create temp file for usage buffer: %v", err)
+	}
+	_, err = tmp.Write(encoded)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), ub.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.New("Unable to save usage buffer %v: %v", ub.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package redis
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/getlantern/measured"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/common"
+)
+
+func TestUsageBuffer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.json")
+	buffer := newUsageBuffer(path)
+
+	loaded, err := buffer.load()
+	require.NoError(t, err)
+	assert.Empty(t, loaded, "missing file should mean no buffered usage")
+
+	require.NoError(t, buffer.save(map[string]*statsAndContext{
+		"device1": {map[string]interface{}{
+			common.DeviceID:          "device1",
+			common.ClientIP:          "1.1.1.1",
+			common.Platform:          "android",
+			common.SupportedDataCaps: []string{"monthly"},
+			"throttled":              true,
+		}, &measured.Stats{RecvTotal: 2, SentTotal: 1}},
+	}))
+
+	loaded, err = buffer.load()
+	require.NoError(t, err)
+	if assert.Contains(t, loaded, "device1") {
+		sac := loaded["device1"]
+		assert.Equal(t, "1.1.1.1", sac.ctx[common.ClientIP])
+		assert.Equal(t, "android", sac.ctx[common.Platform])
+		assert.Equal(t, []string{"monthly"}, sac.ctx[common.SupportedDataCaps])
+		assert.Equal(t, true, sac.ctx["throttled"])
+		assert.Equal(t, 2, sac.stats.RecvTotal)
+		assert.Equal(t, 1, sac.stats.SentTotal)
+	}
+
+	require.NoError(t, buffer.save(nil))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "saving nothing should remove the file")
+
+	var nilBuffer *usageBuffer
+	loaded, err = nilBuffer.load()
+	require.NoError(t, err)
+	assert.Empty(t, loaded)
+	assert.NoError(t, nilBuffer.save(loaded))
+}
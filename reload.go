@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+	"github.com/getlantern/errors"
+
+	"github.com/getlantern/http-proxy-lantern/v2/blacklist"
+	"github.com/getlantern/http-proxy-lantern/v2/shadowsocks"
+	"github.com/getlantern/http-proxy-lantern/v2/tlslistener"
+)
+
+// ReloadableSettings are the settings of a Proxy that can be changed while
+// it's running by calling Reload.
+type ReloadableSettings struct {
+	Token                       string
+	Tokens                      string
+	TunnelPorts                 string
+	SessionTicketKeys           string
+	ShadowsocksSecret           string
+	ShadowsocksCipher           string
+	ThrottleRefreshInterval     time.Duration
+	BlacklistMode               string
+	BlacklistMaxIdleTime        time.Duration
+	BlacklistMaxConnectInterval time.Duration
+	BlacklistAllowedFailures    int
+	BlacklistExpiration         time.Duration
+}
+
+// Reload applies the given settings to a running proxy without closing any
+// listeners or active connections. Settings that are unchanged are left
+// alone. All changed settings are validated first, so if any of them can't be
+// applied, none are and an error listing the failures is returned.
+//
+// The exported fields of Proxy keep their initial values, the settings in
+// effect are only tracked internally.
+func (p *Proxy) Reload(settings ReloadableSettings) error {
+	p.reloadMx.Lock()
+	defer p.reloadMx.Unlock()
+
+	if p.reloaded == nil {
+		return errors.New("proxy is not running yet")
+	}
+	current := *p.reloaded
+
+	var failures []string
+	fail := func(setting string, err error) {
+		log.Errorf("Unable to reload %v: %v", setting, err)
+		failures = append(failures, setting)
+	}
+	var changes []func()
+
+	if settings.Token != current.Token || settings.Tokens != current.Tokens {
+		tokens, err := parseAuthTokens(settings.Token, settings.Tokens)
+		if p.tokenFilter == nil {
+			fail("tokens", errors.New("token filter not in use"))
+		} else if err != nil {
+			fail("tokens", err)
+		} else {
+			changes = append(changes, func() {
+				log.Debugf("Reloading %d auth tokens", len(tokens))
+				p.tokenFilter.SetTokens(tokens)
+			})
+		}
+	}
+
+	if settings.TunnelPorts != current.TunnelPorts {
+		ports, err := parseTunnelPorts(settings.TunnelPorts)
+		if err != nil {
+			fail("tunnel ports", err)
+		} else {
+			changes = append(changes, func() {
+				log.Debugf("Reloading tunnel ports: %v", settings.TunnelPorts)
+				p.setTunnelPorts(ports)
+			})
+		}
+	}
+
+	if settings.SessionTicketKeys != current.SessionTicketKeys {
+		if len(p.sessionTicketKeyUpdaters) == 0 {
+			fail("session ticket keys", errors.New("no TLS listeners with in-memory session ticket keys"))
+		} else if err := tlslistener.ValidateSessionTicketKeys(settings.SessionTicketKeys); err != nil {
+			fail("session ticket keys", err)
+		} else {
+			changes = append(changes, func() {
+				p.reloadSessionTicketKeys(settings.SessionTicketKeys)
+			})
+		}
+	}
+
+	if settings.ShadowsocksSecret != current.ShadowsocksSecret || settings.ShadowsocksCipher != current.ShadowsocksCipher {
+		configs := shadowsocksCipherConfigs(settings.ShadowsocksSecret, settings.ShadowsocksCipher)
+		if len(p.shadowsocksCipherLists) == 0 {
+			fail("shadowsocks ciphers", errors.New("no shadowsocks listeners"))
+		} else if err := shadowsocks.ValidateCipherConfigs(configs); err != nil {
+			fail("shadowsocks ciphers", err)
+		} else {
+			changes = append(changes, func() {
+				p.reloadShadowsocksCiphers(configs)
+			})
+		}
+	}
+
+	if settings.ThrottleRefreshInterval != current.ThrottleRefreshInterval {
+		refreshable, ok := p.throttleConfig.(interface {
+			SetRefreshInterval(time.Duration)
+		})
+		if !ok {
+			fail("throttle refresh interval", errors.New("throttle config is not refreshed periodically"))
+		} else {
+			changes = append(changes, func() {
+				refreshable.SetRefreshInterval(settings.ThrottleRefreshInterval)
+			})
+		}
+	}
+
+	if settings.BlacklistMode != current.BlacklistMode ||
+		settings.BlacklistMaxIdleTime != current.BlacklistMaxIdleTime ||
+		settings.BlacklistMaxConnectInterval != current.BlacklistMaxConnectInterval ||
+		settings.BlacklistAllowedFailures != current.BlacklistAllowedFailures ||
+		settings.BlacklistExpiration != current.BlacklistExpiration {
+		mode, err := blacklist.ParseMode(settings.BlacklistMode)
+		if p.blacklist == nil {
+			fail("blacklist options", errors.New("blacklist not in use"))
+		} else if err != nil {
+			fail("blacklist options", err)
+		} else {
+			changes = append(changes, func() {
+				p.blacklist.SetOptions(blacklist.Options{
+					Mode:               mode,
+					MaxIdleTime:        settings.BlacklistMaxIdleTime,
+					MaxConnectInterval: settings.BlacklistMaxConnectInterval,
+					AllowedFailures:    settings.BlacklistAllowedFailures,
+					Expiration:         settings.BlacklistExpiration,
+				})
+			})
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New("unable to reload %v", strings.Join(failures, ", "))
+	}
+	for _, change := range changes {
+		change()
+	}
+	p.reloaded = &settings
+	return nil
+}
+
+// enableReload starts tracking the reloadable settings in effect, which are
+// the initial values of the corresponding fields. It's called once everything
+// that Reload changes has been set up.
+func (p *Proxy) enableReload() {
+	p.reloadMx.Lock()
+	defer p.reloadMx.Unlock()
+	settings := p.initialReloadableSettings()
+	p.reloaded = &settings
+}
+
+func (p *Proxy) initialReloadableSettings() ReloadableSettings {
+	return ReloadableSettings{
+		Token:                       p.Token,
+		Tokens:                      p.Tokens,
+		TunnelPorts:                 p.TunnelPorts,
+		SessionTicketKeys:           p.SessionTicketKeys,
+		ShadowsocksSecret:           p.ShadowsocksSecret,
+		ShadowsocksCipher:           p.ShadowsocksCipher,
+		ThrottleRefreshInterval:     p.ThrottleRefreshInterval,
+		BlacklistMode:               p.BlacklistMode,
+		BlacklistMaxIdleTime:        p.BlacklistMaxIdleTime,
+		BlacklistMaxConnectInterval: p.BlacklistMaxConnectInterval,
+		BlacklistAllowedFailures:    p.BlacklistAllowedFailures,
+		BlacklistExpiration:         p.BlacklistExpiration,
+	}
+}
+
+// reloadableSettings returns the reloadable settings currently in effect, for
+// use by listeners created after a Reload.
+func (p *Proxy) reloadableSettings() ReloadableSettings {
+	p.reloadMx.Lock()
+	defer p.reloadMx.Unlock()
+	return p.currentReloadableSettings()
+}
+
+// currentReloadableSettings is like reloadableSettings, but requires reloadMx
+// to be held.
+func (p *Proxy) currentReloadableSettings() ReloadableSettings {
+	if p.reloaded == nil {
+		return p.initialReloadableSettings()
+	}
+	return *p.reloaded
+}
+
+func (p *Proxy) reloadSessionTicketKeys(sessionTicketKeys string) {
+	for _, updater := range p.sessionTicketKeyUpdaters {
+		if err := updater.UpdateSessionTicketKeys(sessionTicketKeys); err != nil {
+			log.Errorf("Unable to reload session ticket keys: %v", err)
+		}
+	}
+	log.Debugf("Reloaded session ticket keys on %d listeners", len(p.sessionTicketKeyUpdaters))
+}
+
+func (p *Proxy) reloadShadowsocksCiphers(configs []shadowsocks.CipherConfig) {
+	for _, cipherList := range p.shadowsocksCipherLists {
+		if err := shadowsocks.UpdateCipherList(cipherList, configs); err != nil {
+			log.Errorf("Unable to reload shadowsocks ciphers: %v", err)
+		}
+	}
+	log.Debugf("Reloaded ciphers on %d shadowsocks listeners", len(p.shadowsocksCipherLists))
+}
+
+// trackSessionTicketKeyUpdater remembers the given TLS listener, which was
+// created with the given session ticket keys, so that its session ticket keys
+// can be changed on Reload.
+func (p *Proxy) trackSessionTicketKeyUpdater(l net.Listener, sessionTicketKeys string) {
+	updater, ok := l.(tlslistener.SessionTicketKeysUpdater)
+	if !ok || p.SessionTicketKeys == "" || p.SessionTicketKeyFile != "" {
+		// keys are either not used or maintained in a file
+		return
+	}
+	p.reloadMx.Lock()
+	defer p.reloadMx.Unlock()
+	p.sessionTicketKeyUpdaters = append(p.sessionTicketKeyUpdaters, updater)
+	if p.reloaded != nil && p.reloaded.SessionTicketKeys != sessionTicketKeys {
+		// keys were reloaded while the listener was being created
+		if err := updater.UpdateSessionTicketKeys(p.reloaded.SessionTicketKeys); err != nil {
+			log.Errorf("Unable to reload session ticket keys: %v", err)
+		}
+	}
+}
+
+// newShadowsocksCipherList creates a cipher list with the current shadowsocks
+// settings and remembers it so that its ciphers can be changed on Reload.
+func (p *Proxy) newShadowsocksCipherList() (service.CipherList, error) {
+	p.reloadMx.Lock()
+	defer p.reloadMx.Unlock()
+	settings := p.currentReloadableSettings()
+	ciphers, err := shadowsocks.NewCipherListWithConfigs(shadowsocksCipherConfigs(settings.ShadowsocksSecret, settings.ShadowsocksCipher))
+	if err != nil {
+		return nil, err
+	}
+	p.shadowsocksCipherLists = append(p.shadowsocksCipherLists, ciphers)
+	return ciphers, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	rclient "github.com/go-redis/redis/v8"
@@ -16,18 +17,28 @@ import (
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
 	"github.com/getlantern/http-proxy-lantern/v2/redis"
 	"github.com/getlantern/http-proxy-lantern/v2/throttle"
+	"github.com/getlantern/http-proxy-lantern/v2/usage"
 )
 
 var (
 	measuredReportingInterval = 1 * time.Minute
+
+	// finalFlushTimeout limits how long the final flush may take once the
+	// shutdown deadline has passed while waiting for connections.
+	finalFlushTimeout = 5 * time.Second
 )
 
 type reportingConfig struct {
 	enabled bool
 	wrapper func(ls net.Listener) net.Listener
+
+	// flush waits for all measured connections to report their final stats and
+	// then submits whatever hasn't been submitted yet. It should be called
+	// once on shutdown, after all connections have been closed.
+	flush func(ctx context.Context) error
 }
 
-func newReportingConfig(countryLookup geo.CountryLookup, rc *rclient.Client, instrument instrument.Instrument, throttleConfig throttle.Config) *reportingConfig {
+func newReportingConfig(countryLookup geo.CountryLookup, rc *rclient.Client, instrument instrument.Instrument, throttleConfig throttle.Config, usageCache *usage.Cache, usageBufferFile string) *reportingConfig {
 	proxiedBytesReporter := func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
 		if deltaStats.SentTotal == 0 && deltaStats.RecvTotal == 0 {
 			// nothing to report
@@ -44,6 +55,7 @@ func newReportingConfig(countryLookup geo.CountryLookup, rc *rclient.Client, ins
 		originHost := fromContext(ctx, common.OriginHost)
 		probingError := fromContext(ctx, common.ProbingError)
 		arch := fromContext(ctx, common.KernelArch)
+		authTokenLabel := fromContext(ctx, common.AuthTokenLabel)
 
 		var client_ip net.IP
 		_client_ip := ctx[common.ClientIP]
@@ -56,10 +68,11 @@ func newReportingConfig(countryLookup geo.CountryLookup, rc *rclient.Client, ins
 		if hasThrottleSettings {
 			dataCapCohort = throttleSettings.(*throttle.Settings).Label
 		}
-		instrument.ProxiedBytes(context.Background(), deltaStats.SentTotal, deltaStats.RecvTotal, platform, platformVersion, libraryVersion, appVersion, app, locale, dataCapCohort, probingError, client_ip, deviceID, originHost, arch)
+		instrument.ProxiedBytes(context.Background(), deltaStats.SentTotal, deltaStats.RecvTotal, platform, platformVersion, libraryVersion, appVersion, app, locale, dataCapCohort, probingError, client_ip, deviceID, originHost, arch, authTokenLabel)
 	}
 
 	var reporter listeners.MeasuredReportFN
+	flushReporter := func(ctx context.Context) error { return nil }
 	if throttleConfig == nil {
 		log.Debug("No throttling configured, don't bother reporting bandwidth usage to Redis")
 		reporter = func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats,
@@ -67,13 +80,91 @@ func newReportingConfig(countryLookup geo.CountryLookup, rc *rclient.Client, ins
 			// noop
 		}
 	} else if rc != nil {
-		reporter = redis.NewMeasuredReporter(countryLookup, rc, measuredReportingInterval, throttleConfig)
+		reporter, flushReporter = redis.NewMeasuredReporter(countryLookup, rc, measuredReportingInterval, throttleConfig, usageCache, usageBufferFile)
+	}
+
+	// Keep track of connections that haven't yet reported their final stats so
+	// that we can wait for them before flushing on shutdown.
+	pending := newPendingReports()
+	pendingReporter := func(ctx map[string]interface{}, stats *measured.Stats, deltaStats *measured.Stats, final bool) {
+		if final {
+			pending.done()
+		}
 	}
-	reporter = combineReporter(reporter, proxiedBytesReporter)
+	reporter = combineReporter(reporter, proxiedBytesReporter, pendingReporter)
 	wrapper := func(ls net.Listener) net.Listener {
-		return listeners.NewMeasuredListener(ls, measuredReportingInterval, reporter)
+		return listeners.NewMeasuredListener(&pendingReportsListener{ls, pending}, measuredReportingInterval, reporter)
+	}
+	flush := func(ctx context.Context) error {
+		select {
+		case <-pending.allReported():
+		case <-ctx.Done():
+			log.Errorf("Timed out waiting for final stats from all connections, flushing what we have")
+			// ctx has already expired, so give the final flush its own deadline
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(context.Background(), finalFlushTimeout)
+			defer cancel()
+		}
+		return flushReporter(ctx)
+	}
+	return &reportingConfig{true, wrapper, flush}
+}
+
+// pendingReports counts connections that haven't reported their final stats
+// yet. Unlike a sync.WaitGroup, waiting for it can be abandoned without leaking
+// a goroutine.
+type pendingReports struct {
+	count int
+	zero  chan struct{}
+	mx    sync.Mutex
+}
+
+func newPendingReports() *pendingReports {
+	zero := make(chan struct{})
+	close(zero)
+	return &pendingReports{zero: zero}
+}
+
+func (p *pendingReports) add() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	if p.count == 0 {
+		p.zero = make(chan struct{})
+	}
+	p.count++
+}
+
+func (p *pendingReports) done() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.count--
+	if p.count == 0 {
+		close(p.zero)
+	}
+}
+
+// allReported returns a channel that's closed once no connections are
+// pending.
+func (p *pendingReports) allReported() <-chan struct{} {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return p.zero
+}
+
+// pendingReportsListener counts accepted connections in pending. Each
+// connection is expected to mark itself done once it has reported its final
+// stats.
+type pendingReportsListener struct {
+	net.Listener
+	pending *pendingReports
+}
+
+func (l *pendingReportsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.pending.add()
 	}
-	return &reportingConfig{true, wrapper}
+	return conn, err
 }
 
 func fromContext(ctx map[string]interface{}, key string) string {
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/getlantern/errors"
@@ -22,6 +23,14 @@ import (
 var (
 	testingLocal = false
 	log          = golog.LoggerFor("server")
+
+	// ErrServerClosed is returned by Serve, ListenAndServeHTTP, etc. after a
+	// call to Shutdown or Close.
+	ErrServerClosed = errors.New("server closed")
+
+	// shutdownPollInterval is how often Shutdown checks whether all active
+	// connections have finished.
+	shutdownPollInterval = 500 * time.Millisecond
 )
 
 // A ListenerGenerator generates a new listener from an existing one.
@@ -62,6 +71,11 @@ type Server struct {
 	listenerGenerators []ListenerGenerator
 	onError            func(conn net.Conn, err error)
 	onAcceptError      func(err error) (fatalErr error)
+
+	mx           sync.Mutex
+	listeners    map[net.Listener]bool
+	activeConns  map[net.Conn]bool
+	shuttingDown bool
 }
 
 // New constructs a new HTTP proxy server using the given options
@@ -96,6 +110,8 @@ func New(opts *Opts) *Server {
 		proxy:         p,
 		onError:       opts.OnError,
 		onAcceptError: opts.OnAcceptError,
+		listeners:     make(map[net.Listener]bool),
+		activeConns:   make(map[net.Conn]bool),
 	}
 }
 
@@ -139,6 +155,12 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 		l = wrap(l)
 	}
 
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
 	if readyCb != nil {
 		readyCb(l.Addr().String())
 	}
@@ -147,6 +169,9 @@ func (s *Server) serve(listener net.Listener, readyCb func(addr string)) error {
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isShuttingDown() {
+				return ErrServerClosed
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				// delay code based on net/http.Server
 				if tempDelay == 0 {
@@ -174,6 +199,7 @@ func (s *Server) handle(conn net.Conn) {
 	if isWrapConn {
 		wrapConn.OnState(http.StateNew)
 	}
+	s.trackConn(conn, true)
 	go s.doHandle(conn, isWrapConn, wrapConn)
 }
 
@@ -185,6 +211,7 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 	}
 	op := ops.Begin("http_proxy_handle").Set("client_ip", clientIP)
 	defer op.End()
+	defer s.trackConn(conn, false)
 
 	defer func() {
 		p := recover()
@@ -207,6 +234,110 @@ func (s *Server) doHandle(conn net.Conn, isWrapConn bool, wrapConn listeners.Wra
 	}
 }
 
+// Shutdown gracefully shuts down the server. It first closes all listeners so
+// that no new connections are accepted and then waits for active connections
+// to finish. If ctx expires before all connections have finished, the
+// remaining connections are closed forcibly and ctx's error is returned.
+//
+// Once Shutdown has been called, Serve, ListenAndServeHTTP, etc. return
+// ErrServerClosed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closeListeners()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		numConns := s.numActiveConns()
+		if numConns == 0 {
+			return nil
+		}
+		log.Debugf("Waiting for %d active connections to finish", numConns)
+		select {
+		case <-ctx.Done():
+			log.Debugf("Timed out waiting for active connections, closing them")
+			s.closeActiveConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes all listeners and all active connections. For a
+// graceful shutdown, use Shutdown.
+func (s *Server) Close() error {
+	s.closeListeners()
+	s.closeActiveConns()
+	return nil
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.shuttingDown
+}
+
+// trackListener adds or removes the given listener from the set of listeners
+// to close on shutdown. It returns false if the server is already shutting
+// down, in which case the listener is not added.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if add {
+		if s.shuttingDown {
+			return false
+		}
+		s.listeners[l] = true
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+func (s *Server) trackConn(conn net.Conn, add bool) {
+	s.mx.Lock()
+	if add {
+		s.activeConns[conn] = true
+	} else {
+		delete(s.activeConns, conn)
+	}
+	s.mx.Unlock()
+}
+
+func (s *Server) numActiveConns() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.activeConns)
+}
+
+func (s *Server) closeListeners() {
+	s.mx.Lock()
+	s.shuttingDown = true
+	ls := make([]net.Listener, 0, len(s.listeners))
+	for l := range s.listeners {
+		ls = append(ls, l)
+	}
+	s.mx.Unlock()
+
+	for _, l := range ls {
+		if err := l.Close(); err != nil {
+			log.Debugf("Error closing listener at %v: %v", l.Addr(), err)
+		}
+	}
+}
+
+func (s *Server) closeActiveConns() {
+	s.mx.Lock()
+	conns := make([]net.Conn, 0, len(s.activeConns))
+	for conn := range s.activeConns {
+		conns = append(conns, conn)
+	}
+	s.mx.Unlock()
+
+	for _, conn := range conns {
+		safeClose(conn)
+	}
+}
+
 func safeClose(conn net.Conn) {
 	defer func() {
 		p := recover()
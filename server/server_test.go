@@ -3,6 +3,7 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
@@ -454,6 +455,49 @@ func TestPanicRecover(t *testing.T) {
 	assert.True(t, conn.Closed(), "Connection should have been closed after recovering from panic")
 }
 
+func TestShutdown(t *testing.T) {
+	connectReq := "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n"
+
+	s := basicServer(0, 30*time.Second)
+	ready := make(chan string)
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- s.ListenAndServeHTTP("localhost:0", func(addr string) {
+			ready <- addr
+		})
+	}()
+	addr := <-ready
+
+	conn, err := net.Dial("tcp", addr)
+	if !assert.NoError(t, err, "should dial proxy server") {
+		return
+	}
+	defer conn.Close()
+	originURL, _ := url.Parse(tlsOriginServer.server.URL)
+	_, err = conn.Write([]byte(fmt.Sprintf(connectReq, originURL.Host, originURL.Host)))
+	if !assert.NoError(t, err, "should write CONNECT request") {
+		return
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if !assert.NoError(t, err) || !assert.Equal(t, 200, resp.StatusCode) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx), "active tunnel should prevent graceful shutdown within deadline")
+	assert.Equal(t, ErrServerClosed, <-serveErr)
+
+	_, err = net.DialTimeout("tcp", addr, time.Second)
+	assert.Error(t, err, "should not accept new connections after shutdown")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err, "active connection should have been closed")
+
+	assert.NoError(t, s.Shutdown(context.Background()), "shutting down again should be a no-op")
+}
+
 //
 // Auxiliary functions
 //
@@ -37,6 +37,22 @@ func NewCipherListWithConfigs(configs []CipherConfig) (service.CipherList, error
 // UpdateCipherList replaces the contents of the given cipherList with the
 // configuration given.
 func UpdateCipherList(cipherList service.CipherList, configs []CipherConfig) error {
+	list, err := newCipherEntries(configs)
+	if err != nil {
+		return err
+	}
+	cipherList.Update(list)
+	return nil
+}
+
+// ValidateCipherConfigs checks that a cipher list could be created from the
+// configuration given.
+func ValidateCipherConfigs(configs []CipherConfig) error {
+	_, err := newCipherEntries(configs)
+	return err
+}
+
+func newCipherEntries(configs []CipherConfig) (*list.List, error) {
 	list := list.New()
 	for _, config := range configs {
 		cipher := config.Cipher
@@ -44,15 +60,14 @@ func UpdateCipherList(cipherList service.CipherList, configs []CipherConfig) err
 			cipher = DefaultCipher
 		}
 		if config.Secret == "" {
-			return fmt.Errorf("Secret was not specified for cipher %s", config.ID)
+			return nil, fmt.Errorf("Secret was not specified for cipher %s", config.ID)
 		}
 		ci, err := shadowsocks.NewEncryptionKey(cipher, config.Secret)
 		if err != nil {
-			return fmt.Errorf("Failed to create cipher entry (%v, %v, %v) : %w", config.ID, config.Cipher, config.Secret, err)
+			return nil, fmt.Errorf("Failed to create cipher entry (%v, %v, %v) : %w", config.ID, config.Cipher, config.Secret, err)
 		}
 		entry := service.MakeCipherEntry(config.ID, ci, config.Secret)
 		list.PushBack(&entry)
 	}
-	cipherList.Update(list)
-	return nil
+	return list, nil
 }
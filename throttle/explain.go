@@ -0,0 +1,29 @@
+package throttle
+
+import (
+	"fmt"
+)
+
+// Explanation describes how settings were selected for a device.
+type Explanation struct {
+	// Segment is the segment between 0 and 1 into which the device falls.
+	Segment float64 `json:"segment"`
+
+	// Settings are the selected settings, or nil if the device isn't
+	// throttled.
+	Settings *Settings `json:"settings"`
+
+	// Trace lists each step of the selection, including fallbacks to default
+	// countries, platforms and app names.
+	Trace []string `json:"trace"`
+}
+
+// Explain selects settings for the given device the same way that
+// Config.SettingsFor does, recording each step along the way.
+func (sbcap SettingsByCountryAndPlatform) Explain(deviceID, countryCode, platform, appName string, supportedDataCaps []string) *Explanation {
+	explanation := &Explanation{Segment: deviceSegment(deviceID)}
+	explanation.Settings = sbcap.selectSettings(deviceID, countryCode, platform, appName, supportedDataCaps, func(msg string, args ...interface{}) {
+		explanation.Trace = append(explanation.Trace, fmt.Sprintf(msg, args...))
+	})
+	return explanation
+}
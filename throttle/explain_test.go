@@ -0,0 +1,33 @@
+package throttle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExplain(t *testing.T) {
+	sbcap, err := decodeSettingsByCountryAndPlatform([]byte(goodSettings))
+	require.NoError(t, err)
+
+	explanation := sbcap.Explain(deviceIDInSegment2, "de", "windows", "lantern", []string{"monthly", "weekly"})
+	require.NotNil(t, explanation.Settings)
+	assert.Equal(t, "cohort 4", explanation.Settings.Label)
+	assert.InDelta(t, 0.914739, explanation.Segment, 0.000001)
+	assert.Equal(t, []string{
+		"No settings found for country de, use default",
+		"Found 2 settings for platform windows",
+		"Device 78 is in segment 0.914739",
+	}, explanation.Trace[:3])
+	assert.Contains(t, explanation.Trace, "No applicable settings found for app name lantern, trying with no app name")
+	assert.Contains(t, explanation.Trace[len(explanation.Trace)-1], "Selected cohort 4")
+
+	explanation = sbcap.Explain(deviceIDInSegment1, "cn", "windows", "", []string{"daily"})
+	assert.Nil(t, explanation.Settings)
+	assert.Equal(t, "No applicable settings found, not throttling", explanation.Trace[len(explanation.Trace)-1])
+
+	settings, ok := (&refreshingConfig{settings: sbcap}).SettingsFor(deviceIDInSegment2, "de", "windows", "lantern", []string{"monthly", "weekly"})
+	assert.True(t, ok)
+	assert.Same(t, settings, sbcap.Explain(deviceIDInSegment2, "de", "windows", "lantern", []string{"monthly", "weekly"}).Settings, "Explain should select the same settings as SettingsFor")
+}
@@ -0,0 +1,210 @@
+package throttle
+
+import (
+	"strings"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+const timeOfDayLayout = "15:04"
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ScheduleWindow overrides the Threshold and/or Rate of the Settings it belongs
+// to at certain times of the day and days of the week, in the client's local
+// time. For example, this lifts the cap overnight:
+//
+//	{"start": "23:00", "end": "07:00", "threshold": 0}
+type ScheduleWindow struct {
+	// Days on which the window starts, as lowercase 3-letter abbreviations
+	// ("mon", "tue", ...). Leave empty to apply every day.
+	Days []string
+
+	// Start (inclusive) and End (exclusive) of the window as "HH:MM". If End
+	// is before Start, the window continues past midnight into the next day.
+	Start string
+	End   string
+
+	// Threshold, if set, replaces the Threshold of the Settings during this
+	// window. 0 turns the cap off.
+	Threshold *int64
+
+	// Rate, if set, replaces the Rate and any Tiers of the Settings during
+	// this window.
+	Rate *int64
+}
+
+func (window *ScheduleWindow) validate(settings *Settings) error {
+	start, err := parseTimeOfDay(window.Start)
+	if err != nil {
+		return errors.New("Invalid start %q: %v", window.Start, err)
+	}
+	end, err := parseTimeOfDay(window.End)
+	if err != nil {
+		return errors.New("Invalid end %q: %v", window.End, err)
+	}
+	if start == end {
+		return errors.New("Schedule window starts and ends at %v", window.Start)
+	}
+	for _, day := range window.Days {
+		if _, ok := weekdays[day]; !ok {
+			return errors.New("Unknown day %q", day)
+		}
+	}
+	if window.Threshold == nil && window.Rate == nil {
+		return errors.New("Schedule window overrides neither threshold nor rate")
+	}
+	if window.Rate != nil && *window.Rate <= 0 {
+		return errors.New("Schedule window rate must be positive")
+	}
+	if active := settings.apply(window); active.Threshold > 0 && active.Rate <= 0 && len(active.Tiers) == 0 {
+		return errors.New("Schedule window throttles without a rate")
+	}
+	return nil
+}
+
+// activeAt determines whether the window is active at the given local time.
+func (window *ScheduleWindow) activeAt(localTime time.Time) bool {
+	start, err := parseTimeOfDay(window.Start)
+	if err != nil {
+		return false
+	}
+	end, err := parseTimeOfDay(window.End)
+	if err != nil {
+		return false
+	}
+	now := time.Duration(localTime.Hour())*time.Hour + time.Duration(localTime.Minute())*time.Minute
+	startDay := localTime.Weekday()
+	if start < end {
+		if now < start || now >= end {
+			return false
+		}
+	} else {
+		// window spans midnight
+		if now < end {
+			// we're in the part after midnight, so the window started yesterday
+			startDay = (startDay + 6) % 7
+		} else if now < start {
+			return false
+		}
+	}
+	if len(window.Days) == 0 {
+		return true
+	}
+	for _, day := range window.Days {
+		if weekdays[day] == startDay {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTimeOfDay(timeOfDay string) (time.Duration, error) {
+	t, err := time.Parse(timeOfDayLayout, timeOfDay)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// apply returns a copy of settings with the overrides from the given window.
+func (settings *Settings) apply(window *ScheduleWindow) *Settings {
+	active := *settings
+	if window.Threshold != nil {
+		active.Threshold = *window.Threshold
+	}
+	if window.Rate != nil {
+		active.Rate = *window.Rate
+		active.Tiers = nil
+	}
+	return &active
+}
+
+// ActiveAt returns the settings that apply at the given time in the client's
+// local time zone. If one of the Schedule windows is active, this returns a
+// copy of the settings with that window's overrides, otherwise it returns the
+// settings unchanged. When windows overlap, the first one wins.
+func (settings *Settings) ActiveAt(localTime time.Time) *Settings {
+	for _, window := range settings.Schedule {
+		if window.activeAt(localTime) {
+			return settings.apply(window)
+		}
+	}
+	return settings
+}
+
+// LocalTime converts now into the time zone of the client. timeZone is the
+// IANA time zone reported by the client. If it's missing or invalid, this
+// falls back to the main time zone of the given country, and finally to UTC.
+func LocalTime(now time.Time, timeZone, countryCode string) time.Time {
+	if timeZone != "" {
+		if loc, err := time.LoadLocation(timeZone); err == nil {
+			return now.In(loc)
+		}
+	}
+	if timeZone = countryTimeZones[strings.ToLower(countryCode)]; timeZone != "" {
+		if loc, err := time.LoadLocation(timeZone); err == nil {
+			return now.In(loc)
+		}
+	}
+	return now.In(time.UTC)
+}
+
+// countryTimeZones maps countries to their main time zone, used when clients
+// don't report their own time zone. For countries spanning several zones, this
+// is the zone of the capital.
+var countryTimeZones = map[string]string{
+	"ae": "Asia/Dubai",
+	"af": "Asia/Kabul",
+	"ar": "America/Argentina/Buenos_Aires",
+	"au": "Australia/Sydney",
+	"az": "Asia/Baku",
+	"bd": "Asia/Dhaka",
+	"br": "America/Sao_Paulo",
+	"by": "Europe/Minsk",
+	"ca": "America/Toronto",
+	"cn": "Asia/Shanghai",
+	"cu": "America/Havana",
+	"de": "Europe/Berlin",
+	"eg": "Africa/Cairo",
+	"es": "Europe/Madrid",
+	"et": "Africa/Addis_Ababa",
+	"fr": "Europe/Paris",
+	"gb": "Europe/London",
+	"hk": "Asia/Hong_Kong",
+	"id": "Asia/Jakarta",
+	"in": "Asia/Kolkata",
+	"iq": "Asia/Baghdad",
+	"ir": "Asia/Tehran",
+	"jp": "Asia/Tokyo",
+	"kr": "Asia/Seoul",
+	"kz": "Asia/Almaty",
+	"lk": "Asia/Colombo",
+	"mm": "Asia/Yangon",
+	"mx": "America/Mexico_City",
+	"my": "Asia/Kuala_Lumpur",
+	"ng": "Africa/Lagos",
+	"pk": "Asia/Karachi",
+	"ph": "Asia/Manila",
+	"ru": "Europe/Moscow",
+	"sa": "Asia/Riyadh",
+	"sy": "Asia/Damascus",
+	"th": "Asia/Bangkok",
+	"tm": "Asia/Ashgabat",
+	"tr": "Europe/Istanbul",
+	"tw": "Asia/Taipei",
+	"ua": "Europe/Kiev",
+	"us": "America/New_York",
+	"uz": "Asia/Tashkent",
+	"ve": "America/Caracas",
+	"vn": "Asia/Ho_Chi_Minh",
+}
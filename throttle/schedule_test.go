@@ -0,0 +1,92 @@
+package throttle
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata" // so that results don't depend on the system's time zone database
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const scheduledSettings = `
+{
+	"default": {
+		"default": [
+			{"label": "scheduled", "threshold": 1000, "rate": 100, "capResets": "monthly", "schedule": [
+				{"start": "23:00", "end": "07:00", "threshold": 0},
+				{"days": ["sat", "sun"], "start": "18:00", "end": "22:00", "rate": 50}
+			]}
+		]
+	}
+}`
+
+func TestScheduleActiveAt(t *testing.T) {
+	sbcap, err := decodeSettingsByCountryAndPlatform([]byte(scheduledSettings))
+	require.NoError(t, err)
+	require.NoError(t, sbcap.Validate())
+	settings := sbcap["default"]["default"][0]
+
+	at := func(day int, hour, minute int) *Settings {
+		// January 1st 2023 was a Sunday
+		return settings.ActiveAt(time.Date(2023, 1, day, hour, minute, 0, 0, time.UTC))
+	}
+
+	assert.Same(t, settings, at(2, 12, 0), "no window should be active on Monday at noon")
+	assert.EqualValues(t, 0, at(2, 23, 0).Threshold, "overnight window should start at 23:00")
+	assert.EqualValues(t, 100, at(2, 23, 0).Rate, "overnight window shouldn't change the rate")
+	assert.EqualValues(t, 0, at(3, 6, 59).Threshold, "overnight window should continue past midnight")
+	assert.Same(t, settings, at(3, 7, 0), "overnight window should end at 07:00")
+
+	assert.EqualValues(t, 50, at(1, 18, 0).Rate, "weekend window should apply on Sunday")
+	assert.EqualValues(t, 1000, at(1, 18, 0).Threshold, "weekend window shouldn't change the threshold")
+	assert.Same(t, settings, at(2, 18, 0), "weekend window shouldn't apply on Monday")
+	assert.EqualValues(t, 1000, settings.Threshold, "applying a window shouldn't modify the settings")
+}
+
+func TestScheduleSpanningMidnightOnDays(t *testing.T) {
+	threshold := int64(0)
+	settings := &Settings{Label: "l", Threshold: 1000, Rate: 100, CapResets: Monthly, Schedule: []*ScheduleWindow{
+		{Days: []string{"fri"}, Start: "22:00", End: "02:00", Threshold: &threshold},
+	}}
+	require.NoError(t, settings.Validate())
+	// January 6th 2023 was a Friday
+	assert.EqualValues(t, 0, settings.ActiveAt(time.Date(2023, 1, 7, 1, 0, 0, 0, time.UTC)).Threshold, "window started on Friday should continue into Saturday")
+	assert.EqualValues(t, 1000, settings.ActiveAt(time.Date(2023, 1, 8, 1, 0, 0, 0, time.UTC)).Threshold, "window shouldn't apply after midnight on Saturday")
+}
+
+func TestScheduleValidate(t *testing.T) {
+	rate := int64(10)
+	zero := int64(0)
+	threshold := int64(500)
+	for _, window := range []*ScheduleWindow{
+		{Start: "25:00", End: "07:00", Rate: &rate},
+		{Start: "07:00", End: "7pm", Rate: &rate},
+		{Start: "07:00", End: "07:00", Rate: &rate},
+		{Days: []string{"Monday"}, Start: "07:00", End: "08:00", Rate: &rate},
+		{Start: "07:00", End: "08:00"},
+		{Start: "07:00", End: "08:00", Rate: &zero},
+	} {
+		settings := &Settings{Label: "l", Threshold: 1000, Rate: 100, CapResets: Monthly, Schedule: []*ScheduleWindow{window}}
+		assert.Error(t, settings.Validate(), "%+v should be invalid", window)
+	}
+
+	uncapped := &Settings{Label: "l", CapResets: Monthly, Schedule: []*ScheduleWindow{
+		{Start: "18:00", End: "22:00", Threshold: &threshold},
+	}}
+	assert.Error(t, uncapped.Validate(), "window that caps without a rate should be invalid")
+	uncapped.Schedule[0].Rate = &rate
+	assert.NoError(t, uncapped.Validate())
+}
+
+func TestLocalTime(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	offset := func(localTime time.Time) time.Duration {
+		_, seconds := localTime.Zone()
+		return time.Duration(seconds) * time.Second
+	}
+	assert.Equal(t, 8*time.Hour, offset(LocalTime(now, "Asia/Shanghai", "ir")), "client time zone should take precedence")
+	assert.Equal(t, 3*time.Hour+30*time.Minute, offset(LocalTime(now, "", "IR")), "should fall back to country time zone")
+	assert.Equal(t, 8*time.Hour, offset(LocalTime(now, "Not/AZone", "cn")), "should fall back to country time zone for invalid client time zone")
+	assert.Equal(t, time.Duration(0), offset(LocalTime(now, "", "")), "should fall back to UTC")
+}
@@ -0,0 +1,122 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+
+	"github.com/getlantern/errors"
+)
+
+// errUnchanged is returned by settingsSource.load when the settings haven't
+// changed since they were last loaded.
+var errUnchanged = errors.New("unchanged")
+
+// settingsSource is somewhere from which encoded
+// SettingsByCountryAndPlatform can be loaded.
+type settingsSource interface {
+	// load returns the encoded settings, or errUnchanged if they haven't
+	// changed since the last successful load.
+	load() ([]byte, error)
+
+	String() string
+}
+
+type redisSource struct {
+	rc  *redis.Client
+	ctx context.Context
+}
+
+func (src *redisSource) load() ([]byte, error) {
+	return src.rc.Get(src.ctx, "_throttle").Bytes()
+}
+
+func (src *redisSource) String() string {
+	return "redis"
+}
+
+// NewFileConfig returns a new Config that loads its settings from the JSON
+// file at the given path and checks the file for changes every
+// refreshInterval.
+func NewFileConfig(path string, refreshInterval time.Duration) Config {
+	return newRefreshingConfig(&fileSource{path: path}, refreshInterval)
+}
+
+type fileSource struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+func (src *fileSource) load() ([]byte, error) {
+	info, err := os.Stat(src.path)
+	if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(src.modTime) && info.Size() == src.size {
+		return nil, errUnchanged
+	}
+	encoded, err := os.ReadFile(src.path)
+	if err != nil {
+		return nil, err
+	}
+	src.modTime, src.size = info.ModTime(), info.Size()
+	return encoded, nil
+}
+
+func (src *fileSource) String() string {
+	return src.path
+}
+
+// NewHTTPConfig returns a new Config that loads its settings from the given
+// URL every refreshInterval. If the server supports ETags, settings are only
+// downloaded when they've changed.
+func NewHTTPConfig(url string, refreshInterval time.Duration) Config {
+	return newRefreshingConfig(&httpSource{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}, refreshInterval)
+}
+
+type httpSource struct {
+	url    string
+	client *http.Client
+	etag   string
+}
+
+func (src *httpSource) load() ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, src.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if src.etag != "" {
+		req.Header.Set("If-None-Match", src.etag)
+	}
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, errUnchanged
+	case http.StatusOK:
+		encoded, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		src.etag = resp.Header.Get("ETag")
+		return encoded, nil
+	default:
+		return nil, errors.New("Unexpected response status %v", resp.Status)
+	}
+}
+
+func (src *httpSource) String() string {
+	return src.url
+}
@@ -0,0 +1,70 @@
+package throttle
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "throttle.json")
+	require.NoError(t, os.WriteFile(path, []byte(goodSettings), 0644))
+
+	cfg := NewFileConfig(path, time.Hour).(*refreshingConfig)
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 4000, 400, "weekly", "initial file")
+
+	require.NoError(t, os.WriteFile(path, []byte(strings.ReplaceAll(goodSettings, "4", "5")), 0644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Second)))
+	cfg.refreshSettings()
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 5000, 500, "weekly", "updated file")
+
+	require.NoError(t, os.WriteFile(path, []byte("blah I'm bad settings blah"), 0644))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second)))
+	cfg.refreshSettings()
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 5000, 500, "weekly", "bad file should keep last good config")
+
+	require.NoError(t, os.Remove(path))
+	cfg.refreshSettings()
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 5000, 500, "weekly", "missing file should keep last good config")
+}
+
+func TestHTTPConfig(t *testing.T) {
+	var settings atomic.Value
+	settings.Store(goodSettings)
+	var downloads int32
+	srv := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		current := settings.Load().(string)
+		etag := `"` + strconv.Itoa(len(current)) + `"`
+		if req.Header.Get("If-None-Match") == etag {
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&downloads, 1)
+		resp.Header().Set("ETag", etag)
+		resp.Write([]byte(current))
+	}))
+	defer srv.Close()
+
+	cfg := NewHTTPConfig(srv.URL, time.Hour).(*refreshingConfig)
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 4000, 400, "weekly", "initial download")
+	cfg.refreshSettings()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&downloads), "unchanged settings shouldn't be downloaded again")
+
+	settings.Store("blah I'm bad settings blah")
+	cfg.refreshSettings()
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 4000, 400, "weekly", "bad download should keep last good config")
+
+	settings.Store(strings.ReplaceAll(goodSettings, "4", "5") + "\n")
+	cfg.refreshSettings()
+	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 5000, 500, "weekly", "updated download")
+	assert.EqualValues(t, 3, atomic.LoadInt32(&downloads))
+}
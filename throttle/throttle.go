@@ -1,8 +1,8 @@
 // Package throttle provides the ability to read throttling configurations from
-// redis. Configurations are stored in redis as maps under the keys
-// "_throttle:desktop" and "_throttle:mobile". The key/value pairs in each map
-// are the 2-digit lowercase ISO-3166 country code plus a pipe-delimited
-// threshold and rate, for example:
+// redis, a local file or an HTTP URL. Configurations are stored in redis as
+// maps under the keys "_throttle:desktop" and "_throttle:mobile". The key/value
+// pairs in each map are the 2-digit lowercase ISO-3166 country code plus a
+// pipe-delimited threshold and rate, for example:
 //
 //   _throttle:mobile
 //     "__"   "524288000|10240"
@@ -41,6 +41,14 @@ const (
 	Legacy  = "legacy" // like Monthly for old clients
 )
 
+// UploadCounting determines whether uploaded bytes count towards the cap.
+type UploadCounting string
+
+const (
+	UploadsCounted   UploadCounting = "counted" // the default
+	UploadsUncounted UploadCounting = "uncounted"
+)
+
 type Settings struct {
 	// Label uniquely identifies this set of settings for reporting purposes
 	Label string
@@ -61,8 +69,24 @@ type Settings struct {
 	// Rate to which to throttle (in bytes per second)
 	Rate int64
 
+	// UploadRate to which to throttle uploads (in bytes per second) once
+	// throttled. If 0, uploads stay at the default rate.
+	UploadRate int64
+
+	// UploadCounting controls whether uploads count towards Threshold, one of
+	// "counted" (the default) or "uncounted"
+	UploadCounting UploadCounting
+
+	// Tiers optionally replace Rate with several rates that apply at
+	// increasing percentages of Threshold, ordered from lowest to highest.
+	Tiers []*Tier
+
 	// How frequently the usage cap resets, one of "daily", "weekly" or "monthly"
 	CapResets CapInterval
+
+	// Schedule optionally overrides Threshold and/or Rate at certain times,
+	// evaluated in the client's local time.
+	Schedule []*ScheduleWindow
 }
 
 func (settings *Settings) Validate() error {
@@ -74,13 +98,40 @@ func (settings *Settings) Validate() error {
 		return errors.New("Unknown CapResets interval %v: ", settings.CapResets)
 	}
 
-	if settings.Threshold > 0 && settings.Rate <= 0 {
+	if settings.Threshold > 0 && settings.Rate <= 0 && len(settings.Tiers) == 0 {
 		return errors.New("Throttling threshold specified without a rate")
 	}
 
+	if settings.UploadRate < 0 {
+		return errors.New("Negative upload rate %d", settings.UploadRate)
+	}
+
+	if settings.UploadCounting != "" && settings.UploadCounting != UploadsCounted && settings.UploadCounting != UploadsUncounted {
+		return errors.New("Unknown UploadCounting %v", settings.UploadCounting)
+	}
+
+	if err := validateTiers(settings); err != nil {
+		return err
+	}
+
+	for i, window := range settings.Schedule {
+		if err := window.validate(settings); err != nil {
+			return errors.New("Invalid schedule window %d: %v", i, err)
+		}
+	}
+
 	return nil
 }
 
+// CountedBytes returns how many of the given bytes uploaded (bytesIn) and
+// downloaded (bytesOut) count towards Threshold.
+func (settings *Settings) CountedBytes(bytesIn, bytesOut int64) int64 {
+	if settings.UploadCounting == UploadsUncounted {
+		return bytesOut
+	}
+	return bytesIn + bytesOut
+}
+
 // Config is a per-country throttling config
 type Config interface {
 	// SettingsFor returns the throttling settings for the given deviceID in the given
@@ -89,6 +140,9 @@ type Config interface {
 	// supportedDataCaps identifies which cap intervals the client supports ("daily", "weekly" or "monthly").
 	// If this list is empty, the client is assumed to support "monthly" (legacy clients).
 	SettingsFor(deviceID, countryCode, platform, appName string, supportedDataCaps []string) (settings *Settings, ok bool)
+
+	// AllSettings returns all of the settings currently known to this Config.
+	AllSettings() SettingsByCountryAndPlatform
 }
 
 // NewForcedConfig returns a new Config that uses the forced threshold, rate and TTL
@@ -111,6 +165,14 @@ func (cfg *forcedConfig) SettingsFor(deviceID, countryCode, platform, appName st
 	return &cfg.Settings, true
 }
 
+// AllSettings returns the forced settings as the default for all countries and
+// platforms.
+func (cfg *forcedConfig) AllSettings() SettingsByCountryAndPlatform {
+	return SettingsByCountryAndPlatform{
+		"default": {"default": {&cfg.Settings}},
+	}
+}
+
 // SettingsByCountryAndPlatform organizes slices of SettingsWithConstraints by
 // country -> platform
 type SettingsByCountryAndPlatform map[string]map[string][]*Settings
@@ -135,45 +197,67 @@ func decodeSettingsByCountryAndPlatform(encoded []byte) (settings SettingsByCoun
 	return
 }
 
-type redisConfig struct {
-	rc              *redis.Client
+// refreshingConfig is a Config that periodically reloads its settings from a
+// settingsSource, keeping the last good settings if loading or decoding fails.
+type refreshingConfig struct {
+	source          settingsSource
 	refreshInterval time.Duration
 	settings        SettingsByCountryAndPlatform
 	mx              sync.RWMutex
-	ctx             context.Context
 }
 
 // NewRedisConfig returns a new Config that uses the given redis client to load
 // its configuration information and reload that information every
 // refreshInterval.
 func NewRedisConfig(rc *redis.Client, refreshInterval time.Duration) Config {
-	cfg := &redisConfig{
-		rc:              rc,
+	return newRefreshingConfig(&redisSource{rc: rc, ctx: context.Background()}, refreshInterval)
+}
+
+func newRefreshingConfig(source settingsSource, refreshInterval time.Duration) *refreshingConfig {
+	cfg := &refreshingConfig{
+		source:          source,
 		refreshInterval: refreshInterval,
-		ctx:             context.Background(),
 	}
 	cfg.refreshSettings()
 	go cfg.keepCurrent()
 	return cfg
 }
 
-func (cfg *redisConfig) keepCurrent() {
-	if cfg.refreshInterval <= 0 {
-		log.Debugf("Defaulting refresh interval to %v", DefaultRefreshInterval)
-		cfg.refreshInterval = DefaultRefreshInterval
-	}
-
-	log.Debugf("Refreshing every %v", cfg.refreshInterval)
+func (cfg *refreshingConfig) keepCurrent() {
+	cfg.SetRefreshInterval(cfg.refreshInterval)
 	for {
-		time.Sleep(cfg.refreshInterval)
+		time.Sleep(cfg.getRefreshInterval())
 		cfg.refreshSettings()
 	}
 }
 
-func (cfg *redisConfig) refreshSettings() {
-	encoded, err := cfg.rc.Get(cfg.ctx, "_throttle").Bytes()
+// SetRefreshInterval changes how frequently the configuration is reloaded from
+// its source. The new interval takes effect after the next refresh.
+func (cfg *refreshingConfig) SetRefreshInterval(refreshInterval time.Duration) {
+	if refreshInterval <= 0 {
+		log.Debugf("Defaulting refresh interval to %v", DefaultRefreshInterval)
+		refreshInterval = DefaultRefreshInterval
+	}
+	log.Debugf("Refreshing every %v", refreshInterval)
+	cfg.mx.Lock()
+	cfg.refreshInterval = refreshInterval
+	cfg.mx.Unlock()
+}
+
+func (cfg *refreshingConfig) getRefreshInterval() time.Duration {
+	cfg.mx.RLock()
+	defer cfg.mx.RUnlock()
+	return cfg.refreshInterval
+}
+
+func (cfg *refreshingConfig) refreshSettings() {
+	encoded, err := cfg.source.load()
+	if err == errUnchanged {
+		log.Tracef("Throttle settings in %v unchanged", cfg.source)
+		return
+	}
 	if err != nil {
-		log.Errorf("Unable to load throttle settings from redis: %v", err)
+		log.Errorf("Unable to load throttle settings from %v: %v", cfg.source, err)
 		return
 	}
 	settings, err := decodeSettingsByCountryAndPlatform(encoded)
@@ -189,29 +273,51 @@ func (cfg *redisConfig) refreshSettings() {
 	cfg.mx.Unlock()
 }
 
-func (cfg *redisConfig) SettingsFor(deviceID, countryCode, platform, appName string, supportedDataCaps []string) (*Settings, bool) {
+// AllSettings returns the settings most recently loaded from the source.
+func (cfg *refreshingConfig) AllSettings() SettingsByCountryAndPlatform {
+	cfg.mx.RLock()
+	defer cfg.mx.RUnlock()
+	return cfg.settings
+}
+
+func (cfg *refreshingConfig) SettingsFor(deviceID, countryCode, platform, appName string, supportedDataCaps []string) (*Settings, bool) {
 	cfg.mx.RLock()
 	settings := cfg.settings
 	cfg.mx.RUnlock()
 
-	platformSettings := settings[strings.ToLower(countryCode)]
+	trace := func(string, ...interface{}) {}
+	if log.IsTraceEnabled() {
+		trace = log.Tracef
+	}
+	result := settings.selectSettings(deviceID, countryCode, platform, appName, supportedDataCaps, trace)
+	return result, result != nil
+}
+
+// selectSettings implements SettingsFor, describing each step of the selection
+// to trace.
+func (sbcap SettingsByCountryAndPlatform) selectSettings(deviceID, countryCode, platform, appName string, supportedDataCaps []string, trace func(string, ...interface{})) *Settings {
+	platformSettings := sbcap[strings.ToLower(countryCode)]
 	if platformSettings == nil {
-		log.Tracef("No settings found for country %v, use default", countryCode)
-		platformSettings = settings["default"]
+		trace("No settings found for country %v, use default", countryCode)
+		platformSettings = sbcap["default"]
 		if platformSettings == nil {
-			log.Trace("No settings for default country, not throttling")
-			return nil, false
+			trace("No settings for default country, not throttling")
+			return nil
 		}
+	} else {
+		trace("Found settings for country %v", countryCode)
 	}
 
 	constrainedSettings := platformSettings[strings.ToLower(platform)]
 	if len(constrainedSettings) == 0 {
-		log.Tracef("No settings found for platform %v, use default", platform)
+		trace("No settings found for platform %v, use default", platform)
 		constrainedSettings = platformSettings["default"]
 		if len(constrainedSettings) == 0 {
-			log.Trace("No settings for default platform, not throttling")
-			return nil, false
+			trace("No settings for default platform, not throttling")
+			return nil
 		}
+	} else {
+		trace("Found %d settings for platform %v", len(constrainedSettings), platform)
 	}
 
 	clientSupportsInterval := func(requested CapInterval) bool {
@@ -227,28 +333,30 @@ func (cfg *redisConfig) SettingsFor(deviceID, countryCode, platform, appName str
 		return false
 	}
 
-	hash := murmur3.New64()
-	hash.Write([]byte(deviceID))
-	hashOfDeviceID := hash.Sum64()
-	const scale = 1000000 // do not change this, as it will result in users being segmented differently than they were before
-	segment := float64((hashOfDeviceID % scale)) / float64(scale)
+	segment := deviceSegment(deviceID)
+	trace("Device %v is in segment %v", deviceID, segment)
 
 	settingsForAppName := func(checkAppName string) *Settings {
 		for _, candidateSettings := range constrainedSettings {
-			if clientSupportsInterval(candidateSettings.CapResets) {
-				appMatches := candidateSettings.AppName == checkAppName
-				deviceMatches := candidateSettings.DeviceFloor <= segment && (candidateSettings.DeviceCeil > segment || (candidateSettings.DeviceCeil == 1 && segment == 1))
-				if appMatches && deviceMatches {
-					return candidateSettings
-				}
+			if !clientSupportsInterval(candidateSettings.CapResets) {
+				trace("Skipping %v, client doesn't support cap interval %v", candidateSettings.Label, candidateSettings.CapResets)
+				continue
+			}
+			appMatches := candidateSettings.AppName == checkAppName
+			deviceMatches := candidateSettings.DeviceFloor <= segment && (candidateSettings.DeviceCeil > segment || (candidateSettings.DeviceCeil == 1 && segment == 1))
+			if appMatches && deviceMatches {
+				trace("Selected %v for app name %q and segment [%v, %v)", candidateSettings.Label, checkAppName, candidateSettings.DeviceFloor, candidateSettings.DeviceCeil)
+				return candidateSettings
 			}
+			trace("Skipping %v, app name %q matches: %v, segment [%v, %v) matches: %v", candidateSettings.Label, candidateSettings.AppName, appMatches, candidateSettings.DeviceFloor, candidateSettings.DeviceCeil, deviceMatches)
 		}
 
-		log.Tracef("No setting for segment %v, using first supported in list", segment)
+		trace("No setting for segment %v, using first supported in list", segment)
 		for _, candidateSettings := range constrainedSettings {
 			if clientSupportsInterval(candidateSettings.CapResets) {
 				appMatches := candidateSettings.AppName == checkAppName
 				if appMatches {
+					trace("Selected %v for app name %q regardless of segment", candidateSettings.Label, checkAppName)
 					return candidateSettings
 				}
 			}
@@ -259,9 +367,22 @@ func (cfg *redisConfig) SettingsFor(deviceID, countryCode, platform, appName str
 
 	result := settingsForAppName(appName)
 	if result == nil && appName != "" {
-		log.Tracef("No applicable settings found for app name %v, trying with no app name", appName)
+		trace("No applicable settings found for app name %v, trying with no app name", appName)
 		result = settingsForAppName("")
 	}
+	if result == nil {
+		trace("No applicable settings found, not throttling")
+	}
 
-	return result, result != nil
+	return result
+}
+
+// deviceSegment deterministically maps the given deviceID to a number between
+// 0 and 1, used to split devices into cohorts.
+func deviceSegment(deviceID string) float64 {
+	hash := murmur3.New64()
+	hash.Write([]byte(deviceID))
+	hashOfDeviceID := hash.Sum64()
+	const scale = 1000000 // do not change this, as it will result in users being segmented differently than they were before
+	return float64((hashOfDeviceID % scale)) / float64(scale)
 }
@@ -135,3 +135,23 @@ func TestFailToConnectRedis(t *testing.T) {
 	// Should load the config when Redis is back up online
 	doTest(t, cfg, deviceIDInSegment1, "cn", "windows", "lantern", []string{"monthly", "weekly"}, 4000, 400, "weekly", "known country, known platform, segment 1, redis back online")
 }
+
+func TestUploadSettings(t *testing.T) {
+	sbcap, err := decodeSettingsByCountryAndPlatform([]byte(`{"default": {"default": [
+		{"label": "uploads", "threshold": 1000, "rate": 100, "uploadRate": 50, "uploadCounting": "uncounted", "capResets": "monthly"}
+	]}}`))
+	require.NoError(t, err)
+	require.NoError(t, sbcap.Validate())
+	settings := sbcap["default"]["default"][0]
+	require.EqualValues(t, 50, settings.UploadRate)
+	require.EqualValues(t, 700, settings.CountedBytes(300, 700), "uploads shouldn't count towards the cap")
+
+	settings.UploadCounting = ""
+	require.EqualValues(t, 1000, settings.CountedBytes(300, 700), "uploads should count by default")
+
+	settings.UploadCounting = "sometimes"
+	require.Error(t, settings.Validate())
+	settings.UploadCounting = UploadsCounted
+	settings.UploadRate = -1
+	require.Error(t, settings.Validate())
+}
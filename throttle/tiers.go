@@ -0,0 +1,63 @@
+package throttle
+
+import (
+	"github.com/getlantern/errors"
+)
+
+// Tier throttles devices to Rate once their usage exceeds Percent of the
+// Threshold of the Settings it belongs to. Tiers let throttling degrade
+// gradually, for example:
+//
+//	"tiers": [
+//		{"percent": 80, "rate": 262144},
+//		{"percent": 100, "rate": 65536},
+//		{"percent": 150, "rate": 8192}
+//	]
+type Tier struct {
+	// Percent of Threshold above which this tier applies
+	Percent int64
+
+	// Rate to which to throttle (in bytes per second)
+	Rate int64
+}
+
+func validateTiers(settings *Settings) error {
+	var previous int64
+	for i, tier := range settings.Tiers {
+		if tier == nil {
+			return errors.New("Tier %d is empty", i)
+		}
+		if tier.Percent <= previous {
+			return errors.New("Tier %d percent %d must be positive and greater than that of the previous tier", i, tier.Percent)
+		}
+		if tier.Rate <= 0 {
+			return errors.New("Tier %d has no rate", i)
+		}
+		previous = tier.Percent
+	}
+	return nil
+}
+
+// TierFor returns the tier that applies to a device that has used the given
+// number of bytes, along with the rate to which to throttle it. Tiers are
+// numbered starting at 1, with 0 meaning that the device isn't throttled. If
+// no Tiers are configured, the settings behave like a single tier at 100% of
+// Threshold with the given Rate.
+func (settings *Settings) TierFor(bytes int64) (tier int, rate int64) {
+	if settings.Threshold <= 0 {
+		return 0, 0
+	}
+	if len(settings.Tiers) == 0 {
+		if bytes > settings.Threshold {
+			return 1, settings.Rate
+		}
+		return 0, 0
+	}
+	for i := len(settings.Tiers) - 1; i >= 0; i-- {
+		t := settings.Tiers[i]
+		if bytes > settings.Threshold*t.Percent/100 {
+			return i + 1, t.Rate
+		}
+	}
+	return 0, 0
+}
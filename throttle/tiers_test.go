@@ -0,0 +1,82 @@
+package throttle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const tieredSettings = `
+{
+	"default": {
+		"default": [
+			{"label": "tiered", "threshold": 1000, "capResets": "monthly", "tiers": [
+				{"percent": 80, "rate": 200},
+				{"percent": 100, "rate": 50},
+				{"percent": 150, "rate": 8}
+			]}
+		]
+	}
+}`
+
+func TestTierFor(t *testing.T) {
+	sbcap, err := decodeSettingsByCountryAndPlatform([]byte(tieredSettings))
+	require.NoError(t, err)
+	require.NoError(t, sbcap.Validate())
+	settings := sbcap["default"]["default"][0]
+
+	for _, tc := range []struct {
+		bytes int64
+		tier  int
+		rate  int64
+	}{
+		{0, 0, 0},
+		{800, 0, 0},
+		{801, 1, 200},
+		{1000, 1, 200},
+		{1001, 2, 50},
+		{1501, 3, 8},
+	} {
+		tier, rate := settings.TierFor(tc.bytes)
+		assert.Equal(t, tc.tier, tier, "wrong tier for %d bytes", tc.bytes)
+		assert.Equal(t, tc.rate, rate, "wrong rate for %d bytes", tc.bytes)
+	}
+
+	legacy := &Settings{Label: "l", Threshold: 1000, Rate: 100, CapResets: Monthly}
+	tier, rate := legacy.TierFor(1000)
+	assert.Equal(t, 0, tier)
+	tier, rate = legacy.TierFor(1001)
+	assert.Equal(t, 1, tier, "settings without tiers should act as a single tier")
+	assert.EqualValues(t, 100, rate)
+
+	uncapped := &Settings{Label: "l", CapResets: Monthly, Tiers: settings.Tiers}
+	tier, _ = uncapped.TierFor(1 << 40)
+	assert.Equal(t, 0, tier, "tiers shouldn't apply without a threshold")
+}
+
+func TestTiersValidate(t *testing.T) {
+	for _, tiers := range [][]*Tier{
+		{{Percent: 0, Rate: 10}},
+		{{Percent: 80, Rate: 0}},
+		{{Percent: 100, Rate: 10}, {Percent: 80, Rate: 20}},
+		{{Percent: 100, Rate: 10}, {Percent: 100, Rate: 5}},
+		{nil},
+		{{Percent: 80, Rate: 10}, nil},
+	} {
+		settings := &Settings{Label: "l", Threshold: 1000, CapResets: Monthly, Tiers: tiers}
+		assert.Error(t, settings.Validate(), "%+v should be invalid", tiers)
+	}
+}
+
+func TestScheduleRateReplacesTiers(t *testing.T) {
+	sbcap, err := decodeSettingsByCountryAndPlatform([]byte(tieredSettings))
+	require.NoError(t, err)
+	settings := sbcap["default"]["default"][0]
+	rate := int64(500)
+	active := settings.apply(&ScheduleWindow{Start: "00:00", End: "06:00", Rate: &rate})
+	tier, activeRate := active.TierFor(2000)
+	assert.Equal(t, 1, tier)
+	assert.EqualValues(t, 500, activeRate)
+	assert.Len(t, settings.Tiers, 3, "applying a window shouldn't modify the settings")
+}
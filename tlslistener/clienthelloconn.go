@@ -41,6 +41,9 @@ var (
 		action: "AlertHandshakeFailure",
 		getConfig: func(c *tls.Config) (*tls.Config, error) {
 			clone := c.Clone()
+			// TLS 1.3 cipher suites aren't configurable, so cap the version to
+			// make sure that no cipher suite can be negotiated.
+			clone.MaxVersion = tls.VersionTLS12
 			clone.CipherSuites = []uint16{}
 			return clone, nil
 		}}
@@ -135,7 +138,7 @@ var bytePool = sync.Pool{
 		return make([]byte, reflectBufferSize)
 	}}
 
-func newClientHelloRecordingConn(rawConn net.Conn, cfg *tls.Config, utlsCfg *utls.Config, ticketKeys utls.TicketKeys, missingTicketReaction HandshakeReaction, instrument instrument.Instrument) (*clientHelloRecordingConn, *tls.Config) {
+func newClientHelloRecordingConn(rawConn net.Conn, cfg *tls.Config, utlsCfg *utls.Config, checkTickets bool, ticketKeys utls.TicketKeys, missingTicketReaction HandshakeReaction, ticketEnforcement *TicketEnforcement, replayCache *ReplayCache, instrument instrument.Instrument) (*clientHelloRecordingConn, *tls.Config) {
 	buf := bufferPool.Get().(*bytes.Buffer)
 	cfgClone := cfg.Clone()
 	rrc := &clientHelloRecordingConn{
@@ -143,11 +146,14 @@ func newClientHelloRecordingConn(rawConn net.Conn, cfg *tls.Config, utlsCfg *utl
 		dataRead:              buf,
 		log:                   golog.LoggerFor("clienthello-conn"),
 		cfg:                   cfgClone,
+		checkTickets:          checkTickets,
 		ticketKeys:            ticketKeys,
 		activeReader:          io.TeeReader(rawConn, buf),
 		helloMutex:            &sync.Mutex{},
 		utlsCfg:               utlsCfg,
 		missingTicketReaction: missingTicketReaction,
+		ticketEnforcement:     ticketEnforcement,
+		replayCache:           replayCache,
 		instrument:            instrument,
 	}
 	cfgClone.GetConfigForClient = rrc.processHello
@@ -163,10 +169,14 @@ type clientHelloRecordingConn struct {
 	helloMutex            *sync.Mutex
 	cfg                   *tls.Config
 	utlsCfg               *utls.Config
+	checkTickets          bool
 	ticketKeys            utls.TicketKeys
 	missingTicketReaction HandshakeReaction
+	ticketEnforcement     *TicketEnforcement
+	replayCache           *ReplayCache
 	instrument            instrument.Instrument
 	probingError          string
+	fingerprints          *ClientHelloFingerprints
 }
 
 func (rrc *clientHelloRecordingConn) Read(b []byte) (int, error) {
@@ -184,17 +194,30 @@ func (rrc *clientHelloRecordingConn) processHello(info *tls.ClientHelloInfo) (*t
 	}()
 
 	hello := rrc.dataRead.Bytes()[5:]
+	sourceIP := rrc.remoteIP()
+	fingerprints, err := fingerprintClientHello(hello)
+	if err != nil {
+		rrc.log.Debugf("Unable to fingerprint ClientHello from %v: %v", sourceIP, err)
+	} else {
+		rrc.helloMutex.Lock()
+		rrc.fingerprints = fingerprints
+		rrc.helloMutex.Unlock()
+		rrc.instrument.ClientHelloFingerprint(context.Background(), sourceIP, fingerprints.JA3, fingerprints.JA4)
+	}
+
+	if !rrc.checkTickets {
+		return nil, nil
+	}
+
 	// We use uTLS here purely because it exposes more TLS handshake internals, allowing
 	// us to decrypt the ClientHello and session tickets, for example. We use those functions
 	// separately without switching to uTLS entirely to allow continued upgrading of the TLS stack
 	// as new Go versions are released.
 	helloMsg := utls.UnmarshalClientHello(hello)
-
 	if helloMsg == nil {
-		return rrc.helloError("malformed ClientHello", false)
+		return rrc.helloError("malformed ClientHello", "")
 	}
 
-	sourceIP := rrc.RemoteAddr().(*net.TCPAddr).IP
 	// We allow loopback to generate session states (makesessions) to
 	// distribute to Lantern clients.
 	if !disallowLoopbackForTesting && sourceIP.IsLoopback() {
@@ -204,37 +227,98 @@ func (rrc *clientHelloRecordingConn) processHello(info *tls.ClientHelloInfo) (*t
 	// Otherwise, we want to make sure that the client is using resumption with one of our
 	// pre-defined tickets. If it doesn't we should again return some sort of error or just
 	// close the connection.
+	if rrc.allowsTLS13() && offersTLS13(helloMsg.SupportedVersions) && len(helloMsg.PskIdentities) > 0 {
+		// TLS 1.3 clients resume using the pre_shared_key extension, whose
+		// identities are tickets encrypted with the same keys as TLS 1.2 tickets.
+		for _, identity := range helloMsg.PskIdentities {
+			plainText, _ := utls.DecryptTicketWith(identity.Label, rrc.ticketKeys)
+			if len(plainText) > 0 {
+				return rrc.checkReplay(helloMsg.Random, identity.Label)
+			}
+		}
+		return rrc.helloError("ClientHello has invalid pre-shared key", ReasonInvalidTicket)
+	}
+
 	if !helloMsg.TicketSupported {
-		return rrc.helloError("ClientHello does not support session tickets", true)
+		return rrc.helloError("ClientHello does not support session tickets", ReasonNoTicketSupport)
 	}
 
 	if len(helloMsg.SessionTicket) == 0 {
-		return rrc.helloError("ClientHello has no session ticket", true)
+		return rrc.helloError("ClientHello has no session ticket", ReasonNoTicket)
 	}
 
 	plainText, _ := utls.DecryptTicketWith(helloMsg.SessionTicket, rrc.ticketKeys)
 	if len(plainText) == 0 {
-		return rrc.helloError("ClientHello has invalid session ticket", true)
+		return rrc.helloError("ClientHello has invalid session ticket", ReasonInvalidTicket)
 	}
 
+	return rrc.checkReplay(helloMsg.Random, helloMsg.SessionTicket)
+}
+
+// checkReplay treats ClientHellos with valid tickets that were seen before as
+// probing.
+func (rrc *clientHelloRecordingConn) checkReplay(random, ticket []byte) (*tls.Config, error) {
+	if rrc.replayCache.add(random, ticket) {
+		return rrc.helloError("ClientHello replayed", "")
+	}
 	return nil, nil
 }
 
-func (rrc *clientHelloRecordingConn) helloError(errStr string, continueOnError bool) (*tls.Config, error) {
-	sourceIP := rrc.RemoteAddr().(*net.TCPAddr).IP
+// allowsTLS13 determines whether the server can negotiate TLS 1.3 with this
+// client. If it can't, a TLS 1.3 client falls back to resuming with a TLS 1.2
+// session ticket.
+func (rrc *clientHelloRecordingConn) allowsTLS13() bool {
+	return rrc.cfg.MaxVersion == 0 || rrc.cfg.MaxVersion >= tls.VersionTLS13
+}
+
+func offersTLS13(supportedVersions []uint16) bool {
+	for _, version := range supportedVersions {
+		if version == tls.VersionTLS13 {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP of the client, which may be connected over TCP or,
+// like with KCP, over UDP.
+func (rrc *clientHelloRecordingConn) remoteIP() net.IP {
+	switch addr := rrc.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
+// helloError records suspected probing and reacts to it. ticketReason is the
+// reason the ClientHello failed the session ticket check, or empty for
+// malformed and replayed ClientHellos, which always get the
+// missingTicketReaction.
+func (rrc *clientHelloRecordingConn) helloError(errStr string, ticketReason string) (*tls.Config, error) {
+	sourceIP := rrc.remoteIP()
+	rrc.helloMutex.Lock()
 	rrc.probingError = errStr
+	rrc.helloMutex.Unlock()
 	rrc.instrument.SuspectedProbing(context.Background(), sourceIP, errStr)
-	// For now, we just record that there was a problem with the client hello, but we actually
-	// proceed as if everything is fine.
-	// See https://github.com/getlantern/engineering/issues/292#issuecomment-1765268377
-	if continueOnError {
-		return nil, nil
+	reaction := rrc.missingTicketReaction
+	if ticketReason != "" {
+		var enforce bool
+		reaction, enforce = rrc.ticketEnforcement.reactionFor(ticketReason, sourceIP)
+		if !enforce {
+			// Unless enforcement is configured, we just record that there was a problem
+			// with the client hello, but we actually proceed as if everything is fine.
+			// See https://github.com/getlantern/engineering/issues/292#issuecomment-1765268377
+			return nil, nil
+		}
 	}
-	if rrc.missingTicketReaction.handleConn != nil {
-		rrc.missingTicketReaction.handleConn(rrc)
+	if reaction.handleConn != nil {
+		reaction.handleConn(rrc)
 		// at this point the connection has already been closed, returning
 		// whatever to the caller is okay.
 		return nil, nil
 	}
-	return rrc.missingTicketReaction.getConfig(rrc.cfg)
+	return reaction.getConfig(rrc.cfg)
 }
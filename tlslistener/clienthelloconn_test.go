@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"io"
 	"net"
 	"net/http"
 	"testing"
@@ -38,8 +39,8 @@ func TestAbortOnHello(t *testing.T) {
 			l, _ := net.Listen("tcp", ":0")
 			defer l.Close()
 			hl, err := Wrap(
-				l, "../test/data/server.key", "../test/data/server.crt", "../test/testtickets", "", "",
-				true, tc.response, false, instrument.NoInstrument{})
+				l, "../test/data/server.key", "../test/data/server.crt", "../test/testtickets", "", "", nil,
+				true, tc.response, nil, nil, false, instrument.NoInstrument{})
 			require.NoError(t, err)
 			defer hl.Close()
 
@@ -120,8 +121,8 @@ func TestSuccess(t *testing.T) {
 	strKeys := base64.StdEncoding.EncodeToString(sessionTicketKeys)
 
 	hl, err := Wrap(
-		l, "../test/data/server.key", "../test/data/server.crt", "", "", strKeys,
-		true, AlertHandshakeFailure, false, instrument.NoInstrument{})
+		l, "../test/data/server.key", "../test/data/server.crt", "", "", strKeys, nil,
+		true, AlertHandshakeFailure, nil, nil, false, instrument.NoInstrument{})
 	require.NoError(t, err)
 	defer hl.Close()
 
@@ -177,3 +178,288 @@ func TestParseInvalidTicket(t *testing.T) {
 	plainText, _ := utls.DecryptTicketWith(ticket, utls.TicketKeys{utls.TicketKeyFromBytes(tk)})
 	require.Len(t, plainText, 0)
 }
+
+func TestResumeWithSessionTicketTLS12(t *testing.T) {
+	testResumeWithSessionTicket(t, tls.VersionTLS12)
+}
+
+func TestResumeWithPreSharedKeyTLS13(t *testing.T) {
+	testResumeWithSessionTicket(t, tls.VersionTLS13)
+}
+
+func testResumeWithSessionTicket(t *testing.T, version uint16) {
+	disallowLoopbackForTesting = false
+	defer func() {
+		disallowLoopbackForTesting = false
+	}()
+
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+
+	sessionTicketKeys := make([]byte, keySize)
+	_, err := rand.Read(sessionTicketKeys)
+	require.NoError(t, err)
+	strKeys := base64.StdEncoding.EncodeToString(sessionTicketKeys)
+
+	hl, err := Wrap(
+		l, "../test/data/server.key", "../test/data/server.crt", "", "", strKeys, nil,
+		true, AlertHandshakeFailure, nil, nil, true, instrument.NoInstrument{})
+	require.NoError(t, err)
+	defer hl.Close()
+
+	probingErrors := make(chan string, 10)
+	go func() {
+		for {
+			sconn, err := hl.Accept()
+			if err != nil {
+				return
+			}
+			go func(sconn net.Conn) {
+				defer sconn.Close()
+				_, err := http.ReadRequest(bufio.NewReader(sconn))
+				if err != nil {
+					return
+				}
+				probingErrors <- sconn.(ProbingDetectingConn).ProbingError()
+				(&http.Response{StatusCode: http.StatusAccepted}).Write(sconn)
+			}(sconn)
+		}
+	}()
+
+	roundTrip := func(ucfg *utls.Config) (*utls.Conn, string) {
+		conn, err := utls.Dial("tcp", l.Addr().String(), ucfg)
+		require.NoError(t, err)
+		defer conn.Close()
+		req, err := http.NewRequest("GET", "/", nil)
+		require.NoError(t, err)
+		require.NoError(t, req.Write(conn))
+		// reading the response also processes any TLS 1.3 NewSessionTicket
+		// messages sent after the handshake
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusAccepted, resp.StatusCode)
+		select {
+		case probingError := <-probingErrors:
+			return conn, probingError
+		case <-time.After(5 * time.Second):
+			t.Fatal("server didn't handle request")
+			return nil, ""
+		}
+	}
+
+	ucfg := &utls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+		ClientSessionCache: utls.NewLRUClientSessionCache(10),
+	}
+
+	// Dial once over loopback to obtain a valid session ticket
+	conn, probingError := roundTrip(ucfg)
+	require.Equal(t, version, conn.ConnectionState().Version)
+	require.Empty(t, probingError)
+
+	// Now disallow loopback and make sure the ticket is accepted
+	disallowLoopbackForTesting = true
+	conn, probingError = roundTrip(ucfg)
+	require.Equal(t, version, conn.ConnectionState().Version)
+	require.True(t, conn.ConnectionState().DidResume)
+	require.Empty(t, probingError)
+
+	// A client that supports tickets but doesn't have one should be flagged
+	_, probingError = roundTrip(&utls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+		ClientSessionCache: utls.NewLRUClientSessionCache(10),
+	})
+	require.Equal(t, "ClientHello has no session ticket", probingError)
+}
+
+func TestEnforceMissingTicket(t *testing.T) {
+	disallowLoopbackForTesting = true
+	defer func() {
+		disallowLoopbackForTesting = false
+	}()
+
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+	hl, err := Wrap(
+		l, "../test/data/server.key", "../test/data/server.crt", "../test/testtickets", "", "", nil,
+		true, None, &TicketEnforcement{
+			Reactions: map[string]HandshakeReaction{ReasonNoTicket: AlertHandshakeFailure},
+			Percent:   100,
+		}, nil, true, instrument.NoInstrument{})
+	require.NoError(t, err)
+	defer hl.Close()
+
+	go func() {
+		for {
+			sconn, err := hl.Accept()
+			if err != nil {
+				return
+			}
+			go func(sconn net.Conn) {
+				defer sconn.Close()
+				sconn.(*tlsconn).Conn.(*tls.Conn).Handshake()
+			}(sconn)
+		}
+	}()
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		// a session cache makes the client support tickets without having one
+		_, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			ServerName:         "microsoft.com",
+			InsecureSkipVerify: true,
+			MaxVersion:         version,
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		})
+		require.Error(t, err)
+		require.Equal(t, "remote error: tls: handshake failure", err.Error())
+	}
+}
+
+// helloRecordingConn remembers the first write, which is the ClientHello.
+type helloRecordingConn struct {
+	net.Conn
+	hello []byte
+}
+
+func (c *helloRecordingConn) Write(b []byte) (int, error) {
+	if c.hello == nil {
+		c.hello = append([]byte(nil), b...)
+	}
+	return c.Conn.Write(b)
+}
+
+func TestReplayedClientHello(t *testing.T) {
+	disallowLoopbackForTesting = false
+	defer func() {
+		disallowLoopbackForTesting = false
+	}()
+
+	l, _ := net.Listen("tcp", ":0")
+	defer l.Close()
+
+	sessionTicketKeys := make([]byte, keySize)
+	_, err := rand.Read(sessionTicketKeys)
+	require.NoError(t, err)
+	strKeys := base64.StdEncoding.EncodeToString(sessionTicketKeys)
+
+	hl, err := Wrap(
+		l, "../test/data/server.key", "../test/data/server.crt", "", "", strKeys, nil,
+		true, None, nil, NewReplayCache(100, time.Hour), true, instrument.NoInstrument{})
+	require.NoError(t, err)
+	defer hl.Close()
+
+	probingErrors := make(chan string, 10)
+	go func() {
+		for {
+			sconn, err := hl.Accept()
+			if err != nil {
+				return
+			}
+			go func(sconn net.Conn) {
+				defer sconn.Close()
+				err := sconn.(*tlsconn).Conn.(*tls.Conn).Handshake()
+				probingErrors <- sconn.(ProbingDetectingConn).ProbingError()
+				if err == nil {
+					// lets the client receive TLS 1.3 session tickets
+					sconn.Write([]byte("x"))
+				}
+			}(sconn)
+		}
+	}()
+
+	ucfg := &utls.Config{
+		InsecureSkipVerify: true,
+		ClientSessionCache: utls.NewLRUClientSessionCache(10),
+	}
+	dial := func() []byte {
+		rawConn, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		recordingConn := &helloRecordingConn{Conn: rawConn}
+		conn := utls.Client(recordingConn, ucfg)
+		defer conn.Close()
+		require.NoError(t, conn.Handshake())
+		_, err = io.ReadFull(conn, make([]byte, 1))
+		require.NoError(t, err)
+		require.Empty(t, <-probingErrors)
+		return recordingConn.hello
+	}
+
+	// Dial once over loopback to obtain a valid session ticket
+	dial()
+	disallowLoopbackForTesting = true
+	hello := dial()
+	dial()
+
+	// Now replay the ClientHello of the resumed connection
+	rawConn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	_, err = rawConn.Write(hello)
+	require.NoError(t, err)
+	// closing makes the server give up on the handshake after processing the ClientHello
+	rawConn.Close()
+	select {
+	case probingError := <-probingErrors:
+		require.Equal(t, "ClientHello replayed", probingError)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server didn't process replayed ClientHello")
+	}
+}
+
+// udpAddrListener makes connections look like they come in over UDP, like with
+// KCP.
+type udpAddrListener struct {
+	net.Listener
+}
+
+func (l *udpAddrListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &udpAddrConn{conn}, nil
+}
+
+type udpAddrConn struct {
+	net.Conn
+}
+
+func (conn *udpAddrConn) RemoteAddr() net.Addr {
+	addr := conn.Conn.RemoteAddr().(*net.TCPAddr)
+	return &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+}
+
+func TestUDPRemoteAddr(t *testing.T) {
+	disallowLoopbackForTesting = true
+	l, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	hl, err := Wrap(
+		&udpAddrListener{l}, "../test/data/server.key", "../test/data/server.crt", "../test/testtickets", "", "", nil,
+		true, AlertInternalError, nil, nil, true, instrument.NoInstrument{})
+	require.NoError(t, err)
+	defer hl.Close()
+
+	probingErrors := make(chan string, 1)
+	go func() {
+		sconn, err := hl.Accept()
+		if err != nil {
+			return
+		}
+		defer sconn.Close()
+		tconn := sconn.(*tlsconn)
+		if err := tconn.Conn.(*tls.Conn).Handshake(); err != nil {
+			probingErrors <- err.Error()
+			return
+		}
+		probingErrors <- tconn.ProbingError()
+	}()
+
+	// without a session cache, the client doesn't support session tickets
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "microsoft.com", InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "ClientHello does not support session tickets", <-probingErrors)
+}
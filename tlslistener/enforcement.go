@@ -0,0 +1,69 @@
+package tlslistener
+
+import (
+	"math/rand"
+	"net"
+	"strings"
+
+	"github.com/getlantern/geo"
+)
+
+// Reasons for which a ClientHello can fail the session ticket check.
+const (
+	// ReasonNoTicketSupport means that the ClientHello doesn't support session
+	// tickets at all.
+	ReasonNoTicketSupport = "no_ticket_support"
+
+	// ReasonNoTicket means that the ClientHello supports session tickets but
+	// doesn't include one.
+	ReasonNoTicket = "no_ticket"
+
+	// ReasonInvalidTicket means that the ClientHello includes a session ticket
+	// or pre-shared key that wasn't encrypted with any of our keys.
+	ReasonInvalidTicket = "invalid_ticket"
+)
+
+// TicketEnforcement configures which ClientHellos failing the session ticket
+// check get a HandshakeReaction. ClientHellos that aren't enforced are only
+// recorded as suspected probing and then handled as usual.
+type TicketEnforcement struct {
+	// Reactions maps the reasons for which to enforce to the reaction for
+	// that reason. Reasons that aren't in the map are never enforced.
+	Reactions map[string]HandshakeReaction
+
+	// Percent is the percentage (0-100) of failing ClientHellos on which to
+	// enforce, which allows rolling out enforcement gradually.
+	Percent float64
+
+	// CountryPercents overrides Percent for clients in the given countries,
+	// keyed by lowercase ISO 3166-1 alpha-2 code. For example, setting
+	// Percent to 0 and {"ir": 100} only enforces in Iran.
+	CountryPercents map[string]float64
+
+	// CountryLookup is used to look up the countries of clients. Required if
+	// CountryPercents is set.
+	CountryLookup geo.CountryLookup
+}
+
+// reactionFor returns the reaction for a client at the given IP that failed
+// the session ticket check for the given reason. If the failure shouldn't be
+// enforced, it returns false.
+func (te *TicketEnforcement) reactionFor(reason string, ip net.IP) (HandshakeReaction, bool) {
+	if te == nil {
+		return None, false
+	}
+	reaction, ok := te.Reactions[reason]
+	if !ok {
+		return None, false
+	}
+	percent := te.Percent
+	if len(te.CountryPercents) > 0 && te.CountryLookup != nil {
+		if countryPercent, found := te.CountryPercents[strings.ToLower(te.CountryLookup.CountryCode(ip))]; found {
+			percent = countryPercent
+		}
+	}
+	if percent <= 0 || rand.Float64()*100 >= percent {
+		return None, false
+	}
+	return reaction, true
+}
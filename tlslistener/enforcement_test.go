@@ -0,0 +1,57 @@
+package tlslistener
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeCountryLookup map[string]string
+
+func (l fakeCountryLookup) CountryCode(ip net.IP) string {
+	return l[ip.String()]
+}
+
+func TestTicketEnforcement(t *testing.T) {
+	var te *TicketEnforcement
+	_, enforce := te.reactionFor(ReasonNoTicket, net.ParseIP("1.1.1.1"))
+	assert.False(t, enforce, "nil enforcement should never enforce")
+
+	te = &TicketEnforcement{
+		Reactions: map[string]HandshakeReaction{
+			ReasonNoTicket:      AlertHandshakeFailure,
+			ReasonInvalidTicket: CloseConnection,
+		},
+		Percent:         100,
+		CountryPercents: map[string]float64{"us": 0},
+		CountryLookup:   fakeCountryLookup{"2.2.2.2": "US", "3.3.3.3": "IR"},
+	}
+	reaction, enforce := te.reactionFor(ReasonNoTicket, net.ParseIP("3.3.3.3"))
+	assert.True(t, enforce)
+	assert.Equal(t, AlertHandshakeFailure.Action(), reaction.Action())
+	reaction, enforce = te.reactionFor(ReasonInvalidTicket, net.ParseIP("1.1.1.1"))
+	assert.True(t, enforce, "clients without a country should use the default percent")
+	assert.Equal(t, CloseConnection.Action(), reaction.Action())
+	_, enforce = te.reactionFor(ReasonNoTicketSupport, net.ParseIP("3.3.3.3"))
+	assert.False(t, enforce, "reasons without a reaction shouldn't be enforced")
+	_, enforce = te.reactionFor(ReasonNoTicket, net.ParseIP("2.2.2.2"))
+	assert.False(t, enforce, "country override should take precedence")
+
+	te.Percent = 0
+	te.CountryPercents = map[string]float64{"ir": 100}
+	_, enforce = te.reactionFor(ReasonNoTicket, net.ParseIP("3.3.3.3"))
+	assert.True(t, enforce, "should enforce only in overridden country")
+	_, enforce = te.reactionFor(ReasonNoTicket, net.ParseIP("1.1.1.1"))
+	assert.False(t, enforce)
+
+	te.Percent = 50
+	te.CountryPercents = nil
+	enforced := 0
+	for i := 0; i < 1000; i++ {
+		if _, enforce := te.reactionFor(ReasonNoTicket, net.ParseIP("1.1.1.1")); enforce {
+			enforced++
+		}
+	}
+	assert.InDelta(t, 500, enforced, 100, "should enforce on about half of the connections")
+}
@@ -0,0 +1,326 @@
+package tlslistener
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/getlantern/errors"
+)
+
+const (
+	extensionServerName          = 0x0000
+	extensionSupportedGroups     = 0x000a
+	extensionECPointFormats      = 0x000b
+	extensionSignatureAlgorithms = 0x000d
+	extensionALPN                = 0x0010
+	extensionSupportedVersions   = 0x002b
+)
+
+// ClientHelloFingerprints are fingerprints of a ClientHello, which identify
+// the TLS implementation of the client.
+type ClientHelloFingerprints struct {
+	// JA3 is the MD5 hash of the JA3 string, see
+	// https://github.com/salesforce/ja3.
+	JA3 string
+
+	// JA4 is the JA4 fingerprint for TLS over TCP, see
+	// https://github.com/FoxIO-LLC/ja4.
+	JA4 string
+}
+
+// clientHelloFields are the fields of a ClientHello that go into JA3 and JA4,
+// with GREASE values already removed.
+type clientHelloFields struct {
+	version             uint16
+	cipherSuites        []uint16
+	extensions          []uint16
+	supportedGroups     []uint16
+	pointFormats        []uint8
+	signatureAlgorithms []uint16
+	supportedVersions   []uint16
+	alpnProtocols       []string
+	hasServerName       bool
+}
+
+// fingerprintClientHello computes the fingerprints of the given ClientHello
+// handshake message, excluding the record header.
+func fingerprintClientHello(hello []byte) (*ClientHelloFingerprints, error) {
+	fields, err := parseClientHelloFields(hello)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientHelloFingerprints{JA3: fields.ja3(), JA4: fields.ja4()}, nil
+}
+
+func (f *clientHelloFields) ja3() string {
+	pointFormats := make([]uint16, 0, len(f.pointFormats))
+	for _, pointFormat := range f.pointFormats {
+		pointFormats = append(pointFormats, uint16(pointFormat))
+	}
+	ja3 := strings.Join([]string{
+		strconv.Itoa(int(f.version)),
+		joinDecimal(f.cipherSuites),
+		joinDecimal(f.extensions),
+		joinDecimal(f.supportedGroups),
+		joinDecimal(pointFormats),
+	}, ",")
+	sum := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *clientHelloFields) ja4() string {
+	version := f.version
+	for _, supportedVersion := range f.supportedVersions {
+		if supportedVersion > version {
+			version = supportedVersion
+		}
+	}
+	sni := "i"
+	if f.hasServerName {
+		sni = "d"
+	}
+	alpn := "00"
+	if len(f.alpnProtocols) > 0 && f.alpnProtocols[0] != "" {
+		first := f.alpnProtocols[0]
+		alpn = ja4ALPN(first[0], first[len(first)-1])
+	}
+	ja4a := fmt.Sprintf("t%v%v%02d%02d%v", ja4Version(version), sni, min(len(f.cipherSuites), 99), min(len(f.extensions), 99), alpn)
+
+	ja4b := ja4Hash(sortedHex(f.cipherSuites))
+
+	var extensions []uint16
+	for _, extension := range f.extensions {
+		if extension != extensionServerName && extension != extensionALPN {
+			extensions = append(extensions, extension)
+		}
+	}
+	ja4c := "000000000000"
+	if len(extensions) > 0 {
+		c := sortedHex(extensions)
+		if len(f.signatureAlgorithms) > 0 {
+			c += "_" + joinHex(f.signatureAlgorithms)
+		}
+		ja4c = ja4Hash(c)
+	}
+
+	return ja4a + "_" + ja4b + "_" + ja4c
+}
+
+func ja4Version(version uint16) string {
+	switch version {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	default:
+		return "00"
+	}
+}
+
+// ja4ALPN returns the first and last characters of the first ALPN protocol,
+// or the first and last hex digits of them if they're not alphanumeric.
+func ja4ALPN(first, last byte) string {
+	isAlphanumeric := func(b byte) bool {
+		return b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z'
+	}
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	return hex.EncodeToString([]byte{first})[:1] + hex.EncodeToString([]byte{last})[1:]
+}
+
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func joinDecimal(values []uint16) string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		strs = append(strs, strconv.Itoa(int(value)))
+	}
+	return strings.Join(strs, "-")
+}
+
+func joinHex(values []uint16) string {
+	strs := make([]string, 0, len(values))
+	for _, value := range values {
+		strs = append(strs, fmt.Sprintf("%04x", value))
+	}
+	return strings.Join(strs, ",")
+}
+
+func sortedHex(values []uint16) string {
+	sorted := append([]uint16(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return joinHex(sorted)
+}
+
+// isGREASE determines whether the given value is one of the reserved GREASE
+// values from RFC 8701, which clients add randomly and are ignored when
+// fingerprinting.
+func isGREASE(value uint16) bool {
+	return value&0x0f0f == 0x0a0a && value>>8 == value&0xff
+}
+
+// helloReader reads length-prefixed fields from a ClientHello.
+type helloReader []byte
+
+func (r *helloReader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *helloReader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+func (r *helloReader) bytes(n int) (helloReader, bool) {
+	if len(*r) < n {
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+// vector reads a field prefixed with a length of lengthSize bytes.
+func (r *helloReader) vector(lengthSize int) (helloReader, bool) {
+	var length int
+	switch lengthSize {
+	case 1:
+		l, ok := r.uint8()
+		if !ok {
+			return nil, false
+		}
+		length = int(l)
+	case 2:
+		l, ok := r.uint16()
+		if !ok {
+			return nil, false
+		}
+		length = int(l)
+	case 3:
+		b, ok := r.bytes(3)
+		if !ok {
+			return nil, false
+		}
+		length = int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	}
+	return r.bytes(length)
+}
+
+// uint16s reads all remaining values as uint16s, skipping GREASE values.
+func (r helloReader) uint16s() []uint16 {
+	var values []uint16
+	for {
+		v, ok := r.uint16()
+		if !ok {
+			return values
+		}
+		if !isGREASE(v) {
+			values = append(values, v)
+		}
+	}
+}
+
+func parseClientHelloFields(hello []byte) (*clientHelloFields, error) {
+	r := helloReader(hello)
+	msgType, ok := r.uint8()
+	if !ok || msgType != 1 {
+		return nil, errors.New("not a ClientHello")
+	}
+	body, ok := r.vector(3)
+	if !ok {
+		// the ClientHello spans multiple records, use what we've got
+		body = r
+	}
+
+	f := &clientHelloFields{}
+	if f.version, ok = body.uint16(); !ok {
+		return nil, errors.New("ClientHello too short for version")
+	}
+	if _, ok = body.bytes(32); !ok {
+		return nil, errors.New("ClientHello too short for random")
+	}
+	if _, ok = body.vector(1); !ok {
+		return nil, errors.New("ClientHello too short for session ID")
+	}
+	cipherSuites, ok := body.vector(2)
+	if !ok {
+		return nil, errors.New("ClientHello too short for cipher suites")
+	}
+	f.cipherSuites = cipherSuites.uint16s()
+	if _, ok = body.vector(1); !ok {
+		return nil, errors.New("ClientHello too short for compression methods")
+	}
+	extensions, ok := body.vector(2)
+	if !ok {
+		// ClientHellos without extensions are valid
+		return f, nil
+	}
+	for len(extensions) > 0 {
+		extension, ok := extensions.uint16()
+		if !ok {
+			return nil, errors.New("ClientHello has malformed extensions")
+		}
+		data, ok := extensions.vector(2)
+		if !ok {
+			return nil, errors.New("ClientHello has malformed extension %d", extension)
+		}
+		if isGREASE(extension) {
+			continue
+		}
+		f.extensions = append(f.extensions, extension)
+		switch extension {
+		case extensionServerName:
+			f.hasServerName = true
+		case extensionSupportedGroups:
+			groups, _ := data.vector(2)
+			f.supportedGroups = groups.uint16s()
+		case extensionECPointFormats:
+			pointFormats, _ := data.vector(1)
+			f.pointFormats = append([]uint8(nil), pointFormats...)
+		case extensionSignatureAlgorithms:
+			algorithms, _ := data.vector(2)
+			f.signatureAlgorithms = algorithms.uint16s()
+		case extensionSupportedVersions:
+			versions, _ := data.vector(1)
+			f.supportedVersions = versions.uint16s()
+		case extensionALPN:
+			protocols, _ := data.vector(2)
+			for len(protocols) > 0 {
+				protocol, ok := protocols.vector(1)
+				if !ok {
+					break
+				}
+				f.alpnProtocols = append(f.alpnProtocols, string(protocol))
+			}
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,105 @@
+package tlslistener
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// buildClientHello builds a ClientHello handshake message with the given
+// cipher suites and extensions.
+func buildClientHello(cipherSuites []uint16, extensions [][]byte) []byte {
+	u16 := func(v int) []byte {
+		return binary.BigEndian.AppendUint16(nil, uint16(v))
+	}
+	body := append(u16(0x0303), make([]byte, 32)...)
+	body = append(body, 0) // session ID
+	body = append(body, u16(len(cipherSuites)*2)...)
+	for _, suite := range cipherSuites {
+		body = append(body, u16(int(suite))...)
+	}
+	body = append(body, 1, 0) // compression methods
+	var exts []byte
+	for _, ext := range extensions {
+		exts = append(exts, ext...)
+	}
+	body = append(body, u16(len(exts))...)
+	body = append(body, exts...)
+	return append([]byte{1, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func buildExtension(extension uint16, data ...byte) []byte {
+	result := binary.BigEndian.AppendUint16(nil, extension)
+	result = binary.BigEndian.AppendUint16(result, uint16(len(data)))
+	return append(result, data...)
+}
+
+func TestFingerprintClientHello(t *testing.T) {
+	hello := buildClientHello([]uint16{0x0a0a, 0xc02f, 0x1301}, [][]byte{
+		buildExtension(0x1a1a),
+		buildExtension(extensionServerName, 0, 0),
+		buildExtension(extensionSupportedGroups, 0, 6, 0x2a, 0x2a, 0x00, 0x1d, 0x00, 0x17),
+		buildExtension(extensionECPointFormats, 1, 0),
+		buildExtension(extensionSignatureAlgorithms, 0, 4, 0x08, 0x04, 0x04, 0x03),
+		buildExtension(extensionALPN, 0, 12, 2, 'h', '2', 8, 'h', 't', 't', 'p', '/', '1', '.', '1'),
+		buildExtension(extensionSupportedVersions, 4, 0x03, 0x04, 0x03, 0x03),
+	})
+
+	fingerprints, err := fingerprintClientHello(hello)
+	require.NoError(t, err)
+
+	ja3 := md5.Sum([]byte("771,49199-4865,0-10-11-13-16-43,29-23,0"))
+	assert.Equal(t, hex.EncodeToString(ja3[:]), fingerprints.JA3, "GREASE values should be ignored")
+
+	ja4b := sha256.Sum256([]byte("1301,c02f"))
+	ja4c := sha256.Sum256([]byte("000a,000b,000d,002b_0804,0403"))
+	assert.Equal(t, "t13d0206h2_"+hex.EncodeToString(ja4b[:])[:12]+"_"+hex.EncodeToString(ja4c[:])[:12], fingerprints.JA4)
+
+	minimal, err := fingerprintClientHello(buildClientHello([]uint16{0xc02f}, nil))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(minimal.JA4, "t12i010000_"), minimal.JA4)
+	assert.True(t, strings.HasSuffix(minimal.JA4, "_000000000000"), minimal.JA4)
+
+	_, err = fingerprintClientHello([]byte{2, 0, 0, 0})
+	assert.Error(t, err, "should only fingerprint ClientHellos")
+	_, err = fingerprintClientHello(hello[:20])
+	assert.Error(t, err, "should fail on truncated ClientHello")
+}
+
+func TestFingerprintGoClientHello(t *testing.T) {
+	hello := func(cfg *tls.Config) *ClientHelloFingerprints {
+		client, server := net.Pipe()
+		defer server.Close()
+		go tls.Client(client, cfg).Handshake()
+		defer client.Close()
+		// read the record header and then the handshake message
+		header := make([]byte, 5)
+		_, err := io.ReadFull(server, header)
+		require.NoError(t, err)
+		msg := make([]byte, binary.BigEndian.Uint16(header[3:]))
+		_, err = io.ReadFull(server, msg)
+		require.NoError(t, err)
+		fingerprints, err := fingerprintClientHello(msg)
+		require.NoError(t, err)
+		return fingerprints
+	}
+
+	cfg := &tls.Config{ServerName: "example.com", NextProtos: []string{"h2", "http/1.1"}}
+	fingerprints := hello(cfg)
+	assert.True(t, strings.HasPrefix(fingerprints.JA4, "t13d"), fingerprints.JA4)
+	assert.Equal(t, "h2", fingerprints.JA4[8:10])
+	assert.Equal(t, fingerprints, hello(cfg), "fingerprints shouldn't depend on random fields")
+
+	tls12 := hello(&tls.Config{ServerName: "example.com", MaxVersion: tls.VersionTLS12})
+	assert.True(t, strings.HasPrefix(tls12.JA4, "t12d"), tls12.JA4)
+	assert.NotEqual(t, fingerprints.JA3, tls12.JA3)
+}
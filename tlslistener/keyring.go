@@ -0,0 +1,187 @@
+package tlslistener
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/getlantern/errors"
+)
+
+// keyRingRefreshInterval is how frequently session ticket key rings are
+// reloaded.
+const keyRingRefreshInterval = 1 * time.Minute
+
+// KeyRing is a versioned set of session ticket keys shared by all proxies on a
+// track. Rather than each proxy rotating its own keys, keys are rotated by
+// publishing a new version of the ring, for example:
+//
+//	{"version": 2, "keys": ["<new key>", "<previous key>"]}
+type KeyRing struct {
+	// Version identifies the keys. The ring is only applied when its version
+	// differs from the one applied last.
+	Version int64 `json:"version"`
+
+	// Keys are the base64-encoded keys. The first key is used for issuing new
+	// tickets, all keys are used for decrypting tickets.
+	Keys []string `json:"keys"`
+}
+
+func (ring *KeyRing) decode() ([][keySize]byte, error) {
+	if len(ring.Keys) == 0 {
+		return nil, errors.New("key ring version %d has no keys", ring.Version)
+	}
+	keys := make([][keySize]byte, 0, len(ring.Keys))
+	for i, encoded := range ring.Keys {
+		b, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, errors.New("failed to parse key %d of key ring version %d: %v", i, ring.Version, err)
+		}
+		if len(b) != keySize {
+			return nil, errors.New("key %d of key ring version %d should be %d bytes", i, ring.Version, keySize)
+		}
+		var key [keySize]byte
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// KeyRingSource is somewhere from which a KeyRing can be loaded.
+type KeyRingSource interface {
+	// Load returns the current KeyRing.
+	Load() (*KeyRing, error)
+
+	// ReportActive records that this proxy is using the key ring with the given
+	// version, whose first key has the given fingerprint, so that we can check
+	// that all proxies on a track rotated together.
+	ReportActive(version int64, fingerprint string) error
+
+	String() string
+}
+
+// NewKeyRingFile returns a KeyRingSource that loads the JSON-encoded KeyRing
+// from the file at the given path. Since the file is only read by this proxy,
+// ReportActive just logs the active key.
+func NewKeyRingFile(path string) KeyRingSource {
+	return &keyRingFile{path: path}
+}
+
+type keyRingFile struct {
+	path string
+}
+
+func (src *keyRingFile) Load() (*KeyRing, error) {
+	encoded, err := os.ReadFile(src.path)
+	if err != nil {
+		return nil, err
+	}
+	ring := &KeyRing{}
+	if err := json.Unmarshal(encoded, ring); err != nil {
+		return nil, errors.New("unable to decode key ring in %v: %v", src.path, err)
+	}
+	return ring, nil
+}
+
+func (src *keyRingFile) ReportActive(version int64, fingerprint string) error {
+	log.Tracef("Using version %d of session ticket key ring in %v with active key %v", version, src.path, fingerprint)
+	return nil
+}
+
+func (src *keyRingFile) String() string {
+	return src.path
+}
+
+// SessionTicketKeyRing keeps the session ticket keys of any number of listeners
+// in sync with a KeyRingSource.
+type SessionTicketKeyRing struct {
+	source          KeyRingSource
+	refreshInterval time.Duration
+	keyListeners    []func(keys [][keySize]byte)
+	keys            [][keySize]byte
+	version         int64
+	active          string
+	mx              sync.Mutex
+}
+
+// MaintainSessionTicketKeyRing loads the key ring from the given source and
+// then polls it every minute until the context is done. If the key ring can't
+// be loaded, it keeps trying, in the meantime listeners use the keys they
+// would use without a key ring. Once loaded, the last good keys are kept if
+// loading fails.
+func MaintainSessionTicketKeyRing(ctx context.Context, source KeyRingSource) *SessionTicketKeyRing {
+	return maintainSessionTicketKeyRing(ctx, source, keyRingRefreshInterval)
+}
+
+func maintainSessionTicketKeyRing(ctx context.Context, source KeyRingSource, refreshInterval time.Duration) *SessionTicketKeyRing {
+	k := &SessionTicketKeyRing{
+		source:          source,
+		refreshInterval: refreshInterval,
+	}
+	if err := k.refresh(); err != nil {
+		log.Errorf("Unable to load session ticket key ring from %v, will keep trying: %v", source, err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(k.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := k.refresh(); err != nil {
+					log.Errorf("Unable to refresh session ticket key ring from %v, keeping version %d: %v", source, k.getVersion(), err)
+				}
+			}
+		}
+	}()
+
+	return k
+}
+
+// addKeyListener calls keyListener with the keys of every version of the key
+// ring that gets applied, starting with the current one if it's loaded.
+func (k *SessionTicketKeyRing) addKeyListener(keyListener func(keys [][keySize]byte)) {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	k.keyListeners = append(k.keyListeners, keyListener)
+	if k.keys != nil {
+		keyListener(k.keys)
+	}
+}
+
+// refresh loads the key ring and applies it if its version changed. The active
+// key is reported on every refresh so that reports don't go stale.
+func (k *SessionTicketKeyRing) refresh() error {
+	ring, err := k.source.Load()
+	if err != nil {
+		return err
+	}
+
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	if k.keys == nil || ring.Version != k.version {
+		keys, err := ring.decode()
+		if err != nil {
+			return err
+		}
+		log.Debugf("Applying version %d of session ticket key ring from %v with %d keys", ring.Version, k.source, len(keys))
+		for _, keyListener := range k.keyListeners {
+			keyListener(keys)
+		}
+		k.keys = keys
+		k.version = ring.Version
+		k.active = fingerprint(keys[0])
+	}
+	return k.source.ReportActive(k.version, k.active)
+}
+
+func (k *SessionTicketKeyRing) getVersion() int64 {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	return k.version
+}
@@ -0,0 +1,104 @@
+package tlslistener
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type reportingKeyRingSource struct {
+	KeyRingSource
+	reported []string
+	mx       sync.Mutex
+}
+
+func (src *reportingKeyRingSource) ReportActive(version int64, fingerprint string) error {
+	src.mx.Lock()
+	defer src.mx.Unlock()
+	src.reported = append(src.reported, fingerprint)
+	return nil
+}
+
+func (src *reportingKeyRingSource) lastReported() string {
+	src.mx.Lock()
+	defer src.mx.Unlock()
+	return src.reported[len(src.reported)-1]
+}
+
+func TestSessionTicketKeyRing(t *testing.T) {
+	newKey := func() [keySize]byte {
+		var key [keySize]byte
+		_, err := rand.Read(key[:])
+		require.NoError(t, err)
+		return key
+	}
+	writeRing := func(path string, version int64, keys ...[keySize]byte) {
+		ring := &KeyRing{Version: version}
+		for _, key := range keys {
+			ring.Keys = append(ring.Keys, base64.StdEncoding.EncodeToString(key[:]))
+		}
+		b, err := json.Marshal(ring)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, b, 0644))
+	}
+
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	source := &reportingKeyRingSource{KeyRingSource: NewKeyRingFile(path)}
+	var applied [][keySize]byte
+	var appliedMx sync.Mutex
+	getApplied := func() [][keySize]byte {
+		appliedMx.Lock()
+		defer appliedMx.Unlock()
+		return applied
+	}
+	onKeys := func(keys [][keySize]byte) {
+		appliedMx.Lock()
+		defer appliedMx.Unlock()
+		applied = keys
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keyRing := maintainSessionTicketKeyRing(ctx, source, 10*time.Millisecond)
+	keyRing.addKeyListener(onKeys)
+	assert.Nil(t, getApplied(), "nothing should be applied without key ring")
+	assert.EqualValues(t, 0, keyRing.getVersion())
+
+	key1, key2 := newKey(), newKey()
+	writeRing(path, 1, key1)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, [][keySize]byte{key1}, getApplied(), "key ring should be applied once it can be loaded")
+	assert.EqualValues(t, 1, keyRing.getVersion())
+	assert.Equal(t, fingerprint(key1), source.lastReported())
+
+	otherApplied := make(chan [][keySize]byte, 10)
+	keyRing.addKeyListener(func(keys [][keySize]byte) {
+		otherApplied <- keys
+	})
+	assert.Equal(t, [][keySize]byte{key1}, <-otherApplied, "new listeners should get the current keys")
+
+	writeRing(path, 1, key2)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, [][keySize]byte{key1}, getApplied(), "key ring with same version shouldn't be applied")
+	assert.Equal(t, fingerprint(key1), source.lastReported())
+
+	writeRing(path, 2, key2, key1)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, [][keySize]byte{key2, key1}, getApplied(), "new version should be applied")
+	assert.EqualValues(t, 2, keyRing.getVersion())
+	assert.Equal(t, fingerprint(key2), source.lastReported())
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 3, "keys": ["bad key"]}`), 0644))
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, [][keySize]byte{key2, key1}, getApplied(), "bad key ring should keep last good keys")
+	assert.EqualValues(t, 2, keyRing.getVersion())
+}
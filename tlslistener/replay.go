@@ -0,0 +1,67 @@
+package tlslistener
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// ReplayCache remembers ClientHellos that presented valid session tickets, so
+// that a censor replaying a captured ClientHello to confirm that the server is
+// a proxy gets detected. Since legitimate clients use a fresh random in every
+// ClientHello, they never collide, even when reusing a ticket.
+//
+// Like the shadowsocks replay cache, it keeps two generations of ClientHellos
+// to stay bounded. The active generation is archived once it holds capacity
+// ClientHellos or is older than window, so every ClientHello is remembered for
+// at least as long as it takes to see capacity more ClientHellos or window to
+// pass, whichever comes first.
+type ReplayCache struct {
+	capacity      int
+	window        time.Duration
+	active        map[[sha256.Size]byte]bool
+	archive       map[[sha256.Size]byte]bool
+	activeStarted time.Time
+	mx            sync.Mutex
+}
+
+// NewReplayCache creates a ReplayCache that remembers up to 2*capacity
+// ClientHellos for up to 2*window. If capacity is not positive, it returns nil,
+// which detects no replays.
+func NewReplayCache(capacity int, window time.Duration) *ReplayCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &ReplayCache{
+		capacity:      capacity,
+		window:        window,
+		active:        make(map[[sha256.Size]byte]bool, capacity),
+		activeStarted: time.Now(),
+	}
+}
+
+// add remembers the ClientHello with the given random and ticket, returning
+// true if it was seen before.
+func (c *ReplayCache) add(random, ticket []byte) bool {
+	if c == nil {
+		return false
+	}
+	h := sha256.New()
+	h.Write(random)
+	h.Write(ticket)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.active[key] || c.archive[key] {
+		return true
+	}
+	if len(c.active) >= c.capacity || (c.window > 0 && time.Since(c.activeStarted) >= c.window) {
+		c.archive = c.active
+		c.active = make(map[[sha256.Size]byte]bool, c.capacity)
+		c.activeStarted = time.Now()
+	}
+	c.active[key] = true
+	return false
+}
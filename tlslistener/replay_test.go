@@ -0,0 +1,34 @@
+package tlslistener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplayCache(t *testing.T) {
+	disabled := NewReplayCache(0, time.Hour)
+	assert.Nil(t, disabled)
+	assert.False(t, disabled.add([]byte("random"), []byte("ticket")))
+	assert.False(t, disabled.add([]byte("random"), []byte("ticket")), "disabled cache should never detect replays")
+
+	c := NewReplayCache(2, time.Hour)
+	assert.False(t, c.add([]byte("random1"), []byte("ticket")))
+	assert.True(t, c.add([]byte("random1"), []byte("ticket")), "same random and ticket should be a replay")
+	assert.False(t, c.add([]byte("random2"), []byte("ticket")), "same ticket with different random shouldn't be a replay")
+	assert.False(t, c.add([]byte("random1"), []byte("ticket2")), "same random with different ticket shouldn't be a replay")
+	assert.True(t, c.add([]byte("random1"), []byte("ticket")), "archived ClientHello should still be detected")
+	assert.False(t, c.add([]byte("random3"), []byte("ticket")))
+	assert.False(t, c.add([]byte("random4"), []byte("ticket")))
+	assert.False(t, c.add([]byte("random1"), []byte("ticket")), "ClientHello should be forgotten after two generations")
+
+	c = NewReplayCache(100, 50*time.Millisecond)
+	assert.False(t, c.add([]byte("random1"), []byte("ticket")))
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, c.add([]byte("random2"), []byte("ticket")))
+	assert.True(t, c.add([]byte("random1"), []byte("ticket")), "ClientHello should be archived after the window")
+	time.Sleep(60 * time.Millisecond)
+	assert.False(t, c.add([]byte("random3"), []byte("ticket")))
+	assert.False(t, c.add([]byte("random1"), []byte("ticket")), "ClientHello should be forgotten after two windows")
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/getlantern/errors"
@@ -101,38 +102,83 @@ func makeSessionTicketKey() []byte {
 	return b
 }
 
+// inMemorySessionTicketKeys holds a set of session ticket keys that are
+// rotated in memory every rotateInterval.
+type inMemorySessionTicketKeys struct {
+	keyBytes    []byte
+	keyListener func(keys [][keySize]byte)
+	mx          sync.Mutex
+}
+
 func maintainSessionTicketKeysInMemory(
-	sessionTicketKeys string, keyListener func(keys [][keySize]byte)) error {
+	sessionTicketKeys string, keyListener func(keys [][keySize]byte)) (*inMemorySessionTicketKeys, error) {
+
+	k := &inMemorySessionTicketKeys{keyListener: keyListener}
+	// Initialize key
+	if err := k.update(sessionTicketKeys); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			time.Sleep(rotateInterval)
+			k.rotate()
+		}
+	}()
+
+	return k, nil
+}
+
+// ValidateSessionTicketKeys checks that the given base64-encoded session ticket
+// keys could be applied with UpdateSessionTicketKeys.
+func ValidateSessionTicketKeys(sessionTicketKeys string) error {
+	_, err := decodeSessionTicketKeys(sessionTicketKeys)
+	return err
+}
 
+func decodeSessionTicketKeys(sessionTicketKeys string) ([]byte, error) {
 	keyBytes, err := base64.StdEncoding.DecodeString(sessionTicketKeys)
 	if err != nil {
-		return errors.New("failed to parse session ticket keys: %v", err)
+		return nil, errors.New("failed to parse session ticket keys: %v", err)
 	}
-	if len(keyBytes)%keySize != 0 {
-		return errors.New("session ticket keys should be multiple of keySize bytes")
+	if len(keyBytes) == 0 || len(keyBytes)%keySize != 0 {
+		return nil, errors.New("session ticket keys should be multiple of keySize bytes")
 	}
+	return keyBytes, nil
+}
 
-	// Initialize key
-	keyListener(buildKeysArray(keyBytes))
+// update replaces the current session ticket keys with the given
+// base64-encoded keys and applies them immediately.
+func (k *inMemorySessionTicketKeys) update(sessionTicketKeys string) error {
+	keyBytes, err := decodeSessionTicketKeys(sessionTicketKeys)
+	if err != nil {
+		return err
+	}
 
 	if len(keyBytes) == keySize {
 		log.Debug("session ticket keys contains only one key, we'll use that and not bother rotating")
-		return nil
+	} else {
+		log.Debugf("Will rotate %d session ticket keys in memory every %v hours", len(keyBytes)/keySize, rotateInterval)
 	}
 
-	log.Debugf("Will rotate %d session ticket keys in memory every %v hours", len(keyBytes)/keySize, rotateInterval)
-
-	go func() {
-		for {
-			time.Sleep(rotateInterval)
-			keyBytes = rotateSessionTicketKeysInMemory(keyBytes)
-			keyListener(buildKeysArray(keyBytes))
-		}
-	}()
-
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	k.keyBytes = keyBytes
+	k.keyListener(buildKeysArray(keyBytes))
 	return nil
 }
 
+func (k *inMemorySessionTicketKeys) rotate() {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	if len(k.keyBytes) == keySize {
+		// nothing to rotate
+		return
+	}
+	k.keyBytes = rotateSessionTicketKeysInMemory(k.keyBytes)
+	k.keyListener(buildKeysArray(k.keyBytes))
+}
+
 func rotateSessionTicketKeysInMemory(keyBytes []byte) []byte {
 	shiftedKeyBytes := make([]byte, len(keyBytes))
 	copy(shiftedKeyBytes, keyBytes[keySize:])
@@ -1,6 +1,7 @@
 package tlslistener
 
 import (
+	"encoding/base64"
 	"math/rand"
 	"testing"
 
@@ -23,3 +24,31 @@ func TestRotateSessionTicketKeysInMemory(t *testing.T) {
 	rotatedKeyBytes = rotateSessionTicketKeysInMemory(rotatedKeyBytes)
 	require.EqualValues(t, initialKeyBytes, rotatedKeyBytes)
 }
+
+func TestUpdateSessionTicketKeysInMemory(t *testing.T) {
+	key1 := make([]byte, 32)
+	key2 := make([]byte, 32)
+	_, err := rand.Read(key1)
+	require.NoError(t, err)
+	_, err = rand.Read(key2)
+	require.NoError(t, err)
+
+	var currentKeys [][keySize]byte
+	k, err := maintainSessionTicketKeysInMemory(base64.StdEncoding.EncodeToString(key1), func(keys [][keySize]byte) {
+		currentKeys = keys
+	})
+	require.NoError(t, err)
+	require.Len(t, currentKeys, 1)
+	require.EqualValues(t, key1, currentKeys[0][:])
+
+	require.NoError(t, k.update(base64.StdEncoding.EncodeToString(append(key2, key1...))))
+	require.Len(t, currentKeys, 2)
+	require.EqualValues(t, key2, currentKeys[0][:])
+	require.EqualValues(t, key1, currentKeys[1][:])
+
+	k.rotate()
+	require.EqualValues(t, key1, currentKeys[0][:], "keys should rotate after update")
+
+	require.Error(t, k.update(base64.StdEncoding.EncodeToString(key1[:10])), "partial keys should be rejected")
+	require.Len(t, currentKeys, 2, "keys should be unchanged after failed update")
+}
@@ -3,7 +3,9 @@
 package tlslistener
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"encoding/hex"
 	"net"
 	"sync"
 
@@ -20,9 +22,15 @@ var (
 	log = golog.LoggerFor("tlslistener")
 )
 
-// Wrap wraps the specified listener in our default TLS listener.
-func Wrap(wrapped net.Listener, keyFile, certFile, sessionTicketKeyFile, firstSessionTicketKey, sessionTicketKeys string,
-	requireSessionTickets bool, missingTicketReaction HandshakeReaction, allowTLS13 bool,
+// Wrap wraps the specified listener in our default TLS listener. Session ticket
+// keys come from the sessionTicketKeyRing if it's not nil and has been loaded,
+// otherwise from the sessionTicketKeyFile or the sessionTicketKeys. Malformed
+// ClientHellos get the missingTicketReaction, whereas ClientHellos failing the
+// session ticket check only get a reaction as configured by ticketEnforcement,
+// which may be nil to never enforce. If replayCache is not nil, ClientHellos replaying a valid
+// session ticket also get the missingTicketReaction.
+func Wrap(wrapped net.Listener, keyFile, certFile, sessionTicketKeyFile, firstSessionTicketKey, sessionTicketKeys string, sessionTicketKeyRing *SessionTicketKeyRing,
+	requireSessionTickets bool, missingTicketReaction HandshakeReaction, ticketEnforcement *TicketEnforcement, replayCache *ReplayCache, allowTLS13 bool,
 	instrument instrument.Instrument) (net.Listener, error) {
 
 	cfg, err := tlsdefaults.BuildListenerConfig(wrapped.Addr().String(), keyFile, certFile)
@@ -34,17 +42,17 @@ func Wrap(wrapped net.Listener, keyFile, certFile, sessionTicketKeyFile, firstSe
 
 	// Depending on the ClientHello generated, we use session tickets both for normal
 	// session ticket resumption as well as pre-negotiated session tickets as obfuscation.
-	// Ideally we'll make this work with TLS 1.3, see:
-	// https://github.com/getlantern/lantern-internal/issues/3057
-	// https://github.com/getlantern/lantern-internal/issues/3850
-	// https://github.com/getlantern/lantern-internal/issues/4111
+	// With TLS 1.3, the tickets are presented as pre_shared_key identities instead, which
+	// are encrypted with the same keys. Only offering TLS 1.2 is itself a fingerprint, so
+	// allowTLS13 should only be disabled to support clients that can't handle TLS 1.3.
 	if !allowTLS13 {
 		cfg.MaxVersion = tls.VersionTLS12
 	}
 
+	expectTicketsFromKeyRing := sessionTicketKeyRing != nil
 	expectTicketsFromFile := sessionTicketKeyFile != ""
 	expectTicketsInMemory := sessionTicketKeys != ""
-	expectTickets := expectTicketsFromFile || expectTicketsInMemory
+	expectTickets := expectTicketsFromKeyRing || expectTicketsFromFile || expectTicketsInMemory
 
 	listener := &tlslistener{
 		wrapped:               wrapped,
@@ -54,30 +62,33 @@ func Wrap(wrapped net.Listener, keyFile, certFile, sessionTicketKeyFile, firstSe
 		requireTickets:        requireSessionTickets,
 		utlsCfg:               utlsConfig,
 		missingTicketReaction: missingTicketReaction,
+		ticketEnforcement:     ticketEnforcement,
+		replayCache:           replayCache,
 		instrument:            instrument,
 	}
 
 	onKeys := func(keys [][32]byte) {
-		cfg.SetSessionTicketKeys(keys)
-		utlsConfig.SetSessionTicketKeys(keys)
-		listener.ticketKeysMutex.Lock()
-		defer listener.ticketKeysMutex.Unlock()
-		listener.ticketKeys = make([]utls.TicketKey, 0, len(keys))
-		for _, k := range keys {
-			listener.ticketKeys = append(listener.ticketKeys, utls.TicketKeyFromBytes(k))
-		}
-		log.Debug("Finished setting listener keys")
+		listener.setTicketKeys(keys, false)
 	}
 
+	// keys from the file or in memory are used until the key ring is loaded
 	if expectTicketsFromFile {
 		log.Debugf("Will rotate session ticket key and store in %v", sessionTicketKeyFile)
 		maintainSessionTicketKeyFile(sessionTicketKeyFile, firstSessionTicketKey, onKeys)
 	} else if expectTicketsInMemory {
 		log.Debug("Will rotate through session tickets in memory")
-		if err := maintainSessionTicketKeysInMemory(sessionTicketKeys, onKeys); err != nil {
+		listener.inMemoryTicketKeys, err = maintainSessionTicketKeysInMemory(sessionTicketKeys, onKeys)
+		if err != nil {
 			return nil, errors.New("unable to maintain session ticket keys in memory: %v", err)
 		}
 	}
+	if expectTicketsFromKeyRing {
+		log.Debugf("Will load session ticket keys from key ring in %v", sessionTicketKeyRing.source)
+		listener.keyRing = sessionTicketKeyRing
+		sessionTicketKeyRing.addKeyListener(func(keys [][32]byte) {
+			listener.setTicketKeys(keys, true)
+		})
+	}
 
 	return listener, nil
 }
@@ -90,9 +101,15 @@ type tlslistener struct {
 	requireTickets        bool
 	utlsCfg               *utls.Config
 	missingTicketReaction HandshakeReaction
+	ticketEnforcement     *TicketEnforcement
+	replayCache           *ReplayCache
 	instrument            instrument.Instrument
 	ticketKeys            utls.TicketKeys
+	ticketKeyFingerprints []string
 	ticketKeysMutex       sync.RWMutex
+	keysFromKeyRing       bool
+	inMemoryTicketKeys    *inMemorySessionTicketKeys
+	keyRing               *SessionTicketKeyRing
 }
 
 func (l *tlslistener) Accept() (net.Conn, error) {
@@ -100,20 +117,86 @@ func (l *tlslistener) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	if !l.expectTickets || !l.requireTickets {
-		return &tlsconn{Conn: tls.Server(conn, l.cfg), wrapped: conn}, nil
-	}
-
-	helloConn, cfg := newClientHelloRecordingConn(conn, l.cfg, l.utlsCfg, l.getTicketKeys(), l.missingTicketReaction, l.instrument)
+	ticketKeys := l.getTicketKeys()
+	// tickets can't be checked before any keys are loaded
+	checkTickets := l.expectTickets && l.requireTickets && len(ticketKeys) > 0
+	helloConn, cfg := newClientHelloRecordingConn(conn, l.cfg, l.utlsCfg, checkTickets, ticketKeys, l.missingTicketReaction, l.ticketEnforcement, l.replayCache, l.instrument)
 	return &tlsconn{Conn: tls.Server(helloConn, cfg), wrapped: conn, helloConn: helloConn}, nil
 }
 
+// setTicketKeys applies the given session ticket keys. Once keys from the key
+// ring have been applied, keys from anywhere else are ignored.
+func (l *tlslistener) setTicketKeys(keys [][keySize]byte, fromKeyRing bool) {
+	l.ticketKeysMutex.Lock()
+	defer l.ticketKeysMutex.Unlock()
+	if l.keysFromKeyRing && !fromKeyRing {
+		return
+	}
+	l.keysFromKeyRing = fromKeyRing
+	l.cfg.SetSessionTicketKeys(keys)
+	l.utlsCfg.SetSessionTicketKeys(keys)
+	l.ticketKeys = make([]utls.TicketKey, 0, len(keys))
+	l.ticketKeyFingerprints = make([]string, 0, len(keys))
+	for _, k := range keys {
+		l.ticketKeys = append(l.ticketKeys, utls.TicketKeyFromBytes(k))
+		l.ticketKeyFingerprints = append(l.ticketKeyFingerprints, fingerprint(k))
+	}
+	log.Debug("Finished setting listener keys")
+}
+
 func (l *tlslistener) getTicketKeys() utls.TicketKeys {
 	l.ticketKeysMutex.RLock()
 	defer l.ticketKeysMutex.RUnlock()
 	return l.ticketKeys
 }
 
+// SessionTicketKeysUpdater is implemented by listeners that can change their
+// session ticket keys while running.
+type SessionTicketKeysUpdater interface {
+	// UpdateSessionTicketKeys replaces the session ticket keys with the given
+	// base64-encoded keys, in the same format as accepted by Wrap.
+	UpdateSessionTicketKeys(sessionTicketKeys string) error
+}
+
+func (l *tlslistener) UpdateSessionTicketKeys(sessionTicketKeys string) error {
+	if l.inMemoryTicketKeys == nil {
+		return errors.New("listener at %v was not configured with in-memory session ticket keys", l.Addr())
+	}
+	return l.inMemoryTicketKeys.update(sessionTicketKeys)
+}
+
+// SessionTicketKeysInspector is implemented by listeners that can report which
+// session ticket keys they're using.
+type SessionTicketKeysInspector interface {
+	// SessionTicketKeyFingerprints returns the fingerprints of the current
+	// session ticket keys, starting with the one used for issuing new tickets.
+	// Fingerprints are the hex-encoded first 8 bytes of the SHA-256 of a key, so
+	// they can be shared without revealing the keys.
+	SessionTicketKeyFingerprints() []string
+
+	// SessionTicketKeyRingVersion returns the version of the KeyRing that the
+	// keys came from, or 0 if they don't come from a KeyRingSource.
+	SessionTicketKeyRingVersion() int64
+}
+
+func (l *tlslistener) SessionTicketKeyFingerprints() []string {
+	l.ticketKeysMutex.RLock()
+	defer l.ticketKeysMutex.RUnlock()
+	return append([]string(nil), l.ticketKeyFingerprints...)
+}
+
+func (l *tlslistener) SessionTicketKeyRingVersion() int64 {
+	if l.keyRing == nil {
+		return 0
+	}
+	return l.keyRing.getVersion()
+}
+
+func fingerprint(key [keySize]byte) string {
+	sum := sha256.Sum256(key[:])
+	return hex.EncodeToString(sum[:8])
+}
+
 func (l *tlslistener) Addr() net.Addr {
 	return l.wrapped.Addr()
 }
@@ -128,6 +211,12 @@ type ProbingDetectingConn interface {
 	ProbingError() string
 }
 
+type ClientHelloFingerprintingConn interface {
+	// ClientHelloFingerprints returns the fingerprints of the ClientHello
+	// received on this connection, or nil if it couldn't be fingerprinted.
+	ClientHelloFingerprints() *ClientHelloFingerprints
+}
+
 type tlsconn struct {
 	net.Conn
 	wrapped   net.Conn
@@ -147,3 +236,13 @@ func (conn *tlsconn) ProbingError() string {
 	conn.helloConn.helloMutex.Unlock()
 	return err
 }
+
+func (conn *tlsconn) ClientHelloFingerprints() *ClientHelloFingerprints {
+	if conn.helloConn == nil {
+		return nil
+	}
+	conn.helloConn.helloMutex.Lock()
+	fingerprints := conn.helloConn.fingerprints
+	conn.helloConn.helloMutex.Unlock()
+	return fingerprints
+}
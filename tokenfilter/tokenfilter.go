@@ -4,36 +4,155 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/getlantern/errors"
 	"github.com/getlantern/golog"
 	"github.com/getlantern/proxy/v3/filters"
 
 	"github.com/getlantern/http-proxy-lantern/v2/common"
 	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+	"github.com/getlantern/http-proxy-lantern/v2/listeners"
 	"github.com/getlantern/http-proxy-lantern/v2/mimic"
 )
 
+const (
+	// DefaultLabel is the label used for the token given to New.
+	DefaultLabel = "default"
+)
+
 var log = golog.LoggerFor("tokenfilter")
 
-type tokenFilter struct {
-	token      string
+// Token is an auth token accepted by the TokenFilter.
+type Token struct {
+	// Token is the value clients send in common.TokenHeader.
+	Token string
+
+	// Label identifies this token for reporting purposes.
+	Label string
+
+	// Expires is the time after which this token is no longer accepted. The
+	// zero value means that the token never expires.
+	Expires time.Time
+}
+
+func (t *Token) expired(now time.Time) bool {
+	return !t.Expires.IsZero() && now.After(t.Expires)
+}
+
+// ParseTokens parses a comma-separated list of tokens, each of which is a
+// pipe-delimited label, token and optional expiration time in RFC 3339 format,
+// for example:
+//
+//	old|abcdef|2024-06-01T00:00:00Z,new|ghijkl
+func ParseTokens(s string) ([]Token, error) {
+	var tokens []Token
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "|")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, errors.New("expected label|token[|expiration] but got %v parts", len(parts))
+		}
+		token := Token{
+			Label: strings.TrimSpace(parts[0]),
+			Token: strings.TrimSpace(parts[1]),
+		}
+		if token.Label == "" || token.Token == "" {
+			return nil, errors.New("token entries require both a label and a token")
+		}
+		if len(parts) == 3 {
+			expires, err := time.Parse(time.RFC3339, strings.TrimSpace(parts[2]))
+			if err != nil {
+				return nil, errors.New("invalid expiration for token %v: %v", token.Label, err)
+			}
+			token.Expires = expires
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// TokenFilter is a filter that only allows requests carrying one of the
+// expected tokens in common.TokenHeader and mimics Apache for everything else.
+type TokenFilter struct {
+	tokens     []Token
+	tokensMx   sync.RWMutex
 	instrument instrument.Instrument
 }
 
-func New(token string, instrument instrument.Instrument) filters.Filter {
-	return &tokenFilter{
-		token:      token,
+// New creates a TokenFilter that accepts the single given token, labeled
+// DefaultLabel. If token is empty, all requests are allowed.
+func New(token string, instrument instrument.Instrument) *TokenFilter {
+	return NewWithTokens(singleToken(token), instrument)
+}
+
+// NewWithTokens creates a TokenFilter that accepts any of the given tokens
+// until they expire. If tokens is empty, all requests are allowed.
+func NewWithTokens(tokens []Token, instrument instrument.Instrument) *TokenFilter {
+	return &TokenFilter{
+		tokens:     tokens,
 		instrument: instrument,
 	}
 }
 
-func (f *tokenFilter) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
+func singleToken(token string) []Token {
+	if token == "" {
+		return nil
+	}
+	return []Token{{Token: token, Label: DefaultLabel}}
+}
+
+// SetToken replaces the accepted tokens with the single given token. It's safe
+// to call while the filter is in use.
+func (f *TokenFilter) SetToken(token string) {
+	f.SetTokens(singleToken(token))
+}
+
+// SetTokens replaces the accepted tokens. It's safe to call while the filter
+// is in use.
+func (f *TokenFilter) SetTokens(tokens []Token) {
+	f.tokensMx.Lock()
+	f.tokens = tokens
+	f.tokensMx.Unlock()
+}
+
+func (f *TokenFilter) getTokens() []Token {
+	f.tokensMx.RLock()
+	defer f.tokensMx.RUnlock()
+	return f.tokens
+}
+
+// match finds the configured token matching any of the candidates. If the
+// matching token has expired, it's still returned, with expired set to true.
+func (f *TokenFilter) match(candidates []string, now time.Time) (token *Token, expired bool) {
+	tokens := f.getTokens()
+	for _, candidate := range candidates {
+		for i := range tokens {
+			if candidate != tokens[i].Token {
+				continue
+			}
+			if tokens[i].expired(now) {
+				token, expired = &tokens[i], true
+				// keep looking in case another candidate matches an unexpired token
+				continue
+			}
+			return &tokens[i], false
+		}
+	}
+	return
+}
+
+func (f *TokenFilter) Apply(cs *filters.ConnectionState, req *http.Request, next filters.Next) (*http.Response, *filters.ConnectionState, error) {
 	if log.IsTraceEnabled() {
 		reqStr, _ := httputil.DumpRequest(req, true)
 		log.Tracef("Token Filter Middleware received request:\n%s", reqStr)
 	}
 
-	if f.token == "" {
+	if len(f.getTokens()) == 0 {
 		log.Trace("Not checking token")
 		return next(cs, req)
 	}
@@ -44,20 +163,26 @@ func (f *tokenFilter) Apply(cs *filters.ConnectionState, req *http.Request, next
 		f.instrument.Mimic(req.Context(), true)
 		return mimicApache(cs, req)
 	}
-	tokenMatched := false
-	for _, candidate := range tokens {
-		if candidate == f.token {
-			tokenMatched = true
-			break
-		}
+	token, expired := f.match(tokens, time.Now())
+	if token != nil {
+		f.instrument.AuthToken(req.Context(), token.Label, expired)
 	}
-	if tokenMatched {
+	if token != nil && !expired {
 		req.Header.Del(common.TokenHeader)
-		log.Tracef("Allowing connection from %v to %v", req.RemoteAddr, req.Host)
+		log.Tracef("Allowing connection from %v to %v with token %v", req.RemoteAddr, req.Host, token.Label)
+		if wc, ok := cs.Downstream().(listeners.WrapConn); ok {
+			wc.ControlMessage("measured", map[string]interface{}{
+				common.AuthTokenLabel: token.Label,
+			})
+		}
 		f.instrument.Mimic(req.Context(), false)
 		return next(cs, req)
 	}
-	log.Errorf("Mismatched token(s) %v, mimicking apache", strings.Join(tokens, ","))
+	if expired {
+		log.Errorf("Expired token %v, mimicking apache", token.Label)
+	} else {
+		log.Errorf("Mismatched token(s) %v, mimicking apache", strings.Join(tokens, ","))
+	}
 	f.instrument.Mimic(req.Context(), true)
 	return mimicApache(cs, req)
 }
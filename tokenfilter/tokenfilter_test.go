@@ -0,0 +1,75 @@
+package tokenfilter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
+)
+
+func TestParseTokens(t *testing.T) {
+	tokens, err := ParseTokens("old|abc|2024-06-01T00:00:00Z, new|def")
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	assert.Equal(t, Token{Label: "old", Token: "abc", Expires: time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)}, tokens[0])
+	assert.Equal(t, Token{Label: "new", Token: "def"}, tokens[1])
+
+	tokens, err = ParseTokens("")
+	require.NoError(t, err)
+	assert.Empty(t, tokens)
+
+	_, err = ParseTokens("abc")
+	assert.Error(t, err, "missing label should fail")
+	_, err = ParseTokens("|abc")
+	assert.Error(t, err, "empty label should fail")
+	_, err = ParseTokens("old|abc|tomorrow")
+	assert.Error(t, err, "invalid expiration should fail")
+}
+
+func TestMatch(t *testing.T) {
+	now := time.Now()
+	f := NewWithTokens([]Token{
+		{Label: "old", Token: "abc", Expires: now.Add(-time.Minute)},
+		{Label: "new", Token: "def", Expires: now.Add(time.Minute)},
+		{Label: "forever", Token: "ghi"},
+	}, instrument.NoInstrument{})
+
+	token, expired := f.match([]string{"def"}, now)
+	if assert.NotNil(t, token) {
+		assert.Equal(t, "new", token.Label)
+		assert.False(t, expired)
+	}
+
+	token, expired = f.match([]string{"ghi"}, now.Add(24*time.Hour))
+	if assert.NotNil(t, token) {
+		assert.Equal(t, "forever", token.Label)
+		assert.False(t, expired)
+	}
+
+	token, expired = f.match([]string{"abc"}, now)
+	if assert.NotNil(t, token) {
+		assert.Equal(t, "old", token.Label)
+		assert.True(t, expired)
+	}
+
+	token, expired = f.match([]string{"abc", "def"}, now)
+	if assert.NotNil(t, token) {
+		assert.Equal(t, "new", token.Label, "unexpired token should win over expired one")
+		assert.False(t, expired)
+	}
+
+	token, _ = f.match([]string{"xyz"}, now)
+	assert.Nil(t, token)
+
+	f.SetToken("xyz")
+	token, expired = f.match([]string{"xyz"}, now)
+	if assert.NotNil(t, token) {
+		assert.Equal(t, DefaultLabel, token.Label)
+		assert.False(t, expired)
+	}
+	token, _ = f.match([]string{"def"}, now)
+	assert.Nil(t, token, "SetToken should replace all tokens")
+}
@@ -1,33 +1,230 @@
+// Package usage keeps track of the data usage of devices, as last reported by
+// Redis plus whatever has been used locally since.
 package usage
 
 import (
 	"sync"
 	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/getlantern/http-proxy-lantern/v2/instrument"
 )
 
-var (
-	mutex           sync.RWMutex
-	usageByDeviceID = make(map[string]*Usage)
+const (
+	DefaultMaxDevices     = 200000
+	DefaultRefreshAfter   = 10 * time.Minute
+	DefaultMaxAge         = 1 * time.Hour
+	DefaultReportInterval = 1 * time.Minute
 )
 
 type Usage struct {
 	CountryCode string
-	Bytes       int64
-	AsOf        time.Time
-	TTLSeconds  int64
+	// Bytes is the total of BytesIn and BytesOut
+	Bytes int64
+	// BytesIn is the number of bytes uploaded by the device
+	BytesIn int64
+	// BytesOut is the number of bytes downloaded by the device
+	BytesOut   int64
+	AsOf       time.Time
+	TTLSeconds int64
+
+	// touched is the later of AsOf and the last time local usage was added,
+	// which determines when the Usage expires
+	touched time.Time
+
+	// unsubmittedIn and unsubmittedOut are the bytes added locally that haven't
+	// been submitted to Redis yet, which are kept when Usage is Set
+	unsubmittedIn  int64
+	unsubmittedOut int64
+}
+
+// Options configures a Cache
+type Options struct {
+	// MaxDevices is the maximum number of devices to keep. Once reached, the
+	// least recently used devices are dropped. Defaults to DefaultMaxDevices.
+	MaxDevices int
+
+	// RefreshAfter is the age after which Get reports Usage as stale, meaning
+	// that it should be fetched again. Defaults to DefaultRefreshAfter.
+	RefreshAfter time.Duration
+
+	// MaxAge is the age after which Usage is dropped. Adding local usage
+	// resets the age for this purpose, so that devices that are still in use
+	// keep their Usage while Redis is unavailable. Defaults to DefaultMaxAge.
+	MaxAge time.Duration
+
+	// ReportInterval is how frequently to drop old Usage and report the number
+	// of entries and hit ratio. Defaults to DefaultReportInterval.
+	ReportInterval time.Duration
+
+	Instrument instrument.Instrument
+}
+
+// Cache holds the Usage of a bounded number of devices.
+type Cache struct {
+	opts    *Options
+	entries *lru.Cache
+	hits    int64
+	misses  int64
+	mx      sync.Mutex
+}
+
+// New creates a new Cache and starts expiring entries in the background.
+func New(opts Options) *Cache {
+	c := newCache(opts)
+	go c.keepClean()
+	return c
+}
+
+func newCache(opts Options) *Cache {
+	if opts.MaxDevices <= 0 {
+		opts.MaxDevices = DefaultMaxDevices
+	}
+	if opts.RefreshAfter <= 0 {
+		opts.RefreshAfter = DefaultRefreshAfter
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = DefaultMaxAge
+	}
+	if opts.ReportInterval <= 0 {
+		opts.ReportInterval = DefaultReportInterval
+	}
+	if opts.Instrument == nil {
+		opts.Instrument = instrument.NoInstrument{}
+	}
+	// lru.New only fails for non-positive sizes
+	entries, _ := lru.New(opts.MaxDevices)
+	return &Cache{
+		opts:    &opts,
+		entries: entries,
+	}
+}
+
+// Set sets the Usage in bytes uploaded (bytesIn) and downloaded (bytesOut) for the given device as of the given time and known to be resetting within ttlSeconds.
+// Usage that was added locally but hasn't been Submitted yet is added on top.
+func (c *Cache) Set(dev string, countryCode string, bytesIn int64, bytesOut int64, asOf time.Time, ttlSeconds int64) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	u := &Usage{
+		CountryCode: countryCode,
+		AsOf:        asOf,
+		TTLSeconds:  ttlSeconds,
+		touched:     asOf,
+	}
+	if _existing, found := c.entries.Peek(dev); found {
+		existing := _existing.(*Usage)
+		u.unsubmittedIn = existing.unsubmittedIn
+		u.unsubmittedOut = existing.unsubmittedOut
+		if existing.touched.After(u.touched) {
+			u.touched = existing.touched
+		}
+	}
+	u.BytesIn = bytesIn + u.unsubmittedIn
+	u.BytesOut = bytesOut + u.unsubmittedOut
+	u.Bytes = u.BytesIn + u.BytesOut
+	c.entries.Add(dev, u)
+}
+
+// Add adds bytesIn and bytesOut that haven't been submitted to Redis yet to the
+// Usage of the given device, so that caps keep being enforced between (and
+// despite failing) submissions. Devices without any known Usage are ignored.
+func (c *Cache) Add(dev string, bytesIn int64, bytesOut int64) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	_u, found := c.entries.Peek(dev)
+	if !found {
+		return
+	}
+	updated := *_u.(*Usage)
+	updated.BytesIn += bytesIn
+	updated.BytesOut += bytesOut
+	updated.Bytes += bytesIn + bytesOut
+	updated.unsubmittedIn += bytesIn
+	updated.unsubmittedOut += bytesOut
+	updated.touched = time.Now()
+	c.entries.Add(dev, &updated)
+}
+
+// Submitted records that bytesIn and bytesOut previously added for the given
+// device have been submitted to Redis, so they're no longer added on top of
+// Usage that's Set.
+func (c *Cache) Submitted(dev string, bytesIn int64, bytesOut int64) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	_u, found := c.entries.Peek(dev)
+	if !found {
+		return
+	}
+	updated := *_u.(*Usage)
+	updated.unsubmittedIn = max(updated.unsubmittedIn-bytesIn, 0)
+	updated.unsubmittedOut = max(updated.unsubmittedOut-bytesOut, 0)
+	c.entries.Add(dev, &updated)
+}
+
+// Get gets the Usage for the given device, or nil if it's unknown or expired.
+// stale indicates that the Usage is older than RefreshAfter and should be
+// fetched again.
+func (c *Cache) Get(dev string) (u *Usage, stale bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	_u, found := c.entries.Get(dev)
+	if !found {
+		c.misses++
+		return nil, false
+	}
+	u = _u.(*Usage)
+	if time.Since(u.touched) > c.opts.MaxAge {
+		c.entries.Remove(dev)
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	return u, time.Since(u.AsOf) > c.opts.RefreshAfter
+}
+
+// Peek is like Get, but doesn't count towards the hit ratio or mark the device
+// as recently used, so that inspecting Usage doesn't affect the Cache.
+func (c *Cache) Peek(dev string) (u *Usage, stale bool) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	_u, found := c.entries.Peek(dev)
+	if !found {
+		return nil, false
+	}
+	u = _u.(*Usage)
+	if time.Since(u.touched) > c.opts.MaxAge {
+		return nil, false
+	}
+	return u, time.Since(u.AsOf) > c.opts.RefreshAfter
+}
+
+// Len returns the number of devices in the cache.
+func (c *Cache) Len() int {
+	return c.entries.Len()
 }
 
-// Set sets the Usage in bytes for the given device as of the given time and known to be resetting within ttlSeconds
-func Set(dev string, countryCode string, usage int64, asOf time.Time, ttlSeconds int64) {
-	mutex.Lock()
-	usageByDeviceID[dev] = &Usage{countryCode, usage, asOf, ttlSeconds}
-	mutex.Unlock()
+// removeExpired drops expired Usage and returns the number of
+// remaining entries along with the number of hits and misses since it was last
+// called.
+func (c *Cache) removeExpired() (entries int, hits int64, misses int64) {
+	cutoff := time.Now().Add(-1 * c.opts.MaxAge)
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	for _, dev := range c.entries.Keys() {
+		_u, found := c.entries.Peek(dev)
+		if found && _u.(*Usage).touched.Before(cutoff) {
+			c.entries.Remove(dev)
+		}
+	}
+	hits, misses = c.hits, c.misses
+	c.hits, c.misses = 0, 0
+	return c.entries.Len(), hits, misses
 }
 
-// Get gets the Usage for the given device.
-func Get(dev string) *Usage {
-	mutex.RLock()
-	result := usageByDeviceID[dev]
-	mutex.RUnlock()
-	return result
+func (c *Cache) keepClean() {
+	for {
+		time.Sleep(c.opts.ReportInterval)
+		c.opts.Instrument.UsageCache(c.removeExpired())
+	}
 }
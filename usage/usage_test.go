@@ -0,0 +1,121 @@
+package usage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCache(t *testing.T) {
+	c := newCache(Options{MaxDevices: 2, RefreshAfter: time.Minute, MaxAge: time.Hour})
+
+	u, _ := c.Get("a")
+	assert.Nil(t, u)
+
+	c.Set("a", "ir", 2, 3, time.Now(), 60)
+	u, stale := c.Get("a")
+	if assert.NotNil(t, u) {
+		assert.EqualValues(t, 5, u.Bytes)
+		assert.False(t, stale)
+	}
+
+	c.Add("a", 10, 20)
+	c.Add("unknown", 10, 20)
+	u, _ = c.Get("a")
+	assert.EqualValues(t, 12, u.BytesIn)
+	assert.EqualValues(t, 23, u.BytesOut)
+	assert.EqualValues(t, 35, u.Bytes)
+	assert.Equal(t, 1, c.Len(), "adding to unknown devices should be ignored")
+
+	c.Set("b", "ir", 0, 0, time.Now().Add(-2*time.Minute), 60)
+	_, stale = c.Get("b")
+	assert.True(t, stale, "usage older than RefreshAfter should be stale")
+
+	c.Set("c", "ir", 0, 0, time.Now().Add(-2*time.Hour), 60)
+	u, _ = c.Get("a")
+	assert.Nil(t, u, "least recently used device should have been dropped")
+	u, _ = c.Get("c")
+	assert.Nil(t, u, "usage older than MaxAge should be dropped")
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestRemoveExpired(t *testing.T) {
+	c := newCache(Options{MaxAge: time.Hour})
+	c.Set("old", "", 0, 0, time.Now().Add(-2*time.Hour), 60)
+	c.Set("new", "", 0, 0, time.Now(), 60)
+	c.Get("new")
+	c.Get("missing")
+
+	entries, hits, misses := c.removeExpired()
+	assert.Equal(t, 1, entries)
+	assert.EqualValues(t, 1, hits)
+	assert.EqualValues(t, 1, misses)
+
+	_, hits, misses = c.removeExpired()
+	assert.Zero(t, hits+misses, "hits and misses should be reset")
+}
+
+func TestPeek(t *testing.T) {
+	c := newCache(Options{MaxDevices: 2, MaxAge: time.Hour})
+	c.Set("old", "ir", 0, 0, time.Now().Add(-2*time.Hour), 60)
+	u, _ := c.Peek("old")
+	assert.Nil(t, u, "expired usage shouldn't be returned")
+	u, _ = c.Peek("missing")
+	assert.Nil(t, u)
+	_, hits, misses := c.removeExpired()
+	assert.Zero(t, hits+misses, "peeking shouldn't count towards the hit ratio")
+
+	c.Set("a", "ir", 2, 3, time.Now(), 60)
+	c.Set("b", "ir", 0, 0, time.Now(), 60)
+	u, _ = c.Peek("a")
+	if assert.NotNil(t, u) {
+		assert.EqualValues(t, 5, u.Bytes)
+	}
+	c.Set("c", "ir", 0, 0, time.Now(), 60)
+	u, _ = c.Peek("a")
+	assert.Nil(t, u, "peeking shouldn't mark usage as recently used")
+}
+
+func TestLocalUsageKeepsEntries(t *testing.T) {
+	c := newCache(Options{RefreshAfter: time.Minute, MaxAge: time.Hour})
+	c.Set("a", "ir", 2, 3, time.Now().Add(-2*time.Hour), 60)
+	c.Add("a", 10, 20)
+
+	entries, _, _ := c.removeExpired()
+	assert.Equal(t, 1, entries, "usage with recent local additions shouldn't expire")
+	u, stale := c.Get("a")
+	if assert.NotNil(t, u, "usage with recent local additions shouldn't expire") {
+		assert.EqualValues(t, 35, u.Bytes)
+		assert.True(t, stale, "usage should still be refreshed from Redis")
+	}
+}
+
+func TestSetKeepsUnsubmittedUsage(t *testing.T) {
+	c := newCache(Options{})
+	c.Set("a", "ir", 2, 3, time.Now(), 60)
+	c.Add("a", 10, 20)
+
+	c.Set("a", "ir", 4, 6, time.Now(), 60)
+	u, _ := c.Get("a")
+	if assert.NotNil(t, u) {
+		assert.EqualValues(t, 14, u.BytesIn, "unsubmitted usage should be kept")
+		assert.EqualValues(t, 26, u.BytesOut, "unsubmitted usage should be kept")
+		assert.EqualValues(t, 40, u.Bytes)
+	}
+
+	c.Submitted("a", 10, 5)
+	c.Set("a", "ir", 14, 11, time.Now(), 60)
+	u, _ = c.Get("a")
+	if assert.NotNil(t, u) {
+		assert.EqualValues(t, 14, u.BytesIn, "submitted usage shouldn't be added again")
+		assert.EqualValues(t, 26, u.BytesOut)
+	}
+
+	c.Submitted("a", 100, 100)
+	c.Set("a", "ir", 14, 26, time.Now(), 60)
+	u, _ = c.Get("a")
+	if assert.NotNil(t, u) {
+		assert.EqualValues(t, 40, u.Bytes)
+	}
+}